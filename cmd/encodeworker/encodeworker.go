@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/lpms/ffmpeg"
+)
+
+// Encodes segments decoded by other processes, eg cmd/scheduling with
+// -encodeSockets, received over a Unix socket.
+func main() {
+	sock := flag.String("socket", "", "Path of the Unix socket to listen on")
+	flag.Parse()
+	if *sock == "" {
+		glog.Errorf("Please provide the socket as `%s -socket <path>`", os.Args[0])
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	ffmpeg.InitFFmpeg()
+	srv, err := ffmpeg.NewEncodeServer(*sock)
+	if err != nil {
+		glog.Fatal("Unable to listen: ", err)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		srv.Close()
+	}()
+	glog.Infof("Encode worker listening on %s", *sock)
+	if err := srv.Serve(); err != nil {
+		glog.Fatal("Encode worker failed: ", err)
+	}
+}
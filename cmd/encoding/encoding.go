@@ -76,13 +76,12 @@ func main() {
 		panic(err)
 	}
 	fmt.Printf("profile=input frames=%v pixels=%v\n", res.Decoded.Frames, res.Decoded.Pixels)
-	fmt.Println("size of buffer", res.DframeBuf.Dframebuffer)
+	defer res.DframeBuf.Release()
 	_, err = ffmpeg.Encode(&ffmpeg.EncodeOptionsIn{
 		Fname:     fname,
 		DframeBuf: res.DframeBuf,
 		Accel:     accel,
 		Device:    dev,
-		Ictx:      res.Ictx,
 	}, options)
 	if err != nil {
 		panic(err)
@@ -84,7 +84,7 @@ func main() {
 	table.AppendBulk(data)
 	table.Render()
 
-	fmt.Println("timestamp,session,segment,seg_dur,transcode_time")
+	fmt.Println("timestamp,session,segment,seg_dur,transcode_time,decode_time,filter_time,encode_time,mux_time")
 	segCount := 0
 	realTimeSegCount := 0
 	srcDur := 0.0
@@ -135,12 +135,20 @@ func main() {
 				}
 				out := profs2opts(profiles)
 				t := time.Now()
-				_, err := tc.Transcode(in, out)
+				res, err := tc.Transcode(in, out)
 				end := time.Now()
 				if err != nil {
 					glog.Fatalf("Transcoding failed for session %d segment %d: %v", k, j, err)
 				}
-				fmt.Printf("%s,%d,%d,%0.4v,%0.4v\n", end.Format("2006-01-02 15:04:05.9999"), k, j, v.Duration, end.Sub(t).Seconds())
+				// per-stage times are summed over all renditions
+				var filterDur, encodeDur, muxDur time.Duration
+				for _, r := range res.Encoded {
+					filterDur += r.FilterTime
+					encodeDur += r.EncodeTime
+					muxDur += r.MuxTime
+				}
+				fmt.Printf("%s,%d,%d,%0.4v,%0.4v,%0.4v,%0.4v,%0.4v,%0.4v\n", end.Format("2006-01-02 15:04:05.9999"), k, j, v.Duration, end.Sub(t).Seconds(),
+					res.Decoded.DecodeTime.Seconds(), filterDur.Seconds(), encodeDur.Seconds(), muxDur.Seconds())
 				segTxDur := end.Sub(t).Seconds()
 				mu.Lock()
 				transcodeDur += segTxDur
@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// "github.com/livepeer/lpms/scheduler"
@@ -24,7 +25,7 @@ import (
 	"github.com/olekukonko/tablewriter"
 )
 
-const resourceLimit int64 = 4096 * 1024 // vram limit to 4gb temporarily
+const resourceLimit int64 = 4 << 30 // vram limit in bytes, 4gb temporarily
 const MAXSTREAM int = 100
 
 /*
@@ -50,6 +51,7 @@ func main() {
 	transcodingOptions := flag.String("transcodingOptions", "P240p30fps16x9,P360p30fps16x9,P720p30fps16x9", "Transcoding options for broadcast job, or path to json config")
 	nvidia := flag.String("nvidia", "", "Comma-separated list of Nvidia GPU device IDs to use for transcoding")
 	outPrefix := flag.String("outPrefix", "", "Output segments' prefix (no segments are generated by default)")
+	encodeSockets := flag.String("encodeSockets", "", "Comma-separated list of cmd/encodeworker sockets, one per device, to encode out of process")
 
 	flag.Parse()
 
@@ -101,7 +103,14 @@ func main() {
 
 	fmt.Println("timestamp,session,segment,seg_dur,transcode_time")
 
-	scheduler := CreateNewScheduler(len(devices))
+	sockets := []string{}
+	if *encodeSockets != "" {
+		sockets = strings.Split(*encodeSockets, ",")
+		if len(sockets) != len(devices) {
+			glog.Fatalf("Expected one encode socket per device; got %d sockets for %d devices", len(sockets), len(devices))
+		}
+	}
+	scheduler := CreateNewScheduler(len(devices), sockets)
 	scheduler.Start()
 	start := time.Now()
 
@@ -156,17 +165,17 @@ func main() {
 				}
 				out := profs2opts(profiles)
 
-				/*
-					scheduler.workers[0].Gpumem += encoption2kilobyte(out)
-					for {
-						if scheduler.workers[0].Gpumem <= resourceLimit {
-							// fmt.Printf("VRAM usage=%d felt below resource limit. Continuing...\n", scheduler.workers[0].Gpumem)
-							break
-						}
-						fmt.Printf("VRAM usage=%d exceeded resource limit. Sleeping...\n", scheduler.workers[0].Gpumem)
-						time.Sleep(300 * time.Millisecond)
+				// hold off decoding while the decoded frames of earlier segments
+				// waiting on this worker already take up the vram budget
+				worker := scheduler.workers[k%len(devices)]
+				for {
+					gpumem := atomic.LoadInt64(&worker.Gpumem)
+					if gpumem < resourceLimit {
+						break
 					}
-				*/
+					fmt.Printf("VRAM usage=%d exceeded resource limit. Sleeping...\n", gpumem)
+					time.Sleep(300 * time.Millisecond)
+				}
 
 				for {
 					diffCount := sumOfarray(scheduler.decodeCnts[k]) - sumOfarray(scheduler.encodeCnts[k])
@@ -185,6 +194,7 @@ func main() {
 				if err != nil {
 					glog.Fatalf("Decoding failed for session %d segment %d: %v", k, j, err)
 				}
+				atomic.AddInt64(&worker.Gpumem, res.HWBytes)
 
 				gpuid, _ := strconv.Atoi(devices[k%len(devices)])
 
@@ -195,10 +205,10 @@ func main() {
 						Accel:     accel,
 						Device:    devices[k%len(devices)],
 						DecHandle: res.DecHandle,
-						Dmeta:     res.Dmeta,
 						Pixels:    res.Decoded.Pixels,
 					},
 					ps:       out,
+					gpumem:   res.HWBytes,
 					device:   gpuid,
 					streamId: k,
 					segCount: j,
@@ -335,6 +345,7 @@ type EncodeJob struct {
 	ID       int
 	input    *ffmpeg.EncodeOptionsIn
 	ps       []ffmpeg.TranscodeOptions
+	gpumem   int64 // vram held by the decoded frames
 	device   int
 	streamId int
 	segCount int
@@ -344,8 +355,9 @@ type EncodeWorker struct {
 	ID        int
 	jobs      chan *EncodeJob
 	encoder   *ffmpeg.Encoder
+	remote    *ffmpeg.RemoteEncoder // encodes out of process if set
 	encStatus chan *EncodeStatus
-	Gpumem    int64
+	Gpumem    int64 // vram held by decoded frames queued on this worker; atomic
 	Quit      chan bool
 }
 
@@ -363,7 +375,7 @@ type EncodeScheduler struct {
 	workers    []*EncodeWorker
 }
 
-func CreateNewScheduler(numEncoders int) *EncodeScheduler {
+func CreateNewScheduler(numEncoders int, sockets []string) *EncodeScheduler {
 	s := &EncodeScheduler{
 		jobs:      make(chan *EncodeJob),
 		encStatus: make(chan *EncodeStatus),
@@ -376,6 +388,13 @@ func CreateNewScheduler(numEncoders int) *EncodeScheduler {
 
 	for i := 0; i < numEncoders; i++ {
 		worker := CreateNewEncodeWorker(i, s.encStatus)
+		if len(sockets) > 0 {
+			remote, err := ffmpeg.DialEncoder(sockets[i])
+			if err != nil {
+				glog.Fatalf("Unable to connect to encode worker %s: %v", sockets[i], err)
+			}
+			worker.remote = remote
+		}
 		s.workers = append(s.workers, worker)
 		worker.Start()
 	}
@@ -415,18 +434,20 @@ func (w *EncodeWorker) Start() {
 		for {
 			select {
 			case job := <-w.jobs:
-				// for  {
-				// 	if w.Gpumem <= resourceLimit {
-				// 		break
-				// 	}
-				// 	fmt.Printf("VRAM usage=%d exceeded resource limit. Sleeping...\n", w.Gpumem)
-				// 	time.Sleep(300 * time.Millisecond)
-				// }
-				w.encoder.Encode(job.input, job.ps)
+				var err error
+				if w.remote != nil {
+					_, err = w.remote.Encode(job.input.DframeBuf, job.ps)
+				} else {
+					_, err = w.encoder.Encode(job.input, job.ps)
+				}
+				if err != nil {
+					glog.Errorf("Encoding failed for stream %d segment %d: %v", job.streamId, job.segCount, err)
+				}
+				// the job holds the only reference to the decoded frames
+				job.input.DframeBuf.Release()
+				// decrement gpumem after the decoded frames are freed
+				atomic.AddInt64(&w.Gpumem, -job.gpumem)
 				w.encStatus <- &EncodeStatus{StreamId: job.streamId, SegCount: job.segCount}
-				// decrement gpumem after encoding is finished
-				// w.Gpumem -= encoption2kilobyte(job.ps) + pixel2kilobyte(job.input.Pixels)
-				// w.Gpumem -= encoption2kilobyte(job.ps)
 			case <-w.Quit:
 				return
 			}
@@ -435,7 +456,6 @@ func (w *EncodeWorker) Start() {
 }
 
 func (w *EncodeWorker) AddJob(encodeJob *EncodeJob) {
-	//   w.Gpumem += encoption2kilobyte(encodeJob.ps)			// increament dummy value for PoC, fix with real gpumem later...
 	glog.Infof("Adding job to worker %d gpuid=%d\n", w.ID, encodeJob.device)
 	go func() { w.jobs <- encodeJob }()
 }
@@ -443,37 +463,13 @@ func (w *EncodeWorker) AddJob(encodeJob *EncodeJob) {
 func getBestEncoder(workers []*EncodeWorker) int {
 	minId := 0
 	for i, e := range workers {
-		if i == 0 || e.Gpumem < workers[minId].Gpumem {
+		if i == 0 || atomic.LoadInt64(&e.Gpumem) < atomic.LoadInt64(&workers[minId].Gpumem) {
 			minId = i
 		}
 	}
 	return minId
 }
 
-func pixel2kilobyte(pixelcount int64) int64 {
-	return pixelcount * 3 / 1024
-}
-
-func encoption2kilobyte(ps []ffmpeg.TranscodeOptions) int64 {
-	var numOfpixels int64
-	numOfpixels = 0
-	for _, profile := range ps {
-		resolution := profile.Profile.Resolution
-		framerate := profile.Profile.Framerate
-		numOfpixels += resolution2pixelcnt(resolution) * int64(framerate)
-	}
-	return pixel2kilobyte(numOfpixels)
-}
-
-func resolution2pixelcnt(resolution string) int64 {
-	var pixelcnt int64
-	s := strings.Split(resolution, "x")
-	width, _ := strconv.ParseInt(s[0], 10, 64)
-	height, _ := strconv.ParseInt(s[1], 10, 64)
-	pixelcnt = width * height
-	return pixelcnt
-}
-
 func sumOfarray(numbs ...int) int {
 	result := 0
 	for _, v := range numbs {
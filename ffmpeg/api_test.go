@@ -1,8 +1,19 @@
 package ffmpeg
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -154,17 +165,68 @@ func TestTranscoderAPI_Stopped(t *testing.T) {
 	}
 }
 
-func TestTranscoderAPI_TooManyOutputs(t *testing.T) {
+func TestTranscoderAPI_ManyOutputs(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+    `
+	run(cmd)
 
-	out := make([]TranscodeOptions, 11)
+	// More outputs than the original limit of 10
+	out := make([]TranscodeOptions, 16)
 	for i := range out {
-		out[i].VideoEncoder = ComponentOptions{Name: "drop"}
+		out[i] = TranscodeOptions{
+			Oname:   fmt.Sprintf("%s/out_%d.ts", dir, i),
+			Profile: P144p30fps16x9,
+		}
 	}
-	in := &TranscodeOptionsIn{}
+	out[14].VideoEncoder = ComponentOptions{Name: "copy"}
+	out[14].AudioEncoder = ComponentOptions{Name: "copy"}
+	out[15].VideoEncoder = ComponentOptions{Name: "drop"}
+	in := &TranscodeOptionsIn{Fname: dir + "/test-short.ts"}
 	tc := NewTranscoder()
-	_, err := tc.Transcode(in, out)
-	if err == nil || err.Error() != "Too many outputs" {
-		t.Error("Expected 'Too many outputs', got ", err)
+	defer tc.StopTranscoder()
+	for i := 0; i < 2; i++ {
+		res, err := tc.Transcode(in, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 14; j++ {
+			if res.Encoded[j].Frames != 30 {
+				t.Errorf("Output %d: expected 30 frames, got %d", j, res.Encoded[j].Frames)
+			}
+		}
+	}
+	run(`
+        ffprobe -loglevel warning -count_frames -show_streams out_13.ts | grep nb_read_frames=30
+        ffprobe -loglevel warning -show_streams out_15.ts | grep codec_type=audio
+    `)
+
+	// The number of outputs is fixed for the duration of a stream
+	_, err := tc.Transcode(in, out[:12])
+	if err == nil || err.Error() != "Number of outputs changed between segments of the same stream" {
+		t.Error("Expected changed output count, got ", err)
+	}
+
+	// Split path
+	dres, err := Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	for _, n := range []int{4, 16} {
+		res, err := enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, out[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Encoded) != n || res.Encoded[n-3].Frames != 30 {
+			t.Error("Unexpected results ", res.Encoded)
+		}
 	}
 }
 
@@ -897,6 +959,9 @@ func encodingProfiles(t *testing.T, accel Acceleration) {
 	// Encode to all H264 profiles
 	profilesMap := make(map[Profile]string)
 	for v := range ProfileParameters {
+		if ProfileCodecs[v] != H264 {
+			continue
+		}
 		switch v {
 		case ProfileNone:
 		case ProfileH264Baseline:
@@ -1006,6 +1071,584 @@ func encodingProfiles(t *testing.T, accel Acceleration) {
 	tc.StopTranscoder()
 }
 
+func TestTranscoder_VideoCodecs(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	cmd := `
+        cp "$1/../transcoder/test.ts" test.ts
+    `
+	run(cmd)
+
+	in := &TranscodeOptionsIn{Fname: dir + "/test.ts", MaxFrames: 60}
+	prof := func(codec VideoCodec, profile Profile, format Format) VideoProfile {
+		p := P144p30fps16x9
+		p.Encoder = codec
+		p.Profile = profile
+		p.Format = format
+		return p
+	}
+	out := []TranscodeOptions{{
+		Oname:   dir + "/h264.ts",
+		Profile: prof(H264, ProfileH264Main, FormatNone),
+	}, {
+		Oname:   dir + "/hevc.ts",
+		Profile: prof(H265, ProfileH265Main, FormatMPEGTS),
+	}, {
+		Oname:   dir + "/hevc.mp4",
+		Profile: prof(H265, ProfileNone, FormatMP4),
+	}, {
+		Oname:   dir + "/vp9.mp4",
+		Profile: prof(VP9, ProfileVP9Profile0, FormatMP4),
+	}, {
+		Oname:   dir + "/vp9.webm",
+		Profile: prof(VP9, ProfileNone, FormatNone),
+		Muxer:   ComponentOptions{Name: "webm"},
+		// webm doesn't take aac
+		AudioEncoder: ComponentOptions{Name: "drop"},
+	}, {
+		Oname:   dir + "/av1.mp4",
+		Profile: prof(AV1, ProfileAV1Main, FormatMP4),
+		// libaom defaults are very slow
+		VideoEncoder: ComponentOptions{Opts: map[string]string{"cpu-used": "8"}},
+	}}
+	out[0].Profile.Level = "3.1"
+	out[1].Profile.Level = "3.1"
+	tc := NewTranscoder()
+	_, err := tc.Transcode(in, out)
+	if err != nil {
+		t.Error("Unexpected error ", err)
+	}
+	tc.StopTranscoder()
+
+	cmd = `
+		ffprobe -loglevel warning -show_streams h264.ts | grep codec_name=h264
+		ffprobe -loglevel warning -show_streams h264.ts | grep profile=Main
+		ffprobe -loglevel warning -show_streams h264.ts | grep level=31
+		ffprobe -loglevel warning -show_streams hevc.ts | grep codec_name=hevc
+		ffprobe -loglevel warning -show_streams hevc.ts | grep profile=Main
+		ffprobe -loglevel warning -show_streams hevc.ts | grep level=93
+		ffprobe -loglevel warning -show_streams hevc.mp4 | grep codec_name=hevc
+		ffprobe -loglevel warning -show_streams vp9.mp4 | grep codec_name=vp9
+		ffprobe -loglevel warning -show_streams vp9.mp4 | grep "profile=Profile 0"
+		ffprobe -loglevel warning -show_streams vp9.webm | grep codec_name=vp9
+		ffprobe -loglevel warning -show_streams av1.mp4 | grep codec_name=av1
+
+		# audio is still there
+		ffprobe -loglevel warning -show_streams vp9.mp4 | grep codec_name=aac
+		ffprobe -loglevel warning -show_streams av1.mp4 | grep codec_name=aac
+	`
+	run(cmd)
+
+	checkErr := func(p VideoProfile, oname string, accel Acceleration, expected error) {
+		tc := NewTranscoder()
+		defer tc.StopTranscoder()
+		out := []TranscodeOptions{{Oname: dir + "/" + oname, Profile: p, Accel: accel}}
+		_, err := tc.Transcode(in, out)
+		if err != expected {
+			t.Errorf("Unexpected error for %s; wanted %v but got %v", oname, expected, err)
+		}
+	}
+	// Muxers that can't carry the codec
+	checkErr(prof(VP9, ProfileNone, FormatMPEGTS), "vp9.ts", Software, ErrTranscoderMux)
+	checkErr(prof(AV1, ProfileNone, FormatNone), "av1.ts", Software, ErrTranscoderMux)
+	// Profile belonging to another codec
+	checkErr(prof(H265, ProfileH264High, FormatMP4), "mismatch.mp4", Software, ErrTranscoderPrf)
+	checkErr(prof(H264, ProfileVP9Profile0, FormatMP4), "mismatch.mp4", Software, ErrTranscoderPrf)
+	// No hardware encoder for the codec; checked before any hardware is used
+	checkErr(prof(VP9, ProfileNone, FormatMP4), "nv.mp4", Nvidia, ErrTranscoderVcd)
+	// Unknown codec
+	checkErr(prof(VideoCodec(42), ProfileNone, FormatMP4), "unknown.mp4", Software, ErrTranscoderVcd)
+	// Level can't be set for libaom or libvpx
+	p := prof(AV1, ProfileNone, FormatMP4)
+	p.Level = "3.1"
+	checkErr(p, "level.mp4", Software, ErrTranscoderPrf)
+	p = prof(VP9, ProfileNone, FormatMP4)
+	p.Level = "3.1"
+	checkErr(p, "level.mp4", Software, ErrTranscoderPrf)
+}
+
+func TestVideoProfile_Codecs(t *testing.T) {
+	highBitrate := P720p30fps16x9
+	highBitrate.Bitrate = "16000k"
+	tests := []struct {
+		p       VideoProfile
+		codec   VideoCodec
+		profile Profile
+		level   string
+		want    string
+	}{
+		{P720p30fps16x9, H264, ProfileNone, "", "avc1.64001F"},
+		{P720p30fps16x9, H264, ProfileH264High, "4.1", "avc1.640029"},
+		{P720p30fps16x9, H264, ProfileH264Main, "", "avc1.4D401F"},
+		{P720p30fps16x9, H264, ProfileH264ConstrainedHigh, "", "avc1.640C1F"},
+		{P360p30fps16x9, H264, ProfileH264Baseline, "", "avc1.42C01E"},
+		{P720p30fps16x9, H265, ProfileH265Main, "", "hvc1.1.6.L93.B0"},
+		{P720p30fps16x9, H265, ProfileNone, "4", "hvc1.1.6.L120.B0"},
+		{P720p30fps16x9, VP9, ProfileVP9Profile0, "", "vp09.00.31.08"},
+		{P720p30fps16x9, AV1, ProfileAV1Main, "", "av01.0.05M.08"},
+		// Higher framerates and bitrates need higher levels
+		{P720p60fps16x9, H264, ProfileNone, "", "avc1.640020"},
+		{highBitrate, H264, ProfileNone, "", "avc1.640020"},
+		{P720p30fps16x9, VideoCodec(42), ProfileNone, "", ""},
+	}
+	for _, tt := range tests {
+		p := tt.p
+		p.Encoder = tt.codec
+		p.Profile = tt.profile
+		p.Level = tt.level
+		if codecs := VideoProfileToVariantParams(p).Codecs; codecs != tt.want {
+			t.Errorf("Unexpected codecs for %s %s; wanted %s but got %s",
+				p.Name, VideoCodecName[tt.codec], tt.want, codecs)
+		}
+	}
+
+	// Defaults depend on the encoders, and audio is only listed if encoded
+	optTests := []struct {
+		o    TranscodeOptions
+		want string
+	}{
+		{TranscodeOptions{Profile: P720p30fps16x9}, "avc1.64001F,mp4a.40.2"},
+		{TranscodeOptions{Profile: P720p30fps16x9, Accel: Nvidia}, "avc1.4D401F,mp4a.40.2"},
+		{TranscodeOptions{Profile: P720p30fps16x9, AudioEncoder: ComponentOptions{Name: "aac"}}, "avc1.64001F,mp4a.40.2"},
+		{TranscodeOptions{Profile: P720p30fps16x9, AudioEncoder: ComponentOptions{Name: "drop"}}, "avc1.64001F"},
+		{TranscodeOptions{Profile: P720p30fps16x9, AudioEncoder: ComponentOptions{Name: "copy"}}, "avc1.64001F"},
+		{TranscodeOptions{Profile: P720p30fps16x9, VideoEncoder: ComponentOptions{Name: "drop"}}, "mp4a.40.2"},
+		{TranscodeOptions{Profile: P720p30fps16x9, VideoEncoder: ComponentOptions{Name: "copy"}}, "mp4a.40.2"},
+		{TranscodeOptions{Profile: P720p30fps16x9, VideoEncoder: ComponentOptions{Name: "drop"}, AudioEncoder: ComponentOptions{Name: "drop"}}, ""},
+	}
+	for i, tt := range optTests {
+		if codecs := TranscodeOptionsToVariantParams(tt.o).Codecs; codecs != tt.want {
+			t.Errorf("Unexpected codecs for options %d; wanted %s but got %s", i, tt.want, codecs)
+		}
+	}
+}
+
+func TestTranscoder_RateControl(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	cmd := `
+        cp "$1/../transcoder/test.ts" test.ts
+    `
+	run(cmd)
+
+	in := &TranscodeOptionsIn{Fname: dir + "/test.ts", MaxFrames: 60}
+	prof := func(rc RateControl) VideoProfile {
+		p := P144p30fps16x9
+		p.RateControl = rc
+		return p
+	}
+	out := []TranscodeOptions{{
+		Oname:   dir + "/cbr.ts",
+		Profile: prof(RateControl{Mode: RateControlCBR}),
+	}, {
+		Oname:   dir + "/vbr.ts",
+		Profile: prof(RateControl{Mode: RateControlVBR, MaxBitrate: "800k", BufferSize: "1600k"}),
+	}, {
+		Oname:   dir + "/crf.ts",
+		Profile: prof(RateControl{Mode: RateControlCRF, Quality: 30}),
+	}, {
+		Oname:   dir + "/cappedcrf.ts",
+		Profile: prof(RateControl{Mode: RateControlCRF, Quality: 30, MaxBitrate: "500k"}),
+	}, {
+		Oname:   dir + "/override.ts",
+		Profile: prof(RateControl{Mode: RateControlCRF, Quality: 30}),
+		// caller options take precedence
+		VideoEncoder: ComponentOptions{Opts: map[string]string{"crf": "20"}},
+	}}
+	out[2].Profile.Bitrate = ""
+	tc := NewTranscoder()
+	_, err := tc.Transcode(in, out)
+	if err != nil {
+		t.Error("Unexpected error ", err)
+	}
+	tc.StopTranscoder()
+
+	// x264 writes its settings into the stream, with rates in kbps
+	cmd = `
+		grep -a "rc=cbr" cbr.ts
+		grep -a "nal_hrd=cbr" cbr.ts
+		grep -a "bitrate=400 " cbr.ts
+		grep -a "rc=abr" vbr.ts
+		grep -a "bitrate=400 " vbr.ts
+		grep -a "vbv_maxrate=800 vbv_bufsize=1600" vbr.ts
+		grep -a "rc=crf" crf.ts
+		grep -a "crf=30.0" crf.ts
+		grep -a "vbv_maxrate" crf.ts && exit 1
+		grep -a "crf=30.0" cappedcrf.ts
+		grep -a "vbv_maxrate=500 vbv_bufsize=500" cappedcrf.ts
+		grep -a "crf=20.0" override.ts
+	`
+	run(cmd)
+
+	checkErr := func(p VideoProfile, expected error) {
+		tc := NewTranscoder()
+		defer tc.StopTranscoder()
+		out := []TranscodeOptions{{Oname: dir + "/err.ts", Profile: p}}
+		_, err := tc.Transcode(in, out)
+		if err != expected {
+			t.Errorf("Unexpected error for %+v; wanted %v but got %v", p.RateControl, expected, err)
+		}
+	}
+	// VBR needs a cap, at or above the average
+	checkErr(prof(RateControl{Mode: RateControlVBR}), ErrTranscoderRC)
+	checkErr(prof(RateControl{Mode: RateControlVBR, MaxBitrate: "100k"}), ErrTranscoderRC)
+	checkErr(prof(RateControl{Mode: RateControlVBR, MaxBitrate: "800k", BufferSize: "x"}), ErrTranscoderRC)
+	// Out of range quality
+	checkErr(prof(RateControl{Mode: RateControlCRF}), ErrTranscoderRC)
+	checkErr(prof(RateControl{Mode: RateControlCRF, Quality: 52}), ErrTranscoderRC)
+	checkErr(prof(RateControl{Mode: RateControlMode(42)}), ErrTranscoderRC)
+}
+
+// Renditions that may share a hardware session keep their own rate control
+func sharedRateControl(t *testing.T, accel Acceleration) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	cmd := `
+        cp "$1/../transcoder/test.ts" test.ts
+        ffmpeg -loglevel warning -i test.ts -c copy -t 1 test_0.ts
+        ffmpeg -loglevel warning -i test.ts -c copy -ss 1 -t 1 test_1.ts
+    `
+	run(cmd)
+
+	prof := func(bitrate, maxrate string) VideoProfile {
+		p := P240p30fps16x9
+		p.Bitrate = bitrate
+		p.RateControl = RateControl{Mode: RateControlVBR, MaxBitrate: maxrate}
+		return p
+	}
+	outs := func(prefix string, i int) []TranscodeOptions {
+		// The first output opens the session
+		low := TranscodeOptions{
+			Oname:        fmt.Sprintf("%s/%s_low_%d.ts", dir, prefix, i),
+			Profile:      prof("100k", "100k"),
+			Accel:        accel,
+			AudioEncoder: ComponentOptions{Name: "drop"},
+		}
+		high := low
+		high.Oname = fmt.Sprintf("%s/%s_high_%d.ts", dir, prefix, i)
+		high.Profile = prof("1000k", "2000k")
+		return []TranscodeOptions{low, high}
+	}
+	checkSizes := func(out []TranscodeOptions) {
+		low, err := os.Stat(out[0].Oname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		high, err := os.Stat(out[1].Oname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if high.Size() < 3*low.Size() {
+			t.Errorf("Expected %s to be much larger than %s; got %d and %d bytes",
+				out[1].Oname, out[0].Oname, high.Size(), low.Size())
+		}
+	}
+
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	for i := 0; i < 2; i++ {
+		in := &TranscodeOptionsIn{Fname: fmt.Sprintf("%s/test_%d.ts", dir, i), Accel: accel}
+		out := outs("tc", i)
+		if _, err := tc.Transcode(in, out); err != nil {
+			t.Fatal(err)
+		}
+		checkSizes(out)
+
+		// Split path
+		dres, err := dec.Decode(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = outs("split", i)
+		_, err = enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf, Accel: accel}, out)
+		dres.DframeBuf.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSizes(out)
+	}
+}
+
+func TestTranscoder_SharedRateControl(t *testing.T) {
+	sharedRateControl(t, Software)
+}
+
+func TestVideoProfile_RateControl(t *testing.T) {
+	prof := func(rc RateControl) VideoProfile {
+		p := P720p30fps16x9
+		p.RateControl = rc
+		return p
+	}
+	tests := []struct {
+		p       VideoProfile
+		encoder string
+		want    map[string]string
+	}{
+		{P720p30fps16x9, "libx264", nil},
+		{prof(RateControl{Mode: RateControlCBR}), "libx264",
+			map[string]string{"b": "4000000", "minrate": "4000000", "maxrate": "4000000", "bufsize": "4000000", "nal-hrd": "cbr"}},
+		{prof(RateControl{Mode: RateControlCBR, BufferSize: "2000k"}), "h264_nvenc",
+			map[string]string{"b": "4000000", "minrate": "4000000", "maxrate": "4000000", "bufsize": "2000000", "rc": "cbr"}},
+		{prof(RateControl{Mode: RateControlVBR, MaxBitrate: "6000k"}), "libx264",
+			map[string]string{"b": "4000000", "maxrate": "6000000", "bufsize": "6000000", "nal-hrd": "vbr"}},
+		{prof(RateControl{Mode: RateControlVBR, MaxBitrate: "6000k"}), "h264_nvenc",
+			map[string]string{"b": "4000000", "maxrate": "6000000", "bufsize": "6000000", "rc": "vbr"}},
+		{prof(RateControl{Mode: RateControlCRF, Quality: 23}), "libx264",
+			map[string]string{"crf": "23"}},
+		{prof(RateControl{Mode: RateControlCRF, Quality: 23, MaxBitrate: "6000k"}), "h264_nvenc",
+			map[string]string{"b": "0", "cq": "23", "rc": "vbr", "maxrate": "6000000", "bufsize": "6000000"}},
+		{prof(RateControl{Mode: RateControlCRF, Quality: 40}), "libvpx-vp9",
+			map[string]string{"b": "0", "crf": "40"}},
+	}
+	for _, tt := range tests {
+		opts, err := configRateControl(tt.encoder, tt.p)
+		if err != nil {
+			t.Errorf("Unexpected error for %+v with %s: %v", tt.p.RateControl, tt.encoder, err)
+			continue
+		}
+		if len(opts) != len(tt.want) {
+			t.Errorf("Unexpected options for %+v with %s; wanted %v but got %v", tt.p.RateControl, tt.encoder, tt.want, opts)
+			continue
+		}
+		for k, v := range tt.want {
+			if opts[k] != v {
+				t.Errorf("Unexpected options for %+v with %s; wanted %v but got %v", tt.p.RateControl, tt.encoder, tt.want, opts)
+				break
+			}
+		}
+	}
+
+	// BANDWIDTH is the peak bitrate
+	bandwidths := []struct {
+		p    VideoProfile
+		want uint32
+	}{
+		{P720p30fps16x9, 4000000},
+		{prof(RateControl{Mode: RateControlCBR}), 4000000},
+		{prof(RateControl{Mode: RateControlVBR, MaxBitrate: "6000k"}), 6000000},
+		{prof(RateControl{Mode: RateControlCRF, Quality: 23, MaxBitrate: "5000k"}), 5000000},
+	}
+	for _, tt := range bandwidths {
+		if bw := VideoProfileToVariantParams(tt.p).Bandwidth; bw != tt.want {
+			t.Errorf("Unexpected bandwidth for %+v; wanted %d but got %d", tt.p.RateControl, tt.want, bw)
+		}
+	}
+}
+
+func TestTranscoder_Presets(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	cmd := `
+        cp "$1/../transcoder/test.ts" test.ts
+    `
+	run(cmd)
+
+	in := &TranscodeOptionsIn{Fname: dir + "/test.ts", MaxFrames: 60}
+	prof := func(preset Preset, tune Tune) VideoProfile {
+		p := P144p30fps16x9
+		p.Preset = preset
+		p.Tune = tune
+		return p
+	}
+	out := []TranscodeOptions{{
+		Oname:   dir + "/fastest.ts",
+		Profile: prof(PresetFastest, TuneNone),
+	}, {
+		Oname:   dir + "/slowest.ts",
+		Profile: prof(PresetSlowest, TuneNone),
+	}, {
+		Oname:   dir + "/zerolatency.ts",
+		Profile: prof(PresetDefault, TuneZeroLatency),
+	}, {
+		Oname:   dir + "/animation.ts",
+		Profile: prof(PresetFast, TuneAnimation),
+	}, {
+		// Caller options are merged with the defaults
+		Oname:        dir + "/merged.ts",
+		Profile:      prof(PresetDefault, TuneFilm),
+		VideoEncoder: ComponentOptions{Opts: map[string]string{"x264-params": "subme=3"}},
+	}}
+	out[4].Profile.Profile = ProfileH264Baseline
+	tc := NewTranscoder()
+	_, err := tc.Transcode(in, out)
+	if err != nil {
+		t.Error("Unexpected error ", err)
+	}
+	tc.StopTranscoder()
+
+	// x264 writes its settings into the stream
+	cmd = `
+		grep -a "subme=0 " fastest.ts
+		grep -a "subme=10 " slowest.ts
+		grep -a "bframes=0 " zerolatency.ts
+		grep -a "rc_lookahead=0 " zerolatency.ts
+		grep -a "deblock=1:1:1 " animation.ts
+		grep -a "subme=2 " animation.ts
+		grep -a "deblock=1:-1:-1 " merged.ts
+		grep -a "subme=3 " merged.ts
+		ffprobe -loglevel warning -show_streams -select_streams v merged.ts | grep "profile=Constrained Baseline"
+	`
+	run(cmd)
+
+	checkErr := func(p VideoProfile, accel Acceleration, expected error) {
+		tc := NewTranscoder()
+		defer tc.StopTranscoder()
+		out := []TranscodeOptions{{Oname: dir + "/err.ts", Profile: p, Accel: accel}}
+		_, err := tc.Transcode(in, out)
+		if err != expected {
+			t.Errorf("Unexpected error for %v %v; wanted %v but got %v", p.Preset, p.Tune, expected, err)
+		}
+	}
+	// Unknown values
+	checkErr(prof(Preset(42), TuneNone), Software, ErrTranscoderTun)
+	checkErr(prof(PresetDefault, Tune(42)), Software, ErrTranscoderTun)
+	// Tunes the encoder lacks; checked before any hardware is used
+	checkErr(prof(PresetDefault, TuneFilm), Nvidia, ErrTranscoderTun)
+}
+
+// Renditions that may share a hardware session keep their own preset and
+// encoder profile, which are fixed once the encoder is opened
+func sharedPresets(t *testing.T, accel Acceleration) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	cmd := `
+        cp "$1/../transcoder/test.ts" test.ts
+    `
+	run(cmd)
+
+	in := &TranscodeOptionsIn{Fname: dir + "/test.ts", Accel: accel, MaxFrames: 60}
+	prof := func(preset Preset, profile Profile) VideoProfile {
+		p := P240p30fps16x9
+		p.Preset = preset
+		p.Profile = profile
+		return p
+	}
+	outs := func(prefix string) []TranscodeOptions {
+		return []TranscodeOptions{{
+			Oname:   dir + "/" + prefix + "_fast.ts",
+			Profile: prof(PresetFast, ProfileH264Main),
+			Accel:   accel,
+		}, {
+			Oname:   dir + "/" + prefix + "_slowest.ts",
+			Profile: prof(PresetSlowest, ProfileH264High),
+			Accel:   accel,
+		}}
+	}
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	if _, err := tc.Transcode(in, outs("tc")); err != nil {
+		t.Fatal(err)
+	}
+	dres, err := Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	if _, err := enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf, Accel: accel}, outs("split")); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd = `
+        for p in tc split
+        do
+          ffprobe -loglevel warning -show_streams -select_streams v ${p}_fast.ts | grep profile=Main
+          ffprobe -loglevel warning -show_streams -select_streams v ${p}_slowest.ts | grep profile=High
+        done
+    `
+	run(cmd)
+	if accel == Software {
+		// x264 writes its settings into the stream
+		run(`
+            grep -a "subme=2 " tc_fast.ts
+            grep -a "subme=10 " tc_slowest.ts
+        `)
+	}
+}
+
+func TestTranscoder_SharedPresets(t *testing.T) {
+	sharedPresets(t, Software)
+}
+
+func TestVideoProfile_Presets(t *testing.T) {
+	prof := func(preset Preset, tune Tune) VideoProfile {
+		p := P720p30fps16x9
+		p.Preset = preset
+		p.Tune = tune
+		return p
+	}
+	tests := []struct {
+		p       VideoProfile
+		encoder string
+		want    map[string]string
+		err     error
+	}{
+		{P720p30fps16x9, "libx264", map[string]string{}, nil},
+		{P720p30fps16x9, "unknown", map[string]string{}, nil},
+		{prof(PresetSlow, TuneFilm), "libx264", map[string]string{"preset": "slow", "tune": "film"}, nil},
+		{prof(PresetFastest, TuneZeroLatency), "libx265", map[string]string{"preset": "ultrafast", "tune": "zerolatency"}, nil},
+		{prof(PresetFast, TuneZeroLatency), "h264_nvenc", map[string]string{"preset": "fast", "zerolatency": "1", "delay": "0"}, nil},
+		{prof(PresetMedium, TuneFilm), "libvpx-vp9", map[string]string{"deadline": "good", "cpu-used": "2", "tune-content": "film"}, nil},
+		{prof(PresetSlowest, TuneZeroLatency), "libaom-av1", map[string]string{"cpu-used": "0", "lag-in-frames": "0"}, nil},
+		{prof(PresetDefault, TuneAnimation), "hevc_nvenc", nil, ErrTranscoderTun},
+		{prof(PresetFast, TuneNone), "unknown", nil, ErrTranscoderTun},
+	}
+	for _, tt := range tests {
+		opts, err := configPreset(tt.encoder, tt.p)
+		if err != tt.err {
+			t.Errorf("Unexpected error for %v %v with %s; wanted %v but got %v", tt.p.Preset, tt.p.Tune, tt.encoder, tt.err, err)
+			continue
+		}
+		if len(opts) != len(tt.want) {
+			t.Errorf("Unexpected options for %v %v with %s; wanted %v but got %v", tt.p.Preset, tt.p.Tune, tt.encoder, tt.want, opts)
+			continue
+		}
+		for k, v := range tt.want {
+			if opts[k] != v {
+				t.Errorf("Unexpected options for %v %v with %s; wanted %v but got %v", tt.p.Preset, tt.p.Tune, tt.encoder, tt.want, opts)
+				break
+			}
+		}
+	}
+}
+
+func TestVideoProfile_SampleAspect(t *testing.T) {
+	prof := func(res, ar string) VideoProfile {
+		p := P144p30fps16x9
+		p.Resolution = res
+		p.AspectRatio = ar
+		return p
+	}
+	tests := []struct {
+		p      VideoProfile
+		sn, sd int
+		err    error
+	}{
+		{prof("256x144", "16:9"), 1, 1, nil},
+		{prof("256x144", ""), 1, 1, nil},
+		{prof("720x480", "16:9"), 32, 27, nil},
+		{prof("720x480", "4:3"), 8, 9, nil},
+		{prof("1440x1080", "16:9"), 4, 3, nil},
+		{prof("256x144", "16x9"), 0, 0, ErrTranscoderAsp},
+		{prof("256x144", "16:0"), 0, 0, ErrTranscoderAsp},
+		{prof("256x144", "-16:9"), 0, 0, ErrTranscoderAsp},
+		{prof("0x144", "16:9"), 0, 0, ErrTranscoderRes},
+	}
+	for _, tt := range tests {
+		w, h, _ := VideoProfileResolution(tt.p)
+		sn, sd, err := sampleAspect(tt.p, w, h)
+		if err != tt.err || sn != tt.sn || sd != tt.sd {
+			t.Errorf("Unexpected sample aspect for %s at %s; wanted %d:%d %v but got %d:%d %v",
+				tt.p.Resolution, tt.p.AspectRatio, tt.sn, tt.sd, tt.err, sn, sd, err)
+		}
+	}
+}
+
 func TestAPI_SetGOPs(t *testing.T) {
 	setGops(t, Software)
 }
@@ -1232,14 +1875,1892 @@ func audioOnlySegment(t *testing.T, accel Acceleration) {
 			Accel:   accel,
 		}}
 		_, err := tc.Transcode(in, out)
-		if i == 2 && (err == nil || err.Error() != "No video parameters found while initializing stream") {
-			t.Error("Expected to fail for audio-only segment but did not")
-		} else if i != 2 && err != nil {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Same with separate decoding and encoding
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	for i := 2; i < 4; i++ {
+		in := &TranscodeOptionsIn{
+			Fname: fmt.Sprintf("%s/test%d.ts", dir, i),
+			Accel: accel,
+		}
+		dres, err := dec.Decode(in)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		out := []TranscodeOptions{{
+			Oname:   fmt.Sprintf("%s/out3_%d.ts", dir, i),
+			Profile: prof,
+			Accel:   accel,
+		}}
+		_, err = enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, out)
+		dres.DframeBuf.Release()
+		if err != nil {
 			t.Error(err)
 		}
 	}
+
+	cmd = `
+    # audio-only segments yield audio-only outputs
+    for f in out2_2.ts out3_2.ts; do
+      ffprobe -loglevel warning -show_streams -select_streams a $f | grep codec_name=aac
+      ffprobe -loglevel warning -show_streams -select_streams v $f > video.txt
+      [ ! -s video.txt ]
+    done
+
+    # and video resumes with the next segment
+    for f in out2_3.ts out3_3.ts; do
+      ffprobe -loglevel warning -show_streams -select_streams v $f | grep codec_name=h264
+    done
+  `
+	run(cmd)
+}
+
+func TestAPI_AudioOnlyHLS(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+    ffmpeg -loglevel warning -i "$1"/../transcoder/test.ts -t 2 -c:a copy -vn audio.ts
+  `
+	run(cmd)
+
+	// The segmenter takes audio-only inputs
+	err := RTMPToHLS(dir+"/audio.ts", dir+"/out.m3u8", dir+"/out_%d.ts", "1", 0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	cmd = `
+    ffprobe -loglevel warning -show_streams -select_streams a out_0.ts | grep codec_name=aac
+    ffprobe -loglevel warning -show_streams -select_streams v out_0.ts > video.txt
+    [ ! -s video.txt ]
+  `
+	run(cmd)
+
+	// Video showing up later on continues the same playlist, which is only
+	// ended once the stream is over. The video starts after the demuxer
+	// has finished probing the input.
+	cmd = `
+    ffmpeg -loglevel warning -f lavfi -i sine=sample_rate=44100:duration=16 -itsoffset 10 -f lavfi -i testsrc=size=320x240:rate=30:duration=4 -map 0 -map 1 -c:a aac -c:v libx264 -g 30 switch.flv
+  `
+	run(cmd)
+	err = RTMPToHLS(dir+"/switch.flv", dir+"/switch.m3u8", dir+"/switch_%d.ts", "1", 0)
+	if err != nil {
+		t.Error(err)
+	}
+	cmd = `
+    [ $(grep -c EXT-X-ENDLIST switch.m3u8) -eq 1 ]
+    tail -n 1 switch.m3u8 | grep EXT-X-ENDLIST
+    # segment numbers continue from the audio-only ones rather than restarting
+    last=$(grep switch_ switch.m3u8 | tail -n 1)
+    [ $(basename $last .ts | cut -d_ -f2) -ge 12 ]
+    ffprobe -loglevel warning -show_streams -select_streams v $last | grep codec_name=h264
+    ffprobe -loglevel warning -show_streams -select_streams a $last | grep codec_name=aac
+  `
+	run(cmd)
 }
 
 func TestTranscoder_AudioOnly(t *testing.T) {
 	audioOnlySegment(t, Software)
 }
+
+func overlay(t *testing.T, accel Acceleration) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+    cp "$1"/../transcoder/test.ts .
+    ffmpeg -loglevel warning -f lavfi -i color=red:s=64x64 -frames:v 1 wm.png
+  `
+	run(cmd)
+	data, err := ioutil.ReadFile(dir + "/wm.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := &TranscodeOptionsIn{Fname: dir + "/test.ts", Accel: accel, MaxFrames: 30}
+	out := func(name string, o *Overlay) TranscodeOptions {
+		return TranscodeOptions{
+			Oname:   dir + "/" + name,
+			Profile: P144p30fps16x9,
+			Accel:   accel,
+			Overlay: o,
+		}
+	}
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	res, err := tc.Transcode(in, []TranscodeOptions{
+		out("none.ts", nil),
+		out("path.ts", &Overlay{Path: dir + "/wm.png"}),
+		out("data.ts", &Overlay{Data: data, Position: OverlayBottomRight}),
+		out("scaled.ts", &Overlay{Path: dir + "/wm.png", Scale: 0.5}),
+		out("half.ts", &Overlay{Path: dir + "/wm.png", Opacity: 0.5}),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	for i, r := range res.Encoded {
+		if r.Frames != res.Encoded[0].Frames {
+			t.Error("Mismatched frame count for output ", i, r.Frames)
+		}
+	}
+
+	// The output is 256x144 so the unscaled image covers 64x64 pixels inset
+	// by ~3 pixels from the corner, and the scaled one 128x128.
+	cmd = `
+    function pixel {
+      ffmpeg -loglevel warning -i $1 -vf crop=2:2:$2:$3,scale=1:1 -frames:v 1 -f rawvideo -pix_fmt rgb24 - | od -An -tu1
+    }
+    function red {
+      read r g b <<< "$(pixel $@)"
+      [ $r -gt 200 ] && [ $g -lt 60 ] && [ $b -lt 60 ]
+    }
+
+    red path.ts 20 20
+    ! red none.ts 20 20
+    ! red path.ts 100 100
+    red data.ts 220 110
+    ! red data.ts 20 20
+    red scaled.ts 100 100
+
+    # blended halfway between the video and the image
+    read r0 g0 b0 <<< "$(pixel none.ts 20 20)"
+    read r g b <<< "$(pixel half.ts 20 20)"
+    awk "BEGIN { exit !(($r - ($r0 + 255) / 2)^2 < 900 && ($g - $g0 / 2)^2 < 900) }"
+  `
+	run(cmd)
+
+	// Invalid overlays
+	for _, o := range []Overlay{
+		{},
+		{Path: dir + "/wm.png", Position: OverlayPosition(99)},
+		{Path: dir + "/wm.png", Scale: 1.5},
+		{Path: dir + "/wm.png", Scale: -1},
+		{Path: dir + "/wm.png", Opacity: 2},
+	} {
+		o := o
+		_, err := tc.Transcode(in, []TranscodeOptions{out("invalid.ts", &o)})
+		if err != ErrTranscoderOvl {
+			t.Errorf("Expected %v for %+v but got %v", ErrTranscoderOvl, o, err)
+		}
+	}
+	_, err = tc.Transcode(in, []TranscodeOptions{out("missing.ts", &Overlay{Path: dir + "/missing.png"})})
+	if err == nil {
+		t.Error("Expected an error for a missing image")
+	}
+}
+
+func TestTranscoder_Overlay(t *testing.T) {
+	overlay(t, Software)
+}
+
+func aspectModes(t *testing.T, accel Acceleration) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// 4:3 source with square pixels
+	cmd := `
+    cp "$1"/../transcoder/test.ts .
+    ffmpeg -loglevel warning -i test.ts -an -vf scale=640:480,setsar=1 -c:v libx264 -t 1 test43.ts
+  `
+	run(cmd)
+
+	prof := func(mode AspectMode) VideoProfile {
+		p := P144p30fps16x9
+		p.AspectMode = mode
+		return p
+	}
+	anamorphic := prof(AspectPad)
+	anamorphic.Resolution = "720x480"
+	out := func(name string, p VideoProfile) TranscodeOptions {
+		return TranscodeOptions{Oname: dir + "/" + name, Profile: p, Accel: accel}
+	}
+	in := &TranscodeOptionsIn{Fname: dir + "/test43.ts", Accel: accel}
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	_, err := tc.Transcode(in, []TranscodeOptions{
+		out("keep.ts", prof(AspectKeep)),
+		out("pad.ts", prof(AspectPad)),
+		out("crop.ts", prof(AspectCrop)),
+		out("stretch.ts", prof(AspectStretch)),
+		out("anamorphic.ts", anamorphic),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	cmd = `
+    function dims {
+      ffprobe -loglevel warning -select_streams v -show_entries stream=width,height,sample_aspect_ratio,display_aspect_ratio -of csv=p=0 $1
+    }
+    function pixel {
+      ffmpeg -loglevel warning -i $1 -vf crop=2:2:$2:$3,scale=1:1 -frames:v 1 -f rawvideo -pix_fmt gray - | od -An -tu1
+    }
+
+    # the default only keeps the source aspect ratio
+    [ $(dims keep.ts) = "256,192,1:1,4:3" ]
+    [ $(dims pad.ts) = "256,144,1:1,16:9" ]
+    [ $(dims crop.ts) = "256,144,1:1,16:9" ]
+    [ $(dims stretch.ts) = "256,144,1:1,16:9" ]
+    [ $(dims anamorphic.ts) = "720,480,32:27,16:9" ]
+
+    # pillarboxed 192x144 picture in the middle
+    [ $(pixel pad.ts 4 70) -lt 20 ]
+    [ $(pixel pad.ts 250 70) -lt 20 ]
+    # 4:3 displays as 16:9 pixels 540x480 wide, padded to 720
+    [ $(pixel anamorphic.ts 40 240) -lt 20 ]
+  `
+	run(cmd)
+
+	// Invalid aspect ratios or modes
+	invalid := []VideoProfile{prof(AspectPad), prof(AspectCrop), prof(AspectMode(99))}
+	invalid[0].AspectRatio = "16x9"
+	invalid[1].AspectRatio = "16:0"
+	for _, p := range invalid {
+		_, err := tc.Transcode(in, []TranscodeOptions{out("invalid.ts", p)})
+		if err != ErrTranscoderAsp {
+			t.Errorf("Expected %v for %s %v but got %v", ErrTranscoderAsp, p.AspectRatio, p.AspectMode, err)
+		}
+	}
+}
+
+func TestTranscoder_AspectModes(t *testing.T) {
+	aspectModes(t, Software)
+}
+
+func TestTranscoder_CustomFilters(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+    cp "$1"/../transcoder/test.ts .
+    ffmpeg -loglevel warning -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+  `
+	run(cmd)
+
+	out := func(name, pre, post string) TranscodeOptions {
+		return TranscodeOptions{
+			Oname:       dir + "/" + name,
+			Profile:     P144p30fps16x9,
+			PreFilters:  pre,
+			PostFilters: post,
+		}
+	}
+	outs := []TranscodeOptions{
+		// cropped to portrait before scaling, so scaled along the height
+		out("pre.ts", "crop=iw/2:ih", ""),
+		// rotated after scaling
+		out("post.ts", "", "transpose=1"),
+		out("both.ts", "yadif", "hqdn3d"),
+	}
+	in := &TranscodeOptionsIn{Fname: dir + "/test-short.ts"}
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	_, err := tc.Transcode(in, outs)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Same filters through the encoder
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	dres, err := dec.Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	_, err = enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, []TranscodeOptions{
+		out("enc-pre.ts", "crop=iw/2:ih", ""),
+		out("enc-post.ts", "", "transpose=1"),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	cmd = `
+    function dims {
+      ffprobe -loglevel warning -select_streams v -show_entries stream=width,height -of csv=p=0 $1
+    }
+    [ $(dims pre.ts) = "128,144" ]
+    [ $(dims post.ts) = "144,256" ]
+    [ $(dims both.ts) = "256,144" ]
+    [ $(dims enc-pre.ts) = "128,144" ]
+    [ $(dims enc-post.ts) = "144,256" ]
+  `
+	run(cmd)
+
+	// Filters are validated when the filtergraph is initialized. Errors
+	// include the failing description and the reason.
+	tests := []struct {
+		name      string
+		pre, post string
+		expected  string
+	}{
+		{name: "unknown filter", pre: "nosuchfilter", expected: "Invalid video filter description"},
+		{name: "invalid option", post: "hqdn3d=nosuchoption=1", expected: "Invalid video filter description"},
+		{name: "malformed graph", post: "transpose=1[x", expected: "Invalid video filter description"},
+		{name: "unusable size", pre: "crop=iw*2:ih", expected: "Unable to configure video filters"},
+	}
+	// The details don't hide which error it was
+	sentinel := func(desc string) error {
+		for _, err := range ErrorMap {
+			if err.Error() == desc {
+				return err
+			}
+		}
+		t.Fatal("No error for ", desc)
+		return nil
+	}
+	for _, tt := range tests {
+		tc := NewTranscoder()
+		_, err := tc.Transcode(in, []TranscodeOptions{out("invalid.ts", tt.pre, tt.post)})
+		if err == nil || !strings.HasPrefix(err.Error(), tt.expected) ||
+			!strings.Contains(err.Error(), tt.pre+tt.post) || !strings.Contains(err.Error(), "\": ") {
+			t.Errorf("%s: expected %q with the filters and reason but got %v", tt.name, tt.expected, err)
+		}
+		if !errors.Is(err, sentinel(tt.expected)) {
+			t.Errorf("%s: expected %v to be %q", tt.name, err, tt.expected)
+		}
+		tc.StopTranscoder()
+	}
+
+	// Split path
+	dres, err = dec.Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+	_, err = enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, []TranscodeOptions{out("invalid.ts", "nosuchfilter", "")})
+	if err == nil || !strings.HasPrefix(err.Error(), "Invalid video filter description") ||
+		!strings.Contains(err.Error(), "nosuchfilter") {
+		t.Error("Expected invalid filters with the description but got ", err)
+	}
+	if !errors.Is(err, sentinel("Invalid video filter description")) {
+		t.Error("Expected a filter parse error but got ", err)
+	}
+}
+
+func preFilters(t *testing.T, accel Acceleration) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+    cp "$1"/../transcoder/test.ts .
+    ffmpeg -loglevel warning -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+  `
+	run(cmd)
+
+	// Filters that only take software frames, regardless of where the
+	// frames were decoded
+	outs := func(prefix string) []TranscodeOptions {
+		return []TranscodeOptions{{
+			Oname:      dir + "/" + prefix + "-crop.ts",
+			Profile:    P144p30fps16x9,
+			Accel:      accel,
+			PreFilters: "yadif,crop=iw/2:ih",
+		}, {
+			Oname:      dir + "/" + prefix + "-sw.ts",
+			Profile:    P144p30fps16x9,
+			PreFilters: "crop=iw/2:ih",
+		}}
+	}
+	in := &TranscodeOptionsIn{Fname: dir + "/test-short.ts", Accel: accel}
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	if _, err := tc.Transcode(in, outs("tc")); err != nil {
+		t.Fatal(err)
+	}
+	dres, err := Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	if _, err := enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf, Accel: accel}, outs("split")); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd = `
+    function dims {
+      ffprobe -loglevel warning -select_streams v -show_entries stream=width,height -of csv=p=0 $1
+    }
+    for p in tc split
+    do
+      [ $(dims $p-crop.ts) = "128,144" ]
+      [ $(dims $p-sw.ts) = "128,144" ]
+    done
+  `
+	run(cmd)
+}
+
+func TestTranscoder_PreFilters(t *testing.T) {
+	preFilters(t, Software)
+}
+
+func TestAPI_SplitAudio(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+    `
+	run(cmd)
+
+	// Decode once, then encode with transcoded, copied and dropped audio
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	in := &TranscodeOptionsIn{Fname: dir + "/test-short.ts"}
+	dres, err := dec.Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := []TranscodeOptions{{
+		Oname:   dir + "/audioenc.ts",
+		Profile: P144p30fps16x9,
+	}, {
+		Oname:        dir + "/audiocopy.ts",
+		Profile:      P144p30fps16x9,
+		AudioEncoder: ComponentOptions{Name: "copy"},
+	}, {
+		Oname:        dir + "/audiodrop.ts",
+		Profile:      P144p30fps16x9,
+		AudioEncoder: ComponentOptions{Name: "drop"},
+	}}
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	defer dres.DframeBuf.Release()
+	_, err = enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd = `
+        # transcoded audio is present
+        ffprobe -loglevel warning -show_streams -select_streams a audioenc.ts | grep codec_name=aac
+
+        # copied audio matches the input
+        ffmpeg -i test-short.ts -vn -c:a copy -f md5 test-audio.md5
+        ffmpeg -i audiocopy.ts -vn -c:a copy -f md5 audiocopy.md5
+        diff -u test-audio.md5 audiocopy.md5
+
+        # dropped audio is absent
+        ffprobe -loglevel warning -show_streams -select_streams a audiodrop.ts > audiodrop.out
+        [ ! -s audiodrop.out ]
+    `
+	run(cmd)
+}
+
+func TestAPI_SplitCopyDrop(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+        ffmpeg -i test.ts -c:a copy -c:v copy -ss 1 -t 1 test-short2.ts
+    `
+	run(cmd)
+
+	// Source passthrough alongside a transcoded rendition and an audio-only
+	// rendition, over consecutive segments of the same session
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	for i, fname := range []string{"test-short.ts", "test-short2.ts"} {
+		dres, err := dec.Decode(&TranscodeOptionsIn{Fname: dir + "/" + fname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := []TranscodeOptions{{
+			Oname:        fmt.Sprintf("%s/source_%d.ts", dir, i),
+			VideoEncoder: ComponentOptions{Name: "copy"},
+			AudioEncoder: ComponentOptions{Name: "copy"},
+		}, {
+			Oname:   fmt.Sprintf("%s/enc_%d.ts", dir, i),
+			Profile: P144p30fps16x9,
+		}, {
+			Oname:        fmt.Sprintf("%s/audio_%d.ts", dir, i),
+			VideoEncoder: ComponentOptions{Name: "drop"},
+			AudioEncoder: ComponentOptions{Name: "copy"},
+		}}
+		res, err := enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, out)
+		dres.DframeBuf.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Encoded[1].Frames != 30 {
+			t.Error("Unexpected encoded frame count ", res.Encoded[1].Frames)
+		}
+	}
+
+	cmd = `
+        # passthrough matches the input
+        for i in 0 1; do
+            [ $i -eq 0 ] && src=test-short.ts || src=test-short2.ts
+            ffmpeg -i $src -c copy -f md5 src_$i.md5
+            ffmpeg -i source_$i.ts -c copy -f md5 source_$i.md5
+            diff -u src_$i.md5 source_$i.md5
+
+            # transcoded rendition has both streams
+            ffprobe -loglevel warning -show_streams enc_$i.ts | grep codec_name=h264
+            ffprobe -loglevel warning -show_streams enc_$i.ts | grep codec_name=aac
+
+            # video is absent from the audio-only rendition
+            ffprobe -loglevel warning -show_streams -select_streams v audio_$i.ts > audio_$i.out
+            [ ! -s audio_$i.out ]
+            ffmpeg -i $src -vn -c:a copy -f md5 src_audio_$i.md5
+            ffmpeg -i audio_$i.ts -c:a copy -f md5 audio_$i.md5
+            diff -u src_audio_$i.md5 audio_$i.md5
+        done
+    `
+	run(cmd)
+}
+
+func TestAPI_SharedDframeBuffer(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+    `
+	run(cmd)
+
+	dres, err := Decode(&TranscodeOptionsIn{Fname: dir + "/test-short.ts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := dres.DframeBuf
+
+	// Fan out one decoded segment to several encoders
+	var wg sync.WaitGroup
+	profs := []VideoProfile{P144p30fps16x9, P240p30fps16x9}
+	for i, p := range profs {
+		if err := buf.Retain(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int, p VideoProfile) {
+			defer wg.Done()
+			defer buf.Release()
+			out := []TranscodeOptions{{
+				Oname:   fmt.Sprintf("%s/out_%d.ts", dir, i),
+				Profile: p,
+			}}
+			res, err := Encode(&EncodeOptionsIn{DframeBuf: buf}, out)
+			if err != nil {
+				t.Error(err)
+			} else if res.Encoded[0].Frames != 30 {
+				t.Error("Unexpected encoded frame count ", res.Encoded[0].Frames)
+			}
+		}(i, p)
+	}
+	buf.Release()
+	wg.Wait()
+
+	// All references are gone so the buffer should be unusable
+	if err := buf.Retain(); err != ErrTranscoderBuf {
+		t.Error("Expected released buffer error but got ", err)
+	}
+	out := []TranscodeOptions{{Oname: dir + "/released.ts", Profile: P144p30fps16x9}}
+	if _, err := Encode(&EncodeOptionsIn{DframeBuf: buf}, out); err != ErrTranscoderBuf {
+		t.Error("Expected released buffer error but got ", err)
+	}
+
+	cmd = `
+        ffprobe -loglevel warning -count_frames -show_streams -select_streams v out_0.ts | grep nb_read_frames=30
+        ffprobe -loglevel warning -count_frames -show_streams -select_streams v out_1.ts | grep nb_read_frames=30
+    `
+	run(cmd)
+}
+
+func TestAPI_DframeBufferLimits(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        # 1200 frames; more than the default buffer ceiling
+        ffmpeg -f lavfi -i testsrc=size=64x64:rate=60 -t 20 -c:v libx264 long.ts
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+    `
+	run(cmd)
+
+	limitErr := "Too many frames in segment"
+	in := &TranscodeOptionsIn{Fname: dir + "/long.ts"}
+	out := []TranscodeOptions{{Oname: dir + "/out.ts", Profile: P144p30fps16x9}}
+	_, err := Transcode3(in, out)
+	if err == nil || err.Error() != limitErr {
+		t.Error("Expected frame limit error but got ", err)
+	}
+	_, err = Decode(in)
+	if err == nil || err.Error() != limitErr {
+		t.Error("Expected frame limit error but got ", err)
+	}
+
+	// Raise the ceiling
+	in.MaxFrames = 1500
+	res, err := Transcode3(in, out)
+	if err != nil {
+		t.Error(err)
+	} else if res.Decoded.Frames != 1200 {
+		t.Error("Unexpected decoded frame count ", res.Decoded.Frames)
+	}
+	dres, err := Decode(in)
+	if err != nil {
+		t.Error(err)
+	} else {
+		if dres.Decoded.Frames != 1200 {
+			t.Error("Unexpected decoded frame count ", dres.Decoded.Frames)
+		}
+		// At least one yuv420p 64x64 picture per frame, all in host memory
+		if dres.HostBytes < 1200*64*64*3/2 || dres.HWBytes != 0 {
+			t.Error("Unexpected memory footprint ", dres.HostBytes, dres.HWBytes)
+		}
+		dres.DframeBuf.Release()
+	}
+
+	// Lower the ceiling
+	in = &TranscodeOptionsIn{Fname: dir + "/test-short.ts", MaxFrames: 10}
+	_, err = Transcode3(in, out)
+	if err == nil || err.Error() != limitErr {
+		t.Error("Expected frame limit error but got ", err)
+	}
+
+	// Released buffers are reused for subsequent segments of the same session
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	in = &TranscodeOptionsIn{Fname: dir + "/test-short.ts"}
+	dres, err = dec.Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbuf := dres.DframeBuf.buf
+	dres.DframeBuf.Release()
+	dres, err = dec.Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dres.DframeBuf.buf != cbuf {
+		t.Error("Expected frame buffer to be reused")
+	}
+	dres.DframeBuf.Release()
+}
+
+func TestAPI_DecodeStream(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+        ffmpeg -i test.ts -c:a copy -c:v copy -ss 1 -t 1 test-short2.ts
+    `
+	run(cmd)
+
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+
+	// Consecutive segments reuse the decoder and encoder sessions
+	for i, seg := range []string{"test-short.ts", "test-short2.ts"} {
+		in := &TranscodeOptionsIn{Fname: dir + "/" + seg}
+		s, err := dec.DecodeStream(context.Background(), in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := []TranscodeOptions{{
+			Oname:   fmt.Sprintf("%s/out_%d_144p.ts", dir, i),
+			Profile: P144p30fps16x9,
+		}, {
+			Oname:        fmt.Sprintf("%s/out_%d_240p.ts", dir, i),
+			Profile:      P240p30fps16x9,
+			AudioEncoder: ComponentOptions{Name: "copy"},
+		}}
+		res, err := enc.EncodeStream(context.Background(), s, out)
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Decoded.Frames != 60 {
+			t.Error("Unexpected decoded frame count ", res.Decoded.Frames)
+		}
+		for _, r := range res.Encoded {
+			if r.Frames != 30 {
+				t.Error("Unexpected encoded frame count ", r.Frames)
+			}
+		}
+	}
+
+	cmd = `
+        for f in out_0_144p.ts out_0_240p.ts out_1_144p.ts out_1_240p.ts
+        do
+          ffprobe -loglevel warning -count_frames -show_streams -select_streams v $f | grep nb_read_frames=30
+          ffprobe -loglevel warning -show_streams -select_streams a $f | grep codec_name=aac
+        done
+    `
+	run(cmd)
+
+	// Cancelling the stream stops the encode
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := dec.DecodeStream(ctx, &TranscodeOptionsIn{Fname: dir + "/test-short.ts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	out := []TranscodeOptions{{Oname: dir + "/cancelled.ts", Profile: P144p30fps16x9}}
+	_, err = enc.EncodeStream(context.Background(), s, out)
+	if err != context.Canceled {
+		t.Error("Expected cancellation error but got ", err)
+	}
+	s.Close()
+}
+
+func TestAPI_VideoFrames(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+        ffmpeg -i test-short.ts -f rawvideo -pix_fmt yuv420p -vsync passthrough test-short.yuv
+    `
+	run(cmd)
+
+	dres, err := Decode(&TranscodeOptionsIn{Fname: dir + "/test-short.ts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := dres.DframeBuf
+
+	// Pack the planes into raw video to compare against ffmpeg
+	var raw []byte
+	lastPTS := int64(-1)
+	count := 0
+	err = buf.VideoFrames(func(f *Frame) error {
+		if f.Index != count {
+			t.Error("Unexpected frame index ", f.Index, count)
+		}
+		if f.PTS <= lastPTS {
+			t.Error("Expected increasing pts ", f.PTS, lastPTS)
+		}
+		if f.PixelFormat != "yuv420p" || len(f.Planes) != 3 {
+			t.Fatal("Unexpected frame format ", f.PixelFormat, len(f.Planes))
+		}
+		for p := range f.Planes {
+			w, h := f.Width, f.Height
+			if p > 0 {
+				w, h = (w+1)/2, (h+1)/2
+			}
+			for y := 0; y < h; y++ {
+				raw = append(raw, f.Planes[p][y*f.Strides[p]:y*f.Strides[p]+w]...)
+			}
+		}
+		lastPTS = f.PTS
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if count != dres.Decoded.Frames {
+		t.Error("Unexpected frame count ", count, dres.Decoded.Frames)
+	}
+	if err := ioutil.WriteFile(dir+"/frames.yuv", raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	run("cmp test-short.yuv frames.yuv")
+
+	// Errors stop the iteration
+	stop := errors.New("stop")
+	count = 0
+	err = buf.VideoFrames(func(f *Frame) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Error("Expected iteration to stop ", err, count)
+	}
+
+	// Released buffers can't be read
+	buf.Release()
+	err = buf.VideoFrames(func(f *Frame) error { return nil })
+	if err != ErrTranscoderBuf {
+		t.Error("Expected released buffer error but got ", err)
+	}
+}
+
+func TestAPI_EncodeFrames(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	// Two seconds of a gray ramp in planar YUV and packed RGB
+	yuvFrame := func(i int) *Frame {
+		w, h := 128, 72
+		y := make([]byte, w*h)
+		for n := range y {
+			y[n] = byte(i * 4)
+		}
+		u := make([]byte, w*h/4)
+		v := make([]byte, w*h/4)
+		for n := range u {
+			u[n], v[n] = 128, 128
+		}
+		return &Frame{
+			Width: w, Height: h, PixelFormat: "yuv420p",
+			Planes:    [][]byte{y, u, v},
+			Strides:   []int{w, w / 2, w / 2},
+			Timestamp: time.Duration(i) * time.Second / 30,
+		}
+	}
+	rgbFrame := func(i int) *Frame {
+		w, h := 64, 64
+		rgb := make([]byte, w*h*3)
+		for n := range rgb {
+			rgb[n] = byte(i * 4)
+		}
+		return &Frame{
+			Width: w, Height: h, PixelFormat: "rgb24",
+			Planes:    [][]byte{rgb},
+			Strides:   []int{w * 3},
+			Timestamp: time.Duration(i) * time.Second / 30,
+		}
+	}
+	yuv, rgb := &RawFramesIn{Framerate: 30}, &RawFramesIn{Framerate: 30}
+	for i := 0; i < 60; i++ {
+		yuv.Frames = append(yuv.Frames, yuvFrame(i))
+		rgb.Frames = append(rgb.Frames, rgbFrame(i))
+	}
+
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	for _, in := range []*RawFramesIn{yuv, rgb} {
+		oname := fmt.Sprintf("%s/%s.ts", dir, in.Frames[0].PixelFormat)
+		out := []TranscodeOptions{{Oname: oname, Profile: P144p30fps16x9}}
+		res, err := enc.EncodeFrames(in, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Decoded.Frames != 60 || res.Encoded[0].Frames != 60 {
+			t.Error("Unexpected frame counts ", res.Decoded.Frames, res.Encoded[0].Frames)
+		}
+	}
+
+	cmd := `
+        ffprobe -loglevel warning -count_frames -show_streams yuv420p.ts > yuv.out
+        grep nb_read_frames=60 yuv.out
+        grep codec_name=h264 yuv.out
+        ffprobe -loglevel warning -count_frames -show_streams rgb24.ts > rgb.out
+        grep nb_read_frames=60 rgb.out
+        # no audio for raw frames
+        ffprobe -loglevel warning -show_streams -select_streams a yuv420p.ts > audio.out
+        [ ! -s audio.out ]
+    `
+	run(cmd)
+
+	// Invalid frames
+	out := []TranscodeOptions{{Oname: dir + "/invalid.ts", Profile: P144p30fps16x9}}
+	bad := &RawFramesIn{Framerate: 30, Frames: []*Frame{yuvFrame(0), rgbFrame(1)}}
+	if _, err := enc.EncodeFrames(bad, out); err != ErrTranscoderInp {
+		t.Error("Expected invalid input for mixed frames but got ", err)
+	}
+	f := yuvFrame(0)
+	f.PixelFormat = "notapixfmt"
+	bad = &RawFramesIn{Framerate: 30, Frames: []*Frame{f}}
+	if _, err := enc.EncodeFrames(bad, out); err != ErrTranscoderFmt {
+		t.Error("Expected unrecognized format but got ", err)
+	}
+	f = yuvFrame(0)
+	f.Planes[0] = f.Planes[0][:10]
+	bad = &RawFramesIn{Framerate: 30, Frames: []*Frame{f}}
+	if _, err := enc.EncodeFrames(bad, out); err != ErrTranscoderInp {
+		t.Error("Expected invalid input for short plane but got ", err)
+	}
+	if _, err := enc.EncodeFrames(&RawFramesIn{Framerate: 30}, out); err != ErrTranscoderInp {
+		t.Error("Expected invalid input for no frames but got ", err)
+	}
+}
+
+func TestAPI_SerializeDframeBuffer(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+    `
+	run(cmd)
+
+	dres, err := Decode(&TranscodeOptionsIn{Fname: dir + "/test-short.ts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+	var b bytes.Buffer
+	n, err := dres.DframeBuf.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(b.Len()) {
+		t.Error("Unexpected serialized size ", n, b.Len())
+	}
+	serialized := b.Bytes()
+	buf, err := ReadDframeBuffer(bytes.NewReader(serialized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buf.Release()
+
+	// Encoding the original and the deserialized copy gives the same output
+	out := func(prefix string) []TranscodeOptions {
+		return []TranscodeOptions{{
+			Oname:   dir + "/" + prefix + "_enc.ts",
+			Profile: P144p30fps16x9,
+		}, {
+			Oname:        dir + "/" + prefix + "_copy.ts",
+			VideoEncoder: ComponentOptions{Name: "copy"},
+			AudioEncoder: ComponentOptions{Name: "copy"},
+		}}
+	}
+	if _, err := Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, out("orig")); err != nil {
+		t.Fatal(err)
+	}
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	res, err := enc.encodeHost(buf, out("deser"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Encoded[0].Frames != 30 {
+		t.Error("Unexpected encoded frame count ", res.Encoded[0].Frames)
+	}
+	cmd = `
+        for o in enc copy; do
+            ffmpeg -i orig_$o.ts -f md5 orig_$o.md5
+            ffmpeg -i deser_$o.ts -f md5 deser_$o.md5
+            diff -u orig_$o.md5 deser_$o.md5
+        done
+    `
+	run(cmd)
+
+	// Invalid input
+	_, err = ReadDframeBuffer(bytes.NewReader(serialized[:len(serialized)/2]))
+	if err != io.ErrUnexpectedEOF {
+		t.Error("Expected unexpected EOF but got ", err)
+	}
+	_, err = ReadDframeBuffer(bytes.NewReader([]byte("notasegment")))
+	if err != ErrTranscoderSeg {
+		t.Error("Expected invalid segment but got ", err)
+	}
+}
+
+func TestAPI_EncodeServer(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+        ffmpeg -i test.ts -c:a copy -c:v copy -ss 1 -t 1 test-short2.ts
+    `
+	run(cmd)
+
+	srv, err := NewEncodeServer(dir + "/enc.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() { served <- srv.Serve() }()
+
+	enc, err := DialEncoder(dir + "/enc.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	for i, fname := range []string{"test-short.ts", "test-short2.ts"} {
+		dres, err := dec.Decode(&TranscodeOptionsIn{Fname: dir + "/" + fname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := []TranscodeOptions{{
+			Oname:   fmt.Sprintf("%s/out_%d.ts", dir, i),
+			Profile: P144p30fps16x9,
+		}}
+		res, err := enc.Encode(dres.DframeBuf, out)
+		dres.DframeBuf.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Encoded[0].Frames != 30 {
+			t.Error("Unexpected encoded frame count ", res.Encoded[0].Frames)
+		}
+	}
+	run(`
+        ffprobe -loglevel warning -count_frames -show_streams out_0.ts | grep nb_read_frames=30
+        ffprobe -loglevel warning -count_frames -show_streams out_1.ts | grep nb_read_frames=30
+    `)
+
+	// Errors are passed back, and the connection remains usable
+	dres, err := dec.Decode(&TranscodeOptionsIn{Fname: dir + "/test-short.ts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+	badProfile := P144p30fps16x9
+	badProfile.Resolution = "invalid"
+	_, err = enc.Encode(dres.DframeBuf, []TranscodeOptions{{Oname: dir + "/bad.ts", Profile: badProfile}})
+	if err != ErrTranscoderRes {
+		t.Error("Expected invalid resolution but got ", err)
+	}
+	out := []TranscodeOptions{{Oname: dir + "/out_2.ts", Profile: P144p30fps16x9}}
+	if _, err := enc.Encode(dres.DframeBuf, out); err != nil {
+		t.Error(err)
+	}
+
+	// Outputs with a writer are sent back to the client
+	var remote bytes.Buffer
+	memOut := []TranscodeOptions{out[0], {Oname: "remote.ts", Writer: &remote, Profile: P144p30fps16x9}}
+	if _, err := enc.Encode(dres.DframeBuf, memOut); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/remote.ts", remote.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(`ffprobe -loglevel warning -count_frames -show_streams remote.ts | grep nb_read_frames=30`)
+	if _, err := os.Stat("remote.ts"); !os.IsNotExist(err) {
+		t.Error("Unexpected file written by the server")
+	}
+
+	// Malformed requests are refused, and the connection remains usable
+	conn, err := net.Dial("unix", dir+"/enc.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		req := encodeRequest{Outputs: out, Writers: []bool{false, true}}
+		if err := writeMessage(conn, &req); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dres.DframeBuf.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+		reply := encodeReply{}
+		if err := readMessage(r, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Error == nil || reply.Error.err() != ErrTranscoderInp || reply.Results != nil {
+			t.Error("Expected invalid input but got ", reply)
+		}
+	}
+
+	// Errors carrying details from the outputs are still recognizable
+	filterEnc, err := DialEncoder(dir + "/enc.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filterEnc.Close()
+	badFilters := []TranscodeOptions{{Oname: dir + "/bad.ts", Profile: P144p30fps16x9, PreFilters: "nosuchfilter"}}
+	_, err = filterEnc.Encode(dres.DframeBuf, badFilters)
+	var oerr *OutputError
+	if !errors.As(err, &oerr) || oerr.Err == nil ||
+		oerr.Err.Error() != "Invalid video filter description" ||
+		!strings.Contains(oerr.Detail, "nosuchfilter") {
+		t.Error("Expected invalid filters with the description but got ", err)
+	}
+
+	enc.Close()
+	if _, err := enc.Encode(dres.DframeBuf, out); err != ErrTranscoderStp {
+		t.Error("Expected stopped encoder but got ", err)
+	}
+	srv.Close()
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAPI_Timings(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+    `
+	run(cmd)
+
+	in := &TranscodeOptionsIn{Fname: dir + "/test-short.ts"}
+	out := []TranscodeOptions{{
+		Oname:   dir + "/enc.ts",
+		Profile: P144p30fps16x9,
+	}, {
+		Oname:        dir + "/copy.ts",
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		AudioEncoder: ComponentOptions{Name: "copy"},
+	}}
+	checkTimings := func(res *TranscodeResults) {
+		if res.Decoded.DecodeTime <= 0 {
+			t.Error("Expected decode time")
+		}
+		enc := res.Encoded[0]
+		if enc.FilterTime <= 0 || enc.EncodeTime <= 0 || enc.MuxTime <= 0 || enc.DecodeTime != 0 {
+			t.Error("Unexpected encoded timings ", enc)
+		}
+		// stream copy only muxes
+		cp := res.Encoded[1]
+		if cp.FilterTime != 0 || cp.EncodeTime != 0 || cp.MuxTime <= 0 || cp.DecodeTime != 0 {
+			t.Error("Unexpected copy timings ", cp)
+		}
+	}
+
+	res, err := Transcode3(in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTimings(res)
+
+	// Split path
+	dres, err := Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+	res, err = Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Decoded = dres.Decoded
+	checkTimings(res)
+}
+
+func TestAPI_InMemoryInput(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c copy -f segment seg%d.ts
+        ls seg*.ts | wc -l | grep 4 # sanity check number of segments
+        ffmpeg -i test.ts -c copy -t 1 -movflags faststart test.mp4
+    `
+	run(cmd)
+
+	readFile := func(fname string) []byte {
+		b, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	out := []TranscodeOptions{{
+		Oname:   dir + "/out.ts",
+		Profile: P144p30fps16x9,
+	}}
+
+	// Reference frame counts, transcoding from files
+	frames := []int{}
+	for i := 0; i < 4; i++ {
+		res, err := Transcode3(&TranscodeOptionsIn{Fname: fmt.Sprintf("%s/seg%d.ts", dir, i)}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, res.Decoded.Frames)
+	}
+
+	// Mix file, byte and reader inputs within a stream, since mpegts
+	// demuxers are kept open between segments
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	for i := 0; i < 4; i++ {
+		fname := fmt.Sprintf("%s/seg%d.ts", dir, i)
+		in := &TranscodeOptionsIn{Fname: fname}
+		switch i % 3 {
+		case 1:
+			in = &TranscodeOptionsIn{Data: readFile(fname)}
+		case 2:
+			in = &TranscodeOptionsIn{Reader: bytes.NewReader(readFile(fname))}
+		}
+		res, err := tc.Transcode(in, out)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if res.Decoded.Frames != frames[i] {
+			t.Errorf("Segment %d: expected %d frames, got %d", i, frames[i], res.Decoded.Frames)
+		}
+	}
+
+	// Seekable formats, with the name as a format hint
+	mp4 := readFile(dir + "/test.mp4")
+	res, err := Transcode3(&TranscodeOptionsIn{Fname: dir + "/test.mp4"}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mres, err := Transcode3(&TranscodeOptionsIn{Fname: "test.mp4", Data: mp4}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Decoded.Frames != mres.Decoded.Frames || res.Encoded[0].Frames != mres.Encoded[0].Frames {
+		t.Error("Mismatched in-memory mp4 results ", res, mres)
+	}
+
+	// Split path
+	dres, err := Decode(&TranscodeOptionsIn{Data: readFile(dir + "/seg0.ts")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+	if dres.Decoded.Frames != frames[0] {
+		t.Errorf("Expected %d decoded frames, got %d", frames[0], dres.Decoded.Frames)
+	}
+
+	// Invalid inputs
+	_, err = Transcode3(&TranscodeOptionsIn{Data: []byte{}}, out)
+	if err != ErrTranscoderInp {
+		t.Error("Unexpected error for empty input ", err)
+	}
+	_, err = Transcode3(&TranscodeOptionsIn{Reader: bytes.NewReader(nil)}, out)
+	if err != ErrTranscoderInp {
+		t.Error("Unexpected error for empty reader ", err)
+	}
+	_, err = Transcode3(&TranscodeOptionsIn{Data: []byte("not a video")}, out)
+	if err == nil || err.Error() != "Invalid data found when processing input" {
+		t.Error("Unexpected error for invalid input ", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("failingWriter")
+}
+
+func TestAPI_InMemoryOutput(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+    `
+	run(cmd)
+
+	in := &TranscodeOptionsIn{Fname: dir + "/test-short.ts"}
+	var ts, mp4, cp bytes.Buffer
+	out := []TranscodeOptions{{
+		Oname:   dir + "/file.ts",
+		Profile: P144p30fps16x9,
+	}, {
+		Oname:   "mem.ts", // format hint only
+		Writer:  &ts,
+		Profile: P144p30fps16x9,
+	}, {
+		Writer:  &mp4,
+		Muxer:   ComponentOptions{Name: "mp4"},
+		Profile: P144p30fps16x9,
+	}, {
+		Oname:        "copy.ts",
+		Writer:       &cp,
+		VideoEncoder: ComponentOptions{Name: "copy"},
+		AudioEncoder: ComponentOptions{Name: "copy"},
+	}}
+	writeFiles := func() {
+		for name, b := range map[string]*bytes.Buffer{"mem.ts": &ts, "mem.mp4": &mp4, "copy.ts": &cp} {
+			if err := ioutil.WriteFile(dir+"/"+name, b.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			b.Reset()
+		}
+	}
+	checkFiles := `
+        ffprobe -loglevel warning -count_frames -show_streams file.ts | grep nb_read_frames=30
+        ffprobe -loglevel warning -count_frames -show_streams mem.ts | grep nb_read_frames=30
+        ffprobe -loglevel warning -count_frames -show_streams mem.mp4 | grep nb_read_frames=30
+        ffprobe -loglevel warning -show_streams copy.ts | grep codec_name=h264
+        ffprobe -loglevel warning -show_streams copy.ts | grep codec_name=aac
+    `
+
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	res, err := tc.Transcode(in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Encoded[1].Frames != 30 || res.Encoded[2].Frames != 30 {
+		t.Error("Unexpected encoded frame counts ", res.Encoded)
+	}
+	writeFiles()
+	run(checkFiles)
+
+	// Split path
+	dres, err := Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+	_, err = Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles()
+	run(checkFiles)
+
+	// Streaming path
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	s, err := dec.DecodeStream(context.Background(), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	_, err = enc.EncodeStream(context.Background(), s, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles()
+	run(checkFiles)
+
+	// Writer errors are returned
+	_, err = tc.Transcode(in, []TranscodeOptions{{
+		Oname:   "fail.ts",
+		Writer:  failingWriter{},
+		Profile: P144p30fps16x9,
+	}})
+	if err == nil || err.Error() != "failingWriter" {
+		t.Error("Expected writer error but got ", err)
+	}
+}
+
+func TestAPI_Cancel(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+        cp "$1"/../transcoder/test.ts .
+        ffmpeg -i test.ts -c:a copy -c:v copy -t 1 test-short.ts
+    `
+	run(cmd)
+
+	seg, err := ioutil.ReadFile(dir + "/test.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Serves part of the segment, then hangs until the test is over
+	done := make(chan struct{})
+	defer close(done)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(seg[:len(seg)/4])
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer srv.Close()
+	hung := &TranscodeOptionsIn{Fname: srv.URL + "/test.ts"}
+	short := &TranscodeOptionsIn{Fname: dir + "/test-short.ts"}
+	out := []TranscodeOptions{{Oname: dir + "/out.ts", Profile: P144p30fps16x9}}
+
+	checkDeadline := func(err error, start time.Time) {
+		if err != context.DeadlineExceeded {
+			t.Error("Expected deadline exceeded but got ", err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Error("Took too long to abort ", time.Since(start))
+		}
+	}
+
+	// Hung input; the transcoder remains usable afterwards
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	start := time.Now()
+	_, err = tc.TranscodeContext(ctx, hung, out)
+	cancel()
+	checkDeadline(err, start)
+	res, err := tc.Transcode(short, out)
+	if err != nil || res.Decoded.Frames != 30 {
+		t.Error("Unexpected results after abort ", res, err)
+	}
+	// Abort in between segments of a stream
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	start = time.Now()
+	_, err = tc.TranscodeContext(ctx, hung, out)
+	cancel()
+	checkDeadline(err, start)
+	if _, err := tc.Transcode(short, out); err != nil {
+		t.Error(err)
+	}
+
+	// Already cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := tc.TranscodeContext(ctx, short, out); err != context.Canceled {
+		t.Error("Expected cancellation but got ", err)
+	}
+
+	// Split path
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	start = time.Now()
+	_, err = dec.DecodeContext(ctx, hung)
+	cancel()
+	checkDeadline(err, start)
+	dres, err := dec.Decode(&TranscodeOptionsIn{Fname: dir + "/test.ts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+
+	// Abort while encoding
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	bigOut := []TranscodeOptions{}
+	for i := 0; i < 3; i++ {
+		bigOut = append(bigOut, TranscodeOptions{
+			Oname:   fmt.Sprintf("%s/big_%d.ts", dir, i),
+			Profile: P720p60fps16x9,
+		})
+	}
+	start = time.Now()
+	_, err = enc.EncodeContext(ctx, &EncodeOptionsIn{DframeBuf: dres.DframeBuf}, bigOut)
+	if err != context.Canceled {
+		t.Error("Expected cancellation but got ", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Took too long to abort ", time.Since(start))
+	}
+	if _, err := enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, out); err != nil {
+		t.Error(err)
+	}
+
+	// Streaming path, hung input. Segments decoded before the decoder was
+	// reset can't be encoded with its handle any more.
+	in := &EncodeOptionsIn{DframeBuf: dres.DframeBuf, DecHandle: dres.DecHandle}
+	if _, err := enc.Encode(in, out); err != nil {
+		t.Error(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	start = time.Now()
+	s, err := dec.DecodeStream(ctx, hung)
+	if err == nil {
+		_, err = enc.EncodeStream(context.Background(), s, out)
+		s.Close()
+	}
+	cancel()
+	checkDeadline(err, start)
+	if !dres.DecHandle.Stale() {
+		t.Error("Expected stale decoder handle")
+	}
+	if _, err := enc.Encode(in, out); err != ErrTranscoderStp {
+		t.Error("Expected stale handle to be refused but got ", err)
+	}
+	s, err = dec.DecodeStream(context.Background(), short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = enc.EncodeStream(context.Background(), s, out)
+	s.Close()
+	if err != nil || res.Encoded[0].Frames != 30 {
+		t.Error("Unexpected results after abort ", res, err)
+	}
+
+	// Encoder context done while the stream is hung
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	start = time.Now()
+	s, err = dec.DecodeStream(context.Background(), hung)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = enc.EncodeStream(ctx, s, out)
+	s.Close()
+	cancel()
+	checkDeadline(err, start)
+	if _, err := enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, out); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAPI_Probe(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	run(`
+        ffmpeg -loglevel warning -f lavfi -i testsrc=size=320x240:rate=25 -f lavfi -i sine=sample_rate=44100 -t 2 -c:v libx264 -pix_fmt yuv420p -profile:v high -b:v 500k -c:a aac -ac 2 probe.mp4
+        ffmpeg -loglevel warning -i probe.mp4 -c copy -metadata:s:v:0 rotate=90 rotated.mp4
+        ffmpeg -loglevel warning -i probe.mp4 -vn -c:a copy audio.ts
+    `)
+
+	checkInfo := func(info *ProbeInfo, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(info.Format, "mp4") {
+			t.Error("Unexpected format ", info.Format)
+		}
+		if info.Duration < 1900*time.Millisecond || info.Duration > 2100*time.Millisecond {
+			t.Error("Unexpected duration ", info.Duration)
+		}
+		if info.Bitrate <= 0 {
+			t.Error("Unexpected bitrate ", info.Bitrate)
+		}
+		if len(info.Streams) != 2 || info.Video == nil || info.Audio == nil {
+			t.Fatal("Unexpected streams ", info.Streams)
+		}
+		v := info.Video
+		if v.Type != "video" || v.Codec != "h264" || v.Profile != "High" ||
+			v.Width != 320 || v.Height != 240 || v.PixelFormat != "yuv420p" ||
+			v.Framerate != 25 || v.FramerateDen != 1 || v.Rotation != 0 {
+			t.Errorf("Unexpected video stream %+v", v)
+		}
+		a := info.Audio
+		if a.Type != "audio" || a.Codec != "aac" || a.SampleRate != 44100 || a.Channels != 2 {
+			t.Errorf("Unexpected audio stream %+v", a)
+		}
+		if a.Index == v.Index || &info.Streams[v.Index] != v || &info.Streams[a.Index] != a {
+			t.Error("Unexpected stream indices")
+		}
+	}
+
+	// From a file, memory and a reader
+	checkInfo(Probe(&TranscodeOptionsIn{Fname: dir + "/probe.mp4"}))
+	data, err := ioutil.ReadFile(dir + "/probe.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInfo(Probe(&TranscodeOptionsIn{Data: data}))
+	checkInfo(Probe(&TranscodeOptionsIn{Reader: bytes.NewReader(data)}))
+
+	// Readers are buffered, so the input can be transcoded after probing
+	in := &TranscodeOptionsIn{Fname: "probe.mp4", Reader: bytes.NewReader(data)}
+	checkInfo(Probe(in))
+	res, err := Transcode3(in, []TranscodeOptions{{Oname: dir + "/probed.ts", Profile: P144p30fps16x9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Decoded.Frames != 50 {
+		t.Error("Unexpected decoded frame count after probing ", res.Decoded.Frames)
+	}
+
+	// Rotation
+	info, err := Probe(&TranscodeOptionsIn{Fname: dir + "/rotated.mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Video == nil || info.Video.Rotation != 90 {
+		t.Errorf("Unexpected rotation %+v", info.Video)
+	}
+
+	// Audio only
+	info, err = Probe(&TranscodeOptionsIn{Fname: dir + "/audio.ts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != "mpegts" || info.Video != nil || info.Audio == nil || info.Audio.Codec != "aac" {
+		t.Errorf("Unexpected audio-only info %+v", info)
+	}
+
+	// Invalid inputs
+	if _, err := Probe(&TranscodeOptionsIn{Fname: dir + "/nonexistent.ts"}); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+	if _, err := Probe(&TranscodeOptionsIn{Data: []byte("not a video")}); err == nil {
+		t.Error("Expected an error for garbage input")
+	}
+	if _, err := Probe(&TranscodeOptionsIn{Data: []byte{}}); err != ErrTranscoderInp {
+		t.Error("Expected invalid input but got ", err)
+	}
+}
+
+func TestAPI_AudioProfile(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+	run(`
+        ffmpeg -loglevel warning -f lavfi -i testsrc=size=320x240:rate=30 -f lavfi -i "aevalsrc=sin(440*2*PI*t)|sin(550*2*PI*t)|sin(660*2*PI*t)|0.1*sin(50*2*PI*t)|sin(770*2*PI*t)|sin(880*2*PI*t):s=48000:c=5.1" -t 1 -c:v libx264 -c:a aac surround.ts
+        ffprobe -loglevel warning -show_streams -select_streams a surround.ts | grep channels=6
+    `)
+
+	out := []TranscodeOptions{{
+		Oname:   dir + "/default.mp4",
+		Profile: P144p30fps16x9,
+	}, {
+		Oname:   dir + "/mono.mp4",
+		Profile: P144p30fps16x9,
+		Audio:   AudioProfile{Bitrate: "64k", SampleRate: 48000, ChannelLayout: "mono"},
+	}, {
+		Oname:   dir + "/surround.mp4",
+		Profile: P144p30fps16x9,
+		Audio:   AudioProfile{ChannelLayout: "5.1", SampleRate: 48000},
+	}, {
+		Oname:   dir + "/dplii.mp4",
+		Profile: P144p30fps16x9,
+		Audio:   AudioProfile{Downmix: DownmixDPLII, SampleRate: 32000},
+		// encoder options take precedence over the profile
+		AudioEncoder: ComponentOptions{Opts: map[string]string{"b": "48k"}},
+	}}
+	in := &TranscodeOptionsIn{Fname: dir + "/surround.ts"}
+	if _, err := Transcode3(in, out); err != nil {
+		t.Fatal(err)
+	}
+	// And in the split path, where audio is resampled in the encoder
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	dres, err := dec.Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	_, err = enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf}, []TranscodeOptions{{
+		Oname:   dir + "/split.mp4",
+		Profile: P144p30fps16x9,
+		Audio:   AudioProfile{Bitrate: "64k", SampleRate: 48000, ChannelLayout: "mono"},
+	}})
+	dres.DframeBuf.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkAudio := func(fname string, rate, channels int, minBr, maxBr int64) {
+		info, err := Probe(&TranscodeOptionsIn{Fname: dir + "/" + fname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := info.Audio
+		if a == nil || a.Codec != "aac" || a.SampleRate != rate || a.Channels != channels {
+			t.Errorf("Unexpected audio for %s: %+v", fname, a)
+		} else if a.Bitrate < minBr || a.Bitrate > maxBr {
+			t.Errorf("Unexpected audio bitrate for %s: %d", fname, a.Bitrate)
+		}
+	}
+	checkAudio("default.mp4", 44100, 2, 1, 1000000)
+	checkAudio("mono.mp4", 48000, 1, 48000, 80000)
+	checkAudio("surround.mp4", 48000, 6, 1, 1000000)
+	checkAudio("dplii.mp4", 32000, 2, 32000, 64000)
+	checkAudio("split.mp4", 48000, 1, 48000, 80000)
+
+	// Invalid profiles
+	for _, a := range []AudioProfile{
+		{SampleRate: -1},
+		{ChannelLayout: "bogus"},
+		{ChannelLayout: "stereo:sample_rates=8000"},
+		{Bitrate: "lots"},
+		{Downmix: 42},
+	} {
+		out := []TranscodeOptions{{Oname: dir + "/invalid.mp4", Profile: P144p30fps16x9, Audio: a}}
+		if _, err := Transcode3(in, out); err != ErrTranscoderAud {
+			t.Errorf("Expected invalid audio profile for %+v but got %v", a, err)
+		}
+	}
+}
+
+func TestAPI_PerTitleLadder(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+    # a static title and a noisy, high-motion one
+    ffmpeg -loglevel warning -f lavfi -i color=c=blue:s=1280x720:r=30 -t 2 -c:v libx264 -crf 10 static.ts
+    ffmpeg -loglevel warning -f lavfi -i testsrc2=s=1280x720:r=30 -t 2 -vf noise=alls=100:allf=t -c:v libx264 -crf 10 noisy.ts
+  `
+	run(cmd)
+
+	static, err := PerTitleLadder(&TranscodeOptionsIn{Fname: dir + "/static.ts"}, LadderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noisy, err := PerTitleLadder(&TranscodeOptionsIn{Fname: dir + "/noisy.ts"}, LadderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(static) <= 0 || len(noisy) <= 0 {
+		t.Fatalf("Expected renditions but got %v and %v", static, noisy)
+	}
+	// Nothing above the source resolution
+	for _, p := range append(static, noisy...) {
+		if _, h, err := VideoProfileResolution(p); err != nil || h > 720 {
+			t.Errorf("Unexpected resolution %s", p.Resolution)
+		}
+	}
+	// Renditions are ordered from highest to lowest bitrate
+	for _, ladder := range [][]VideoProfile{static, noisy} {
+		for i := 1; i < len(ladder); i++ {
+			prev, _ := parseBitrate(ladder[i-1].Bitrate)
+			cur, _ := parseBitrate(ladder[i].Bitrate)
+			if cur >= prev {
+				t.Errorf("Unexpected ladder order %v", ladder)
+			}
+		}
+	}
+	// Complex content needs more bits at the top of the ladder
+	staticBr, _ := parseBitrate(static[0].Bitrate)
+	noisyBr, _ := parseBitrate(noisy[0].Bitrate)
+	if staticBr >= noisyBr {
+		t.Errorf("Expected static title to need fewer bits; got %d and %d", staticBr, noisyBr)
+	}
+	// The renditions can be used as they are
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	_, err = tc.Transcode(&TranscodeOptionsIn{Fname: dir + "/noisy.ts"},
+		[]TranscodeOptions{{Oname: dir + "/out.ts", Profile: noisy[0]}})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Readers give the same ladder as files
+	data, err := ioutil.ReadFile(dir + "/noisy.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromReader, err := PerTitleLadder(&TranscodeOptionsIn{Fname: "noisy.ts", Reader: bytes.NewReader(data)}, LadderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fromReader) != len(noisy) || fromReader[0].Bitrate != noisy[0].Bitrate {
+		t.Errorf("Unexpected ladder from a reader; wanted %v but got %v", noisy, fromReader)
+	}
+
+	// No video to analyze
+	cmd = `
+    ffmpeg -loglevel warning -i "$1"/../transcoder/test.ts -t 1 -c:a copy -vn audio.ts
+  `
+	run(cmd)
+	_, err = PerTitleLadder(&TranscodeOptionsIn{Fname: dir + "/audio.ts"}, LadderOptions{})
+	if err != ErrTranscoderInp {
+		t.Errorf("Expected %v for audio-only input but got %v", ErrTranscoderInp, err)
+	}
+}
+
+func TestLadder_FromComplexity(t *testing.T) {
+	hd := StreamInfo{Width: 1920, Height: 1080, Framerate: 30, FramerateDen: 1}
+	tests := []struct {
+		name    string
+		src     StreamInfo
+		bitrate float64
+		opts    LadderOptions
+		want    []string // resolution@bitrate
+	}{
+		{"typical", hd, 1000000, LadderOptions{MaxRenditions: 5, MaxBitrate: 8000000},
+			[]string{"1920x1080@3637k", "1280x720@1979k", "854x480@1078k", "640x360@700k", "426x240@380k"}},
+		{"static", hd, 20000, LadderOptions{MaxRenditions: 5, MaxBitrate: 8000000},
+			[]string{"1920x1080@622k", "1280x720@276k", "854x480@122k", "640x360@69k", "426x240@30k"}},
+		{"capped", hd, 10000000, LadderOptions{MaxRenditions: 2, MaxBitrate: 8000000},
+			[]string{"1920x1080@8000k", "854x480@3074k"}},
+		{"tiny", StreamInfo{Width: 160, Height: 90}, 50000, LadderOptions{MaxRenditions: 5, MaxBitrate: 8000000},
+			[]string{"160x90@35k"}},
+	}
+	for _, tt := range tests {
+		h := complexityHeight
+		if tt.src.Height < h {
+			h = tt.src.Height
+		}
+		ladder := ladderFromComplexity(tt.src, h, tt.bitrate, tt.opts)
+		got := []string{}
+		for _, p := range ladder {
+			got = append(got, p.Resolution+"@"+p.Bitrate)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("Unexpected %s ladder; wanted %v but got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestTranscoder_Trim(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+    cp "$1"/../transcoder/test.ts .
+    # reference clips, trimmed by ffmpeg
+    ffmpeg -loglevel warning -i test.ts -an -vf trim=start_frame=45:end_frame=100 -vsync passthrough -c:v libx264 ref-frames.ts
+    ffmpeg -loglevel warning -i test.ts -an -vf trim=start=1.5:end=3 -vsync passthrough -c:v libx264 ref-time.ts
+  `
+	run(cmd)
+
+	tc := NewTranscoder()
+	defer tc.StopTranscoder()
+	out := func(name string) []TranscodeOptions {
+		return []TranscodeOptions{{Oname: dir + "/" + name, Profile: P144p30fps16x9}}
+	}
+	prof := P144p30fps16x9
+	prof.Framerate = 0 // passthrough so frames can be counted
+	trim := func(in *TranscodeOptionsIn, name string) {
+		in.Fname = dir + "/test.ts"
+		_, err := tc.Transcode(in, []TranscodeOptions{{Oname: dir + "/" + name, Profile: prof}})
+		if err != nil {
+			t.Error(name, err)
+		}
+	}
+	trim(&TranscodeOptionsIn{InFrame: 45, OutFrame: 100}, "frames.ts")
+	trim(&TranscodeOptionsIn{InTime: 1500 * time.Millisecond, OutTime: 3 * time.Second}, "time.ts")
+	trim(&TranscodeOptionsIn{InTime: 1500 * time.Millisecond}, "in.ts")
+	trim(&TranscodeOptionsIn{OutFrame: 30}, "out.ts")
+	// Untrimmed segment afterwards is unaffected
+	trim(&TranscodeOptionsIn{}, "full.ts")
+
+	cmd = `
+    function frames {
+      ffprobe -loglevel warning -select_streams v -count_frames -show_streams $1 | grep nb_read_frames= | cut -d= -f2
+    }
+    function first_key {
+      ffprobe -loglevel warning -select_streams v -show_frames -read_intervals "%+#1" $1 | grep key_frame=1
+    }
+    function start_time {
+      ffprobe -loglevel warning -select_streams v -show_entries stream=start_time -of csv=p=0 $1
+    }
+
+    # same frames as ffmpeg's trim, starting with a keyframe
+    [ $(frames frames.ts) -eq $(frames ref-frames.ts) ]
+    [ $(frames time.ts) -eq $(frames ref-time.ts) ]
+    [ $(frames out.ts) -eq 30 ]
+    first_key frames.ts
+    first_key time.ts
+    first_key in.ts
+    [ $(frames in.ts) -lt $(frames full.ts) ]
+    [ $(frames full.ts) -eq $(frames test.ts) ]
+
+    # starts at the in point, within a frame
+    full=$(start_time full.ts)
+    awk "BEGIN { d = $(start_time time.ts) - $full; exit !(d >= 1.49 && d < 1.55) }"
+
+    # audio is trimmed along with the video
+    ffprobe -loglevel warning -show_streams -select_streams a time.ts | grep codec_name=aac
+    audio=$(ffprobe -loglevel warning -select_streams a -show_entries stream=start_time -of csv=p=0 time.ts)
+    awk "BEGIN { exit !($audio - $full >= 1.45) }"
+  `
+	run(cmd)
+
+	// Invalid points
+	for _, in := range []TranscodeOptionsIn{
+		{InFrame: -1},
+		{OutTime: -time.Second},
+		{InTime: 2 * time.Second, OutTime: time.Second},
+		{InFrame: 10, OutFrame: 10},
+		{InTime: time.Second, InFrame: 10},
+		{OutTime: time.Second, OutFrame: 10},
+	} {
+		in.Fname = dir + "/test.ts"
+		_, err := tc.Transcode(&in, out("invalid.ts"))
+		if err != ErrTranscoderTrm {
+			t.Errorf("Expected %v for %+v but got %v", ErrTranscoderTrm, in, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package ffmpeg
+
+// #cgo pkg-config: libavutil
+// #include <stdlib.h>
+// #include <libavutil/channel_layout.h>
+import "C"
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// How inputs with more channels than the output are mixed down to stereo
+type Downmix int
+
+const (
+	// Standard downmix matrix
+	DownmixDefault Downmix = iota
+	// Stereo that Dolby Surround decoders can upmix again
+	DownmixDolby
+	// Stereo that Dolby Pro Logic II decoders can upmix again
+	DownmixDPLII
+)
+
+var downmixEncodings = map[Downmix]string{
+	DownmixDefault: "none",
+	DownmixDolby:   "dolby",
+	DownmixDPLII:   "dplii",
+}
+
+// Audio is resampled and remixed to these when unset in an AudioProfile,
+// regardless of the input.
+const (
+	DefaultAudioSampleRate    = 44100
+	DefaultAudioChannelLayout = "stereo"
+)
+
+type AudioProfile struct {
+	// Encoder bitrate, eg "128k". Empty for the encoder default.
+	// A "b" option in the audio encoder options takes precedence.
+	Bitrate string
+	// Output sample rate in Hz
+	SampleRate int
+	// Output channel layout, eg "mono", "stereo" or "5.1"
+	ChannelLayout string
+	Downmix       Downmix
+}
+
+// audioFilters returns the filtergraph that resamples and remixes decoded
+// audio into the profile's format.
+func audioFilters(p AudioProfile) (string, error) {
+	rate := p.SampleRate
+	if rate == 0 {
+		rate = DefaultAudioSampleRate
+	} else if rate < 0 {
+		return "", ErrTranscoderAud
+	}
+	layout := p.ChannelLayout
+	if layout == "" {
+		layout = DefaultAudioChannelLayout
+	}
+	clayout := C.CString(layout)
+	defer C.free(unsafe.Pointer(clayout))
+	// Also rejects characters that are special to the filtergraph parser
+	if C.av_get_channel_layout(clayout) == 0 || strings.ContainsAny(layout, ":,;[]='") {
+		return "", ErrTranscoderAud
+	}
+	encoding, ok := downmixEncodings[p.Downmix]
+	if !ok {
+		return "", ErrTranscoderAud
+	}
+	return fmt.Sprintf("aresample=osr=%d:ocl=%s:matrix_encoding=%s,"+
+		"aformat=sample_fmts=fltp:channel_layouts=%s:sample_rates=%d",
+		rate, layout, encoding, layout, rate), nil
+}
+
+// audioBitrate returns the profile's bitrate in bits per second, or zero if
+// unset.
+func audioBitrate(p AudioProfile) (int, error) {
+	if p.Bitrate == "" {
+		return 0, nil
+	}
+	br, err := strconv.Atoi(strings.Replace(p.Bitrate, "k", "000", 1))
+	if err != nil || br <= 0 {
+		return 0, ErrTranscoderAud
+	}
+	return br, nil
+}
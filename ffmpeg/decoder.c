@@ -3,6 +3,7 @@
 #include "logging.h"
 
 #include <libavutil/pixfmt.h>
+#include <string.h>
 
 static int lpms_send_packet(struct input_ctx *ictx, AVCodecContext *dec, AVPacket *pkt)
 {
@@ -203,6 +204,12 @@ open_audio_err:
   return ret;
 }
 
+// Whether the stream info found any video frames to describe
+static int has_video_params(AVCodecParameters *par)
+{
+  return AV_PIX_FMT_NONE != par->format || par->height;
+}
+
 int open_video_decoder(input_params *params, struct input_ctx *ctx)
 {
   int ret = 0;
@@ -211,6 +218,12 @@ int open_video_decoder(input_params *params, struct input_ctx *ctx)
 
   // open video decoder
   ctx->vi = av_find_best_stream(ic, AVMEDIA_TYPE_VIDEO, -1, -1, &codec, 0);
+  if (ctx->vi >= 0 && !has_video_params(ic->streams[ctx->vi]->codecpar)) {
+    // Broadcasters may send a video stream without any frames in it, eg
+    // while starting up. Treat the segment as audio-only until video shows.
+    LPMS_WARN("Video stream has no frames; treating input as audio-only");
+    ctx->vi = -1;
+  }
   if (ctx->dv) ; // skip decoding video
   else if (ctx->vi < 0) {
     LPMS_WARN("No video stream found in input");
@@ -257,18 +270,159 @@ open_decoder_err:
   return ret;
 }
 
-int open_input(input_params *params, struct input_ctx *ctx)
+// In-memory input
+
+struct mem_input {
+  uint8_t *data;
+  int64_t size;
+  int64_t pos;
+};
+
+#define MEM_INPUT_BUF_SIZE 32768
+
+static int mem_input_read(void *opaque, uint8_t *buf, int buf_size)
+{
+  struct mem_input *m = opaque;
+  int64_t left = m->size - m->pos;
+  if (left <= 0) return AVERROR_EOF;
+  if (buf_size > left) buf_size = left;
+  memcpy(buf, m->data + m->pos, buf_size);
+  m->pos += buf_size;
+  return buf_size;
+}
+
+static int64_t mem_input_seek(void *opaque, int64_t offset, int whence)
+{
+  struct mem_input *m = opaque;
+  switch (whence & ~AVSEEK_FORCE) {
+  case AVSEEK_SIZE: return m->size;
+  case SEEK_SET: break;
+  case SEEK_CUR: offset += m->pos; break;
+  case SEEK_END: offset += m->size; break;
+  default: return AVERROR(EINVAL);
+  }
+  if (offset < 0 || offset > m->size) return AVERROR(EINVAL);
+  m->pos = offset;
+  return offset;
+}
+
+static int open_mem_input(input_params *params, struct input_ctx *ctx)
+{
+  struct mem_input *m = NULL;
+  uint8_t *buf = NULL;
+  int ret = 0;
+
+  if (params->data_size <= 0) LPMS_ERR(open_mem_err, "Empty in-memory input");
+  m = av_mallocz(sizeof(*m));
+  buf = av_malloc(MEM_INPUT_BUF_SIZE);
+  if (!m || !buf) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(open_mem_err, "Unable to allocate in-memory input");
+  }
+  m->data = params->data;
+  m->size = params->data_size;
+  ctx->mem_pb = avio_alloc_context(buf, MEM_INPUT_BUF_SIZE, 0, m,
+                                   mem_input_read, NULL, mem_input_seek);
+  if (!ctx->mem_pb) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(open_mem_err, "Unable to allocate in-memory IO context");
+  }
+  return 0;
+
+open_mem_err:
+  av_free(m);
+  av_free(buf);
+  return ret;
+}
+
+static void free_mem_input(struct input_ctx *ctx)
+{
+  if (!ctx->mem_pb) return;
+  // the IO buffer may have been reallocated by avio, so free whatever it is now
+  av_freep(&ctx->mem_pb->buffer);
+  av_freep(&ctx->mem_pb->opaque);
+  avio_context_free(&ctx->mem_pb);
+}
+
+int is_interrupted(AVIOInterruptCB *cb)
+{
+  return cb->callback && cb->callback(cb->opaque);
+}
+
+// Opens the IO context for a demuxer that is kept open between segments
+int open_input_io(input_params *params, struct input_ctx *ctx)
 {
-  AVFormatContext *ic   = NULL;
-  char *inp = params->fname;
   int ret = 0;
+  if (!params->data) {
+    return avio_open2(&ctx->ic->pb, params->fname, AVIO_FLAG_READ,
+                      &ctx->interrupt_cb, NULL);
+  }
+  ret = open_mem_input(params, ctx);
+  if (ret < 0) return ret;
+  ctx->ic->pb = ctx->mem_pb;
+  return 0;
+}
 
-  // open demuxer
-  ret = avformat_open_input(&ic, inp, NULL, NULL);
-  if (ret < 0) LPMS_ERR(open_input_err, "demuxer: Unable to open input");
+// Closes the IO context of the input, keeping the demuxer open
+void close_input_io(struct input_ctx *ctx)
+{
+  AVFormatContext *ic = ctx->ic;
+  if (ic && ic->pb) {
+    if (ic->pb == ctx->mem_pb) ic->pb = NULL;
+    else avio_closep(&ic->pb);
+  }
+  free_mem_input(ctx);
+}
+
+int open_demuxer(input_params *params, struct input_ctx *ctx)
+{
+  AVFormatContext *ic = NULL;
+  int ret = 0;
+
+  ic = avformat_alloc_context();
+  if (!ic) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(open_demuxer_err, "Unable to allocate demuxer");
+  }
+  ic->interrupt_callback = ctx->interrupt_cb;
+  if (params->data) {
+    ret = open_mem_input(params, ctx);
+    if (ret < 0) {
+      avformat_free_context(ic);
+      goto open_demuxer_err;
+    }
+    ic->pb = ctx->mem_pb;
+  }
+  // on failure, ic is freed by avformat_open_input
+  ret = avformat_open_input(&ic, params->fname, NULL, NULL);
+  if (ret < 0) LPMS_ERR(open_demuxer_err, "demuxer: Unable to open input");
   ctx->ic = ic;
   ret = avformat_find_stream_info(ic, NULL);
-  if (ret < 0) LPMS_ERR(open_input_err, "Unable to find input info");
+  if (ret < 0) LPMS_ERR(open_demuxer_err, "Unable to find input info");
+  return 0;
+
+open_demuxer_err:
+  // anything already opened is released by close_demuxer
+  return ret;
+}
+
+void close_demuxer(struct input_ctx *ctx)
+{
+  if (ctx->ic) {
+    // in-memory IO is ours to free, not the demuxer's
+    if (ctx->mem_pb && ctx->ic->pb == ctx->mem_pb) ctx->ic->flags |= AVFMT_FLAG_CUSTOM_IO;
+    avformat_close_input(&ctx->ic);
+  }
+  free_mem_input(ctx);
+}
+
+int open_input(input_params *params, struct input_ctx *ctx)
+{
+  int ret = 0;
+
+  ctx->trim_in = ctx->trim_out = AV_NOPTS_VALUE;
+  ret = open_demuxer(params, ctx);
+  if (ret < 0) goto open_input_err;
   ret = open_video_decoder(params, ctx);
   if (ret < 0) LPMS_ERR(open_input_err, "Unable to open video decoder")
   ret = open_audio_decoder(params, ctx);
@@ -288,7 +442,7 @@ open_input_err:
 
 void free_input(struct input_ctx *inctx)
 {
-  if (inctx->ic) avformat_close_input(&inctx->ic);
+  close_demuxer(inctx);
   if (inctx->vc) {
     if (inctx->vc->hw_device_ctx) av_buffer_unref(&inctx->vc->hw_device_ctx);
     avcodec_free_context(&inctx->vc);
@@ -6,9 +6,14 @@
 #include "transcoder.h"
 
 #define MAX_CHUNK_CNT 10
+// Default ceiling on the number of frames buffered per segment
 #define MAX_DFRAME_CNT 1000
+// Initial size of a frame buffer; grows on demand up to the ceiling
+#define DFRAME_BUFFER_INIT 64
 struct input_ctx {
   AVFormatContext *ic; // demuxer required
+  AVIOContext *mem_pb; // IO for in-memory input, if any
+  AVIOInterruptCB interrupt_cb; // aborts IO and decoding when triggered
   AVCodecContext  *vc; // video decoder optional
   AVCodecContext  *ac; // audo  decoder optional
   int vi, ai; // video and audio stream indices
@@ -35,6 +40,13 @@ struct input_ctx {
 
   // Filter flush
   AVFrame *last_frame_v, *last_frame_a;
+
+  // Trimming for the current segment. Times are in AV_TIME_BASE units from
+  // the start of the input, or AV_NOPTS_VALUE if unset or not yet known.
+  int64_t trim_in, trim_out;
+  int trim_in_frame, trim_out_frame; // zero if unset
+  int nb_video_frames; // decoded so far in the segment
+  int trim_done; // reached the out point
 };
 
 // struct decode_thread {
@@ -53,11 +65,16 @@ void lpms_decode_stop(struct decode_thread* handle);
 int process_in(struct input_ctx *ictx, AVFrame *frame, AVPacket *pkt);
 enum AVPixelFormat hw2pixfmt(AVCodecContext *ctx);
 int open_input(input_params *params, struct input_ctx *ctx);
+int open_demuxer(input_params *params, struct input_ctx *ctx);
+void close_demuxer(struct input_ctx *ctx);
+int open_input_io(input_params *params, struct input_ctx *ctx);
+void close_input_io(struct input_ctx *ctx);
+int is_interrupted(AVIOInterruptCB *cb);
 int open_video_decoder(input_params *params, struct input_ctx *ctx);
 int open_audio_decoder(input_params *params, struct input_ctx *ctx);
 void free_input(struct input_ctx *inctx);
 
-int lpms_decode(input_params *inp,  output_results *decoded_results, dframe_buffer *dframe_buf, struct input_ctx *ictx, struct decode_meta *dmeta);
+int lpms_decode(input_params *inp,  output_results *decoded_results, dframe_buffer *dframe_buf, struct decode_meta *dmeta);
 // Utility functions
 inline int is_flush_frame(AVFrame *frame)
 {
@@ -0,0 +1,343 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Out-of-process encoding. A client sends an encode request followed by a
+// segment serialized with DframeBuffer.WriteTo, and the server replies once
+// the segment has been encoded. Requests on a connection are handled in
+// order; each connection carries a single stream.
+//
+// Requests and replies are JSON, prefixed with their length as a
+// little-endian uint32. Outputs with a Writer are encoded into memory on the
+// server and follow the reply as raw bytes, in output order.
+
+type encodeRequest struct {
+	Outputs []TranscodeOptions
+	// Which outputs are to be sent back rather than written by the server
+	Writers []bool `json:",omitempty"`
+}
+
+type encodeReply struct {
+	Results *TranscodeResults `json:",omitempty"`
+	Error   *encodeError      `json:",omitempty"`
+	// Sizes of the outputs that follow the reply
+	Sizes []int `json:",omitempty"`
+}
+
+const maxEncodeMessage = 1 << 20
+
+func writeMessage(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(b)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func readMessage(r io.Reader, v interface{}) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n > maxEncodeMessage {
+		return ErrTranscoderSeg
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Errors that are passed back to the client as themselves rather than
+// as a new error with the same message, by name
+var encodeErrors = map[string]error{
+	"ErrTranscoderRes": ErrTranscoderRes,
+	"ErrTranscoderHw":  ErrTranscoderHw,
+	"ErrTranscoderInp": ErrTranscoderInp,
+	"ErrTranscoderStp": ErrTranscoderStp,
+	"ErrTranscoderFmt": ErrTranscoderFmt,
+	"ErrTranscoderPrf": ErrTranscoderPrf,
+	"ErrTranscoderGOP": ErrTranscoderGOP,
+	"ErrTranscoderBuf": ErrTranscoderBuf,
+	"ErrTranscoderVcd": ErrTranscoderVcd,
+	"ErrTranscoderMux": ErrTranscoderMux,
+	"ErrTranscoderRC":  ErrTranscoderRC,
+	"ErrTranscoderTun": ErrTranscoderTun,
+	"ErrTranscoderTrm": ErrTranscoderTrm,
+	"ErrTranscoderAsp": ErrTranscoderAsp,
+	"ErrTranscoderAud": ErrTranscoderAud,
+	"ErrTranscoderOvl": ErrTranscoderOvl,
+	"ErrTranscoderSeg": ErrTranscoderSeg,
+}
+
+// An error as sent to the client. Known errors are identified by their name
+// in encodeErrors or their code in ErrorMap, along with any details from the
+// outputs; anything else only by its message.
+type encodeError struct {
+	Name    string `json:",omitempty"`
+	Code    int    `json:",omitempty"`
+	Detail  string `json:",omitempty"`
+	Message string `json:",omitempty"`
+}
+
+func newEncodeError(err error) *encodeError {
+	e := &encodeError{}
+	if oerr, ok := err.(*OutputError); ok {
+		err, e.Detail = oerr.Err, oerr.Detail
+	}
+	for name, v := range encodeErrors {
+		if v == err {
+			e.Name = name
+			return e
+		}
+	}
+	for code, v := range ErrorMap {
+		if v == err {
+			e.Code = code
+			return e
+		}
+	}
+	if err != nil {
+		e.Message = err.Error()
+	}
+	return e
+}
+
+func (e *encodeError) err() error {
+	var err error
+	if e.Name != "" {
+		err = encodeErrors[e.Name]
+	} else if e.Code != 0 {
+		err = ErrorMap[e.Code]
+	}
+	if e.Detail != "" {
+		return &OutputError{Err: err, Detail: e.Detail}
+	}
+	if err == nil {
+		err = errors.New(e.Message)
+	}
+	return err
+}
+
+// EncodeServer encodes segments sent by other processes over a Unix socket.
+// Each connection is served by its own Encoder.
+type EncodeServer struct {
+	ln     net.Listener
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func NewEncodeServer(sock string) (*EncodeServer, error) {
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	return &EncodeServer{ln: ln, conns: make(map[net.Conn]struct{})}, nil
+}
+
+// Serve accepts connections until the server is closed.
+func (s *EncodeServer) Serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return nil
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *EncodeServer) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	r := bufio.NewReader(conn)
+	for {
+		req := encodeRequest{}
+		if err := readMessage(r, &req); err != nil {
+			if err != io.EOF {
+				glog.Error("Unable to read encode request: ", err)
+			}
+			return
+		}
+		buf, err := ReadDframeBuffer(r)
+		if err != nil {
+			// The rest of the connection can't be parsed, so give up on it
+			glog.Error("Unable to read segment: ", err)
+			writeMessage(conn, &encodeReply{Error: newEncodeError(err)})
+			return
+		}
+		if len(req.Writers) > len(req.Outputs) {
+			buf.Release()
+			glog.Error("Invalid encode request")
+			if err := writeMessage(conn, &encodeReply{Error: newEncodeError(ErrTranscoderInp)}); err != nil {
+				glog.Error("Unable to write encode reply: ", err)
+				return
+			}
+			continue
+		}
+		outs := make([]*bytes.Buffer, len(req.Writers))
+		for i, w := range req.Writers {
+			if w {
+				outs[i] = &bytes.Buffer{}
+				req.Outputs[i].Writer = outs[i]
+			}
+		}
+		res, err := enc.encodeHost(buf, req.Outputs)
+		buf.Release()
+		reply := encodeReply{Results: res}
+		if err != nil {
+			reply.Error = newEncodeError(err)
+		} else {
+			for _, out := range outs {
+				if out != nil {
+					reply.Sizes = append(reply.Sizes, out.Len())
+				}
+			}
+		}
+		if err := writeMessage(conn, &reply); err != nil {
+			glog.Error("Unable to write encode reply: ", err)
+			return
+		}
+		for _, out := range outs {
+			if reply.Error != nil || out == nil {
+				continue
+			}
+			if _, err := out.WriteTo(conn); err != nil {
+				glog.Error("Unable to write encoded output: ", err)
+				return
+			}
+		}
+	}
+}
+
+// Close stops accepting connections and closes existing ones, waiting for
+// any encodes in progress to finish.
+func (s *EncodeServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.ln.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// RemoteEncoder encodes segments in an EncodeServer, usually running in
+// another process. Like an Encoder, it should be used for a single stream.
+type RemoteEncoder struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func DialEncoder(sock string) (*RemoteEncoder, error) {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteEncoder{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Encode sends the decoded segment to the server and waits for it to be
+// encoded. Output names are paths on the server's filesystem, unless the
+// output has a Writer, in which case the output is sent back.
+func (e *RemoteEncoder) Encode(buf *DframeBuffer, ps []TranscodeOptions) (*TranscodeResults, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		return nil, ErrTranscoderStp
+	}
+	if buf == nil {
+		return nil, ErrTranscoderInp
+	}
+	req := encodeRequest{Outputs: ps}
+	writers := []io.Writer{}
+	for i, p := range ps {
+		if p.Writer != nil {
+			if req.Writers == nil {
+				req.Writers = make([]bool, len(ps))
+			}
+			req.Writers[i] = true
+			writers = append(writers, p.Writer)
+		}
+	}
+	reply := encodeReply{}
+	err := writeMessage(e.conn, &req)
+	if err == nil {
+		_, err = buf.WriteTo(e.conn)
+	}
+	if err == nil {
+		err = readMessage(e.r, &reply)
+	}
+	if err == nil && reply.Error == nil {
+		if len(reply.Sizes) != len(writers) {
+			err = ErrTranscoderSeg
+		}
+		for i := 0; err == nil && i < len(writers); i++ {
+			_, err = io.CopyN(writers[i], e.r, int64(reply.Sizes[i]))
+		}
+	}
+	if err != nil {
+		// Unknown how much of the exchange went through, so the
+		// connection can't be reused
+		e.conn.Close()
+		e.conn = nil
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, reply.Error.err()
+	}
+	return reply.Results, nil
+}
+
+func (e *RemoteEncoder) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		return nil
+	}
+	err := e.conn.Close()
+	e.conn = nil
+	return err
+}
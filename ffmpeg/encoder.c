@@ -4,6 +4,41 @@
 #include <libavcodec/avcodec.h>
 #include <libavfilter/buffersrc.h>
 #include <libavfilter/buffersink.h>
+#include <libavutil/time.h>
+
+// Prefer the hvc1 tag for HEVC where the muxer accepts it; some players
+// such as Safari refuse the default hev1.
+static void set_hevc_tag(AVFormatContext *oc, AVStream *st)
+{
+  const unsigned int hvc1 = MKTAG('h', 'v', 'c', '1');
+  if (AV_CODEC_ID_HEVC != st->codecpar->codec_id || !oc->oformat->codec_tag) return;
+  if (AV_CODEC_ID_HEVC == av_codec_get_id(oc->oformat->codec_tag, hvc1)) {
+    st->codecpar->codec_tag = hvc1;
+  }
+}
+
+// Whether the output may use the shared session rather than its own. Options
+// such as the preset or rate control are fixed once the encoder is opened,
+// so they have to be the same as those the session was opened with.
+static int can_share_session(struct hw_session *session, AVCodec *codec, AVDictionary *opts)
+{
+  AVDictionaryEntry *e = NULL, *f = NULL;
+  if (!session->vc || session->vc->codec != codec) return 0;
+  if (av_dict_count(session->opts) != av_dict_count(opts)) return 0;
+  while ((e = av_dict_get(opts, "", e, AV_DICT_IGNORE_SUFFIX))) {
+    f = av_dict_get(session->opts, e->key, NULL, 0);
+    if (!f || strcmp(e->value, f->value)) return 0;
+  }
+  return 1;
+}
+
+// Keeps the options the shared session is about to be opened with, since
+// opening the encoder consumes them.
+static int save_session_opts(struct hw_session *session, AVDictionary *opts)
+{
+  av_dict_free(&session->opts);
+  return av_dict_copy(&session->opts, opts, 0);
+}
 
 static int add_video_stream(struct output_ctx *octx, struct input_ctx *ictx)
 {
@@ -24,7 +59,9 @@ static int add_video_stream(struct output_ctx *octx, struct input_ctx *ictx)
     avformat_transfer_internal_stream_timing_info(octx->oc->oformat, st, ist, AVFMT_TBCF_DEMUXER);
   } else if (octx->vc) {
     st->time_base = octx->vc->time_base;
+    st->sample_aspect_ratio = octx->vc->sample_aspect_ratio;
     ret = avcodec_parameters_from_context(st->codecpar, octx->vc);
+    set_hevc_tag(octx->oc, st);
     if (octx->gop_time) {
       // Rescale the gop time to the expected timebase after filtering.
       // The FPS filter outputs pts incrementing by 1 at a rate of 1/framerate
@@ -127,11 +164,39 @@ audio_output_err:
   return ret;
 }
 
+static int open_output_io(struct output_ctx *octx)
+{
+  octx->oc->interrupt_callback = octx->interrupt_cb;
+  if (octx->to_memory) return avio_open_dyn_buf(&octx->oc->pb);
+  return avio_open2(&octx->oc->pb, octx->fname, AVIO_FLAG_WRITE,
+                    &octx->interrupt_cb, NULL);
+}
+
+static void close_output_io(struct output_ctx *octx)
+{
+  uint8_t *data = NULL;
+  int size = 0;
+  if (!octx->to_memory) {
+    avio_closep(&octx->oc->pb);
+    return;
+  }
+  size = avio_close_dyn_buf(octx->oc->pb, &data);
+  octx->oc->pb = NULL;
+  if (!octx->res) {
+    av_free(data);
+    return;
+  }
+  // hand the output over to the caller
+  av_free(octx->res->data);
+  octx->res->data = data;
+  octx->res->data_size = size;
+}
+
 void close_output(struct output_ctx *octx)
 {
   if (octx->oc) {
     if (!(octx->oc->oformat->flags & AVFMT_NOFILE) && octx->oc->pb) {
-      avio_closep(&octx->oc->pb);
+      close_output_io(octx);
     }
     avformat_free_context(octx->oc);
     octx->oc = NULL;
@@ -157,7 +222,8 @@ int open_output(struct output_ctx *octx, struct input_ctx *ictx)
 
   AVOutputFormat *fmt = NULL;
   AVFormatContext *oc = NULL;
-  static AVCodecContext *vc  = NULL;
+  struct hw_session *session = octx->session;
+  AVCodecContext *vc  = NULL;
   AVCodec *codec      = NULL;
 
   // open muxer
@@ -177,12 +243,16 @@ int open_output(struct output_ctx *octx, struct input_ctx *ictx)
 
     // open video encoder
     // XXX use avoptions rather than manual enumeration
-    if (!vc) {
+    // Only hardware sessions are shared, and only between outputs using the
+    // same encoder and options. Software encoders are freed by close_output.
+    // The first hardware encoder opened becomes the shared session.
+    if (!can_share_session(session, codec, octx->video->opts) || AV_HWDEVICE_TYPE_NONE == ictx->hw_type) {
         vc = avcodec_alloc_context3(codec);
         if (!vc) LPMS_ERR(open_output_err, "Unable to alloc video encoder");
         octx->vc = vc;
         vc->width = av_buffersink_get_w(octx->vf.sink_ctx);
         vc->height = av_buffersink_get_h(octx->vf.sink_ctx);
+        vc->sample_aspect_ratio = av_buffersink_get_sample_aspect_ratio(octx->vf.sink_ctx);
         if (octx->fps.den) vc->framerate = av_buffersink_get_frame_rate(octx->vf.sink_ctx);
         else vc->framerate = ictx->vc->framerate;
         if (octx->fps.den) vc->time_base = av_buffersink_get_time_base(octx->vf.sink_ctx);
@@ -200,15 +270,18 @@ int open_output(struct output_ctx *octx, struct input_ctx *ictx)
         vc->pix_fmt = av_buffersink_get_format(octx->vf.sink_ctx); // XXX select based on encoder + input support
         if (fmt->flags & AVFMT_GLOBALHEADER) vc->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
         av_log(NULL, AV_LOG_INFO, "Opening video encoder session for %dx%d fps %d/%d tb %d/%d bitrate %ld\n", vc->width, vc->height, vc->framerate.num, vc->framerate.den, vc->time_base.num, vc->time_base.den, (long) vc->bit_rate);
-        clock_t t;
-        t = clock();
+        int share = AV_HWDEVICE_TYPE_NONE != ictx->hw_type && !session->vc;
+        if (share) {
+          ret = save_session_opts(session, octx->video->opts);
+          if (ret < 0) LPMS_ERR(open_output_err, "Unable to copy encoder options");
+        }
+        int64_t t = av_gettime_relative();
         ret = avcodec_open2(vc, codec, &octx->video->opts);
-        t = clock() - t;
-        float time_taken = ((float)t)/CLOCKS_PER_SEC; 
-        printf("Opening session took %f seconds\n", time_taken);
+        octx->res->encode_us += av_gettime_relative() - t;
         if (ret < 0) LPMS_ERR(open_output_err, "Error opening video encoder");
+        if (share) session->vc = vc;
     } else {
-        octx->vc = vc;
+        octx->vc = session->vc;
     }
     octx->hw_type = ictx->hw_type;
   }
@@ -224,7 +297,7 @@ int open_output(struct output_ctx *octx, struct input_ctx *ictx)
   if (ret < 0) LPMS_ERR(open_output_err, "Error opening audio output");
 
   if (!(fmt->flags & AVFMT_NOFILE)) {
-    ret = avio_open(&octx->oc->pb, octx->fname, AVIO_FLAG_WRITE);
+    ret = open_output_io(octx);
     if (ret < 0) LPMS_ERR(open_output_err, "Error opening output file");
   }
 
@@ -258,7 +331,7 @@ int reopen_output(struct output_ctx *octx, struct input_ctx *ictx)
   if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to re-add audio stream");
 
   if (!(fmt->flags & AVFMT_NOFILE)) {
-    ret = avio_open(&octx->oc->pb, octx->fname, AVIO_FLAG_WRITE);
+    ret = open_output_io(octx);
     if (ret < 0) LPMS_ERR(reopen_out_err, "Error re-opening output file");
   }
   ret = avformat_write_header(octx->oc, &octx->muxer->opts);
@@ -272,6 +345,8 @@ static int encode(AVCodecContext* encoder, AVFrame *frame, struct output_ctx* oc
 {
   int ret = 0;
   AVPacket pkt = {0};
+  // muxing happens within here but is counted separately
+  int64_t start = av_gettime_relative(), mux_us = octx->res->mux_us;
 
   if (AVMEDIA_TYPE_VIDEO == ost->codecpar->codec_type && frame) {
     if (!octx->res->frames) {
@@ -307,11 +382,14 @@ static int encode(AVCodecContext* encoder, AVFrame *frame, struct output_ctx* oc
 
 encode_cleanup:
   av_packet_unref(&pkt);
+  octx->res->encode_us += av_gettime_relative() - start - (octx->res->mux_us - mux_us);
   return ret;
 }
 
 int mux(AVPacket *pkt, AVRational tb, struct output_ctx *octx, AVStream *ost)
 {
+  int ret = 0;
+  int64_t start = 0;
   pkt->stream_index = ost->index;
   if (av_cmp_q(tb, ost->time_base)) {
     av_packet_rescale_ts(pkt, tb, ost->time_base);
@@ -325,7 +403,10 @@ int mux(AVPacket *pkt, AVRational tb, struct output_ctx *octx, AVStream *ost)
       if (pkt->pts && pkt->pts == octx->drop_ts) return 0;
   }
   // printf("stream cur_dtx=%d, packet dts=%d\n",  ost->cur_dts, pkt->dts);
-  return av_interleaved_write_frame(octx->oc, pkt);
+  start = av_gettime_relative();
+  ret = av_interleaved_write_frame(octx->oc, pkt);
+  octx->res->mux_us += av_gettime_relative() - start;
+  return ret;
 }
 
 int process_out(struct input_ctx *ictx, struct output_ctx *octx, AVCodecContext *encoder, AVStream *ost,
@@ -351,13 +432,17 @@ int process_out(struct input_ctx *ictx, struct output_ctx *octx, AVCodecContext
       if (inf) av_log(NULL, AV_LOG_INFO, "processing output segment %s frame pts %ld for resolution %dx%d br %ld\n", octx->fname, inf->pts, encoder->width, encoder->height, (long) encoder->bit_rate);
   }
 
+  int64_t start = av_gettime_relative();
   ret = filtergraph_write(inf, ictx, octx, filter, is_video);
+  octx->res->filter_us += av_gettime_relative() - start;
   if (ret < 0) goto proc_cleanup;
 
   while (1) {
     // Drain the filter. Each input frame may have multiple output frames
     AVFrame *frame = filter->frame;
+    start = av_gettime_relative();
     ret = filtergraph_read(ictx, octx, filter, is_video);
+    octx->res->filter_us += av_gettime_relative() - start;
     if (ret == lpms_ERR_FILTER_FLUSHED) continue;
     else if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) {
       // no frame returned from filtergraph
@@ -393,9 +478,21 @@ static int add_video_stream1(struct output_ctx *octx, struct decode_meta *dmeta)
   if (!st) LPMS_ERR(add_video_err, "Unable to alloc video stream");
   octx->vi = st->index;
   st->avg_frame_rate = octx->fps;
-  if (octx->vc) {
+  if (is_copy(octx->video->name)) {
+    if (dmeta->vi < 0 || !dmeta->v_codecpar) LPMS_ERR(add_video_err, "Input video stream does not exist");
+    st->time_base = dmeta->time_base;
+    ret = avcodec_parameters_copy(st->codecpar, dmeta->v_codecpar);
+    if (ret < 0) LPMS_ERR(add_video_err, "Error copying video params from input stream");
+    // Sometimes the codec tag is wonky for some reason, so correct it
+    ret = av_codec_get_tag2(octx->oc->oformat->codec_tag, st->codecpar->codec_id, &st->codecpar->codec_tag);
+    // No input stream to transfer timing info from, so set it directly
+    st->r_frame_rate = dmeta->r_frame_rate;
+    if (!st->avg_frame_rate.den) st->avg_frame_rate = dmeta->avg_frame_rate;
+  } else if (octx->vc) {
     st->time_base = octx->vc->time_base;
+    st->sample_aspect_ratio = octx->vc->sample_aspect_ratio;
     ret = avcodec_parameters_from_context(st->codecpar, octx->vc);
+    set_hevc_tag(octx->oc, st);
     if (octx->gop_time) {
       // Rescale the gop time to the expected timebase after filtering.
       // The FPS filter outputs pts incrementing by 1 at a rate of 1/framerate
@@ -416,13 +513,94 @@ add_video_err:
   return ret;
 }
 
+static int add_audio_stream1(struct decode_meta *dmeta, struct output_ctx *octx)
+{
+  if (dmeta->ai < 0 || octx->da) {
+    // Don't need to add an audio stream if no input audio exists,
+    // or we're dropping the output audio stream
+    return 0;
+  }
+
+  // audio stream to muxer
+  int ret = 0;
+  AVStream *st = avformat_new_stream(octx->oc, NULL);
+  if (!st) LPMS_ERR(add_audio_err, "Unable to alloc audio stream");
+  if (is_copy(octx->audio->name)) {
+    if (!dmeta->a_codecpar) LPMS_ERR(add_audio_err, "Input audio stream does not exist");
+    st->time_base = dmeta->a_time_base;
+    ret = avcodec_parameters_copy(st->codecpar, dmeta->a_codecpar);
+    if (ret < 0) LPMS_ERR(add_audio_err, "Error copying audio params from input stream");
+    // Sometimes the codec tag is wonky for some reason, so correct it
+    ret = av_codec_get_tag2(octx->oc->oformat->codec_tag, st->codecpar->codec_id, &st->codecpar->codec_tag);
+  } else if (octx->ac) {
+    st->time_base = octx->ac->time_base;
+    ret = avcodec_parameters_from_context(st->codecpar, octx->ac);
+    if (ret < 0) LPMS_ERR(add_audio_err, "Error setting audio params from encoder");
+  } else if (is_drop(octx->audio->name)) {
+    // Supposed to exit this function early if there's a drop
+    LPMS_ERR(add_audio_err, "Shouldn't ever happen here");
+  } else {
+    LPMS_ERR(add_audio_err, "No audio encoder; not a copy; what is this?");
+  }
+  octx->ai = st->index;
+
+  // signal whether to drop preroll audio
+  if (st->codecpar->initial_padding) octx->drop_ts = AV_NOPTS_VALUE;
+  return 0;
+
+add_audio_err:
+  // XXX free anything here?
+  return ret;
+}
+
+static int open_audio_output1(struct decode_meta *dmeta, struct output_ctx *octx,
+  AVOutputFormat *fmt)
+{
+  int ret = 0;
+  AVCodec *codec = NULL;
+  AVCodecContext *ac = NULL;
+
+  // add audio encoder if a decoder exists and this output requires one
+  if (dmeta->has_ac && !octx->da && needs_decoder(octx->audio->name)) {
+
+    // initialize audio filters
+    ret = init_audio_filters1(dmeta, octx);
+    if (ret < 0) LPMS_ERR(audio_output_err, "Unable to open audio filter")
+
+    // open encoder
+    codec = avcodec_find_encoder_by_name(octx->audio->name);
+    if (!codec) LPMS_ERR(audio_output_err, "Unable to find audio encoder");
+    // open audio encoder
+    ac = avcodec_alloc_context3(codec);
+    if (!ac) LPMS_ERR(audio_output_err, "Unable to alloc audio encoder");
+    octx->ac = ac;
+    ac->sample_fmt = av_buffersink_get_format(octx->af.sink_ctx);
+    ac->channel_layout = av_buffersink_get_channel_layout(octx->af.sink_ctx);
+    ac->channels = av_buffersink_get_channels(octx->af.sink_ctx);
+    ac->sample_rate = av_buffersink_get_sample_rate(octx->af.sink_ctx);
+    ac->time_base = av_buffersink_get_time_base(octx->af.sink_ctx);
+    if (fmt->flags & AVFMT_GLOBALHEADER) ac->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
+    ret = avcodec_open2(ac, codec, &octx->audio->opts);
+    if (ret < 0) LPMS_ERR(audio_output_err, "Error opening audio encoder");
+    av_buffersink_set_frame_size(octx->af.sink_ctx, ac->frame_size);
+  }
+
+  ret = add_audio_stream1(dmeta, octx);
+  if (ret < 0) LPMS_ERR(audio_output_err, "Error adding audio stream")
+
+audio_output_err:
+  // TODO clean up anything here?
+  return ret;
+}
+
 int open_output1(struct output_ctx *octx, struct decode_meta *dmeta)
 {
   int ret = 0, inp_has_stream;
   av_log(NULL, AV_LOG_WARNING, "open output function called\n");
   AVOutputFormat *fmt = NULL;
   AVFormatContext *oc = NULL;
-  static AVCodecContext *vc  = NULL;
+  struct hw_session *session = octx->session;
+  AVCodecContext *vc  = NULL;
   AVCodec *codec      = NULL;
   // open muxer
   fmt = av_guess_format(octx->muxer->name, octx->fname, NULL);
@@ -430,8 +608,8 @@ int open_output1(struct output_ctx *octx, struct decode_meta *dmeta)
   ret = avformat_alloc_output_context2(&oc, fmt, NULL, octx->fname);
   if (ret < 0) LPMS_ERR(open_output_err, "Unable to alloc output context");
   octx->oc = oc;
-  // add video encoder if a decoder exists and this output requires one
-  if (needs_decoder(octx->video->name)) {
+  // add video encoder if the input has video and this output requires one
+  if (!octx->dv && needs_decoder(octx->video->name)) {
     av_log(NULL, AV_LOG_WARNING, "open output function called 2\n");
     ret = init_video_filters1(dmeta, octx);
     if (ret < 0) LPMS_ERR(open_output_err, "Unable to open video filter");
@@ -441,7 +619,11 @@ int open_output1(struct output_ctx *octx, struct decode_meta *dmeta)
     av_log(NULL, AV_LOG_WARNING, "open output function called 4\n");
     // open video encoder
     // XXX use avoptions rather than manual enumeration
-    if (!vc) {
+    // Only hardware sessions are shared, between outputs using the same
+    // encoder and options. Software encoders are freed by close_output at
+    // the end of every segment so can't be reused.
+    if (!can_share_session(session, codec, octx->video->opts) || !octx->share_session ||
+        AV_HWDEVICE_TYPE_NONE == dmeta->hw_type) {
         av_log(NULL, AV_LOG_WARNING, "open output function called 5\n");
         vc = avcodec_alloc_context3(codec);
         av_log(NULL, AV_LOG_WARNING, "open output function called 6\n");
@@ -449,6 +631,7 @@ int open_output1(struct output_ctx *octx, struct decode_meta *dmeta)
         octx->vc = vc;
         vc->width = av_buffersink_get_w(octx->vf.sink_ctx);
         vc->height = av_buffersink_get_h(octx->vf.sink_ctx);
+        vc->sample_aspect_ratio = av_buffersink_get_sample_aspect_ratio(octx->vf.sink_ctx);
         if (octx->fps.den) vc->framerate = av_buffersink_get_frame_rate(octx->vf.sink_ctx);
         else vc->framerate = dmeta->framerate;
         if (octx->fps.den) vc->time_base = av_buffersink_get_time_base(octx->vf.sink_ctx);
@@ -466,15 +649,18 @@ int open_output1(struct output_ctx *octx, struct decode_meta *dmeta)
         vc->pix_fmt = av_buffersink_get_format(octx->vf.sink_ctx); // XXX select based on encoder + input support
         if (fmt->flags & AVFMT_GLOBALHEADER) vc->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
         av_log(NULL, AV_LOG_WARNING, "Opening video encoder session for %dx%d fps %d/%d tb %d/%d bitrate %ld\n", vc->width, vc->height, vc->framerate.num, vc->framerate.den, vc->time_base.num, vc->time_base.den, (long) vc->bit_rate);
-        clock_t t;
-        t = clock();
+        int share = AV_HWDEVICE_TYPE_NONE != dmeta->hw_type && octx->share_session && !session->vc;
+        if (share) {
+          ret = save_session_opts(session, octx->video->opts);
+          if (ret < 0) LPMS_ERR(open_output_err, "Unable to copy encoder options");
+        }
+        int64_t t = av_gettime_relative();
         ret = avcodec_open2(vc, codec, &octx->video->opts);
-        t = clock() - t;
-        float time_taken = ((float)t)/CLOCKS_PER_SEC; 
-        printf("Opening session took %f seconds\n", time_taken);
+        octx->res->encode_us += av_gettime_relative() - t;
         if (ret < 0) LPMS_ERR(open_output_err, "Error opening video encoder");
+        if (share) session->vc = vc;
     } else {
-        octx->vc = vc;
+        octx->vc = session->vc;
     }
     octx->hw_type = dmeta->hw_type;
   }
@@ -484,11 +670,11 @@ int open_output1(struct output_ctx *octx, struct decode_meta *dmeta)
     ret = add_video_stream1(octx, dmeta);
     if (ret < 0) LPMS_ERR(open_output_err, "Error adding video stream");
   }
-  // ret = open_audio_output(ictx, octx, fmt);
-  // if (ret < 0) LPMS_ERR(open_output_err, "Error opening audio output");
+  ret = open_audio_output1(dmeta, octx, fmt);
+  if (ret < 0) LPMS_ERR(open_output_err, "Error opening audio output");
 
   if (!(fmt->flags & AVFMT_NOFILE)) {
-    ret = avio_open(&octx->oc->pb, octx->fname, AVIO_FLAG_WRITE);
+    ret = open_output_io(octx);
     if (ret < 0) LPMS_ERR(open_output_err, "Error opening output file");
   }
 
@@ -518,11 +704,11 @@ int reopen_output1(struct output_ctx *octx, struct decode_meta *dmeta)
   } else LPMS_INFO("No video stream!?");
 
   // re-attach audio encoder
-  // ret = open_audio_output(ictx, octx, fmt);
-  // if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to re-add audio stream");
+  ret = open_audio_output1(dmeta, octx, fmt);
+  if (ret < 0) LPMS_ERR(reopen_out_err, "Unable to re-add audio stream");
 
   if (!(fmt->flags & AVFMT_NOFILE)) {
-    ret = avio_open(&octx->oc->pb, octx->fname, AVIO_FLAG_WRITE);
+    ret = open_output_io(octx);
     if (ret < 0) LPMS_ERR(reopen_out_err, "Error re-opening output file");
   }
   ret = avformat_write_header(octx->oc, &octx->muxer->opts);
@@ -555,13 +741,17 @@ int process_out1(struct decode_meta *dmeta, struct output_ctx *octx, AVCodecCont
       if (inf) av_log(NULL, AV_LOG_INFO, "processing output segment %s frame pts %ld for resolution %dx%d br %ld\n", octx->fname, inf->pts, encoder->width, encoder->height, (long) encoder->bit_rate);
   }
 
+  int64_t start = av_gettime_relative();
   ret = filtergraph_write1(inf, dmeta, octx, filter, is_video);
+  octx->res->filter_us += av_gettime_relative() - start;
   if (ret < 0) goto proc_cleanup;
 
   while (1) {
     // Drain the filter. Each input frame may have multiple output frames
     AVFrame *frame = filter->frame;
+    start = av_gettime_relative();
     ret = filtergraph_read1(dmeta, octx, filter, is_video);
+    octx->res->filter_us += av_gettime_relative() - start;
     if (ret == lpms_ERR_FILTER_FLUSHED) continue;
     else if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) {
       // no frame returned from filtergraph
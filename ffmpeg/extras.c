@@ -1,11 +1,63 @@
 #include "extras.h"
+#include "decoder.h"
+#include "logging.h"
+#include <math.h>
 #include <libavcodec/avcodec.h>
 #include <libavformat/avformat.h>
+#include <libavutil/display.h>
+#include <libavutil/opt.h>
+#include <libavutil/pixdesc.h>
 
 //
 // Segmenter
 //
 
+// Opens the HLS muxer with an output stream for each mapped input stream.
+// When appending, the playlist left by a previous muxer is continued.
+static int r2h_open_output(AVFormatContext **poc, AVFormatContext *ic,
+  int *stream_map, int *out_map, char *outf, char *ts_tmpl, char *seg_time,
+  char *seg_start, int append)
+{
+  int ret               = 0;
+  AVFormatContext *oc   = NULL;
+  AVOutputFormat *ofmt  = NULL;
+  AVStream *ost         = NULL;
+  AVDictionary *md      = NULL;
+
+  ofmt = av_guess_format(NULL, outf, NULL);
+  if (!ofmt) LPMS_ERR(r2h_open_err, "Could not deduce output format from file extension");
+  ret = avformat_alloc_output_context2(&oc, ofmt, NULL, outf);
+  if (ret < 0) LPMS_ERR(r2h_open_err, "Unable to allocate output context");
+
+  for (int i = 0; i < 2; i++) {
+    out_map[i] = -1;
+    if (stream_map[i] < 0) continue;
+    ost = avformat_new_stream(oc, NULL);
+    if (!ost) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR(r2h_open_err, "segmenter: Unable to allocate output stream");
+    }
+    ret = avcodec_parameters_copy(ost->codecpar, ic->streams[stream_map[i]]->codecpar);
+    if (ret < 0) LPMS_ERR(r2h_open_err, "segmenter: Unable to copy stream parameters");
+    out_map[i] = ost->index;
+  }
+
+  av_dict_set(&md, "hls_time", seg_time, 0);
+  av_dict_set(&md, "hls_segment_filename", ts_tmpl, 0);
+  av_dict_set(&md, "start_number", seg_start, 0);
+  av_dict_set(&md, "hls_flags", append ? "delete_segments+append_list" : "delete_segments", 0);
+  ret = avformat_write_header(oc, &md);
+  if (ret < 0) LPMS_ERR(r2h_open_err, "Error writing header");
+  av_dict_free(&md);
+  *poc = oc;
+  return 0;
+
+r2h_open_err:
+  if (oc) avformat_free_context(oc);
+  if (md) av_dict_free(&md);
+  return ret;
+}
+
 int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char* seg_time, char *seg_start)
 {
 #define r2h_err(str) {\
@@ -17,13 +69,11 @@ int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char* seg_time, char
   int ret               = 0;
   AVFormatContext *ic   = NULL;
   AVFormatContext *oc   = NULL;
-  AVOutputFormat *ofmt  = NULL;
   AVStream *ist         = NULL;
   AVStream *ost         = NULL;
-  AVDictionary *md      = NULL;
-  AVCodec *codec        = NULL;
   int64_t prev_ts[2]    = {AV_NOPTS_VALUE, AV_NOPTS_VALUE};
-  int stream_map[2]     = {-1, -1};
+  int stream_map[2]     = {-1, -1}; // input stream indices for video, audio
+  int out_map[2]        = {-1, -1}; // output stream indices for video, audio
   int got_video_kf      = 0;
   AVPacket pkt;
 
@@ -32,32 +82,19 @@ int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char* seg_time, char
   ret = avformat_find_stream_info(ic, NULL);
   if (ret < 0) r2h_err("segmenter: Unable to find any input streams\n");
 
-  ofmt = av_guess_format(NULL, outf, NULL);
-  if (!ofmt) r2h_err("Could not deduce output format from file extension\n");
-  ret = avformat_alloc_output_context2(&oc, ofmt, NULL, outf);
-  if (ret < 0) r2h_err("Unable to allocate output context\n");
-
-  // XXX accommodate cases where audio or video is empty
-  stream_map[0] = av_find_best_stream(ic, AVMEDIA_TYPE_VIDEO, -1, -1, &codec, 0);
-  if (stream_map[0] < 0) r2h_err("segmenter: Unable to find video stream\n");
-  stream_map[1] = av_find_best_stream(ic, AVMEDIA_TYPE_AUDIO, -1, -1, &codec, 0);
-  if (stream_map[1] < 0) r2h_err("segmenter: Unable to find audio stream\n");
-
-  ist = ic->streams[stream_map[0]];
-  ost = avformat_new_stream(oc, NULL);
-  if (!ost) r2h_err("segmenter: Unable to allocate output video stream\n");
-  avcodec_parameters_copy(ost->codecpar, ist->codecpar);
-  ist = ic->streams[stream_map[1]];
-  ost = avformat_new_stream(oc, NULL);
-  if (!ost) r2h_err("segmenter: Unable to allocate output audio stream\n");
-  avcodec_parameters_copy(ost->codecpar, ist->codecpar);
+  // Either of audio or video may be missing. Broadcasts that start out
+  // audio-only are segmented as such until video shows up.
+  stream_map[0] = av_find_best_stream(ic, AVMEDIA_TYPE_VIDEO, -1, -1, NULL, 0);
+  stream_map[1] = av_find_best_stream(ic, AVMEDIA_TYPE_AUDIO, -1, -1, NULL, 0);
+  if (stream_map[0] < 0 && stream_map[1] < 0) {
+    ret = AVERROR_STREAM_NOT_FOUND;
+    r2h_err("segmenter: Unable to find audio or video stream\n");
+  }
+  if (stream_map[0] < 0) stream_map[0] = -1;
+  if (stream_map[1] < 0) stream_map[1] = -1;
 
-  av_dict_set(&md, "hls_time", seg_time, 0);
-  av_dict_set(&md, "hls_segment_filename", ts_tmpl, 0);
-  av_dict_set(&md, "start_number", seg_start, 0);
-  av_dict_set(&md, "hls_flags", "delete_segments", 0);
-  ret = avformat_write_header(oc, &md);
-  if (ret < 0) r2h_err("Error writing header\n");
+  ret = r2h_open_output(&oc, ic, stream_map, out_map, outf, ts_tmpl, seg_time, seg_start, 0);
+  if (ret < 0) r2h_err("segmenter: Unable to open output\n");
 
   av_init_packet(&pkt);
   while (1) {
@@ -66,17 +103,33 @@ int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char* seg_time, char
       av_interleaved_write_frame(oc, NULL); // flush
       break;
     } else if (ret < 0) r2h_err("Error reading\n");
-    // rescale timestamps
-    if (pkt.stream_index == stream_map[0]) pkt.stream_index = 0;
-    else if (pkt.stream_index == stream_map[1]) pkt.stream_index = 1;
+    ist = ic->streams[pkt.stream_index];
+    if (stream_map[0] < 0 && AVMEDIA_TYPE_VIDEO == ist->codecpar->codec_type) {
+      // Video appeared after the start of an audio-only stream. Streams can't
+      // be added to a muxer once started, so start another one that picks up
+      // the playlist where the audio-only one left off.
+      av_interleaved_write_frame(oc, NULL); // flush
+      // The playlist goes on, so the trailer must not end it
+      ret = av_opt_set(oc->priv_data, "hls_flags", "delete_segments+omit_endlist", 0);
+      if (ret < 0) r2h_err("segmenter: Unable to keep the playlist open\n");
+      ret = av_write_trailer(oc);
+      if (ret < 0) r2h_err("segmenter: Unable to write trailer\n");
+      avformat_free_context(oc);
+      oc = NULL;
+      stream_map[0] = pkt.stream_index;
+      ret = r2h_open_output(&oc, ic, stream_map, out_map, outf, ts_tmpl, seg_time, seg_start, 1);
+      if (ret < 0) r2h_err("segmenter: Unable to reopen output with video\n");
+    }
+    int idx;
+    if (pkt.stream_index == stream_map[0]) idx = 0;
+    else if (pkt.stream_index == stream_map[1]) idx = 1;
     else goto r2hloop_end;
-    ist = ic->streams[stream_map[pkt.stream_index]];
-    ost = oc->streams[pkt.stream_index];
-    int64_t dts_next = pkt.dts, dts_prev = prev_ts[pkt.stream_index];
-    if (oc->streams[pkt.stream_index]->codecpar->codec_type == AVMEDIA_TYPE_VIDEO &&
-        AV_NOPTS_VALUE == dts_prev &&
+    ost = oc->streams[out_map[idx]];
+    int64_t dts_next = pkt.dts, dts_prev = prev_ts[idx];
+    if (!idx && AV_NOPTS_VALUE == dts_prev &&
         (pkt.flags & AV_PKT_FLAG_KEY)) got_video_kf = 1;
-    if (!got_video_kf) goto r2hloop_end; // skip everyting until first video KF
+    // skip everything until first video KF, if there is video
+    if (stream_map[0] >= 0 && !got_video_kf) goto r2hloop_end;
     if (AV_NOPTS_VALUE == dts_prev) dts_prev = dts_next;
     else if (dts_next <= dts_prev) goto r2hloop_end; // drop late packets
     pkt.pts = av_rescale_q_rnd(pkt.pts, ist->time_base, ost->time_base,
@@ -85,7 +138,8 @@ int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char* seg_time, char
         AV_ROUND_NEAR_INF | AV_ROUND_PASS_MINMAX);
     if (!pkt.duration) pkt.duration = dts_next - dts_prev;
     pkt.duration = av_rescale_q(pkt.duration, ist->time_base, ost->time_base);
-    prev_ts[pkt.stream_index] = dts_next;
+    prev_ts[idx] = dts_next;
+    pkt.stream_index = out_map[idx];
     // write the thing
     ret = av_interleaved_write_frame(oc, &pkt);
     if (ret < 0) r2h_err("segmenter: Unable to write output frame\n");
@@ -99,46 +153,83 @@ handle_r2h_err:
   if (errstr) fprintf(stderr, "%s", errstr);
   if (ic) avformat_close_input(&ic);
   if (oc) avformat_free_context(oc);
-  if (md) av_dict_free(&md);
   return ret == AVERROR_EOF ? 0 : ret;
 }
 
 //
-// Bypass Check
-// this is needed to handle streams that have first few segments that are
-// audio-only (i.e. have a video stream but no frames)
-// returns: 0 if both audio/video streams valid
-//          1 for video with 0-frame, that needs bypass
-//          <0 invalid stream(s) or internal error
+// Probe
 //
-int lpms_is_bypass_needed(char *fname)
+
+static int stream_rotation(AVStream *st)
 {
+  uint8_t *matrix = av_stream_get_side_data(st, AV_PKT_DATA_DISPLAYMATRIX, NULL);
+  AVDictionaryEntry *tag = av_dict_get(st->metadata, "rotate", NULL, 0);
+  double theta = 0;
+  int rotation = 0;
+  // the display matrix rotation is counterclockwise
+  if (matrix) theta = -av_display_rotation_get((int32_t *) matrix);
+  else if (tag) theta = atof(tag->value);
+  if (isnan(theta)) return 0;
+  rotation = (int) lrint(theta) % 360;
+  return rotation < 0 ? rotation + 360 : rotation;
+}
+
+int lpms_probe(input_params *inp, probe_info *info)
+{
+  struct input_ctx ictx = {0};
   AVFormatContext *ic = NULL;
-  int ret = 0, vstream = 0, astream = 0;
+  int ret = 0;
 
-  ret = avformat_open_input(&ic, fname, NULL, NULL);
-  if (ret < 0) { ret = -1; goto close_format_context; }
-  ret = avformat_find_stream_info(ic, NULL);
-  if (ret < 0) { ret = -1; goto close_format_context; }
-
-  vstream = av_find_best_stream(ic, AVMEDIA_TYPE_VIDEO, -1, -1, NULL, 0);
-  astream = av_find_best_stream(ic, AVMEDIA_TYPE_AUDIO, -1, -1, NULL, 0);
-  if (vstream >= 0 && astream >= 0) {
-      if (AV_PIX_FMT_NONE == ic->streams[vstream]->codecpar->format &&
-          0 == ic->streams[vstream]->codecpar->height) {
-          // no valid pixel format and picture height => needs bypass
-          ret = 1;
-      } else {
-          // no bypass needed if video stream is valid
-          ret = 0;
-      }
-  } else {
-      // one of audio or video streams not present at all, won't bypass
-      ret = -1;
+  ret = open_demuxer(inp, &ictx);
+  if (ret < 0) LPMS_ERR(probe_err, "Unable to open input for probing");
+  ic = ictx.ic;
+
+  info->format = ic->iformat->name;
+  info->duration = ic->duration;
+  info->bit_rate = ic->bit_rate;
+  info->video_stream = av_find_best_stream(ic, AVMEDIA_TYPE_VIDEO, -1, -1, NULL, 0);
+  if (info->video_stream < 0) info->video_stream = -1;
+  info->audio_stream = av_find_best_stream(ic, AVMEDIA_TYPE_AUDIO, -1, -1, NULL, 0);
+  if (info->audio_stream < 0) info->audio_stream = -1;
+  if (ic->nb_streams) {
+    info->streams = av_mallocz_array(ic->nb_streams, sizeof(probe_stream));
+    if (!info->streams) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR(probe_err, "Unable to allocate probe streams");
+    }
   }
-close_format_context:
-  if (ic) avformat_close_input(&ic);
+  info->nb_streams = ic->nb_streams;
+
+  for (int i = 0; i < ic->nb_streams; i++) {
+    AVStream *st = ic->streams[i];
+    AVCodecParameters *par = st->codecpar;
+    probe_stream *ps = &info->streams[i];
+    ps->index = st->index;
+    ps->type = av_get_media_type_string(par->codec_type);
+    ps->codec = avcodec_get_name(par->codec_id);
+    ps->profile = avcodec_profile_name(par->codec_id, par->profile);
+    ps->bit_rate = par->bit_rate;
+    ps->duration = AV_NOPTS_VALUE == st->duration ? AV_NOPTS_VALUE :
+      av_rescale_q(st->duration, st->time_base, AV_TIME_BASE_Q);
+    if (AVMEDIA_TYPE_VIDEO == par->codec_type) {
+      ps->width = par->width;
+      ps->height = par->height;
+      ps->pix_fmt = av_get_pix_fmt_name(par->format);
+      ps->frame_rate = st->avg_frame_rate.den ? st->avg_frame_rate : st->r_frame_rate;
+      ps->rotation = stream_rotation(st);
+    } else if (AVMEDIA_TYPE_AUDIO == par->codec_type) {
+      ps->sample_rate = par->sample_rate;
+      ps->channels = par->channels;
+    }
+  }
+
+probe_err:
+  close_demuxer(&ictx);
   return ret;
 }
 
-
+void lpms_probe_free(probe_info *info)
+{
+  av_freep(&info->streams);
+  info->nb_streams = 0;
+}
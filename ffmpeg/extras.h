@@ -1,7 +1,39 @@
 #ifndef _LPMS_EXTRAS_H_
 #define _LPMS_EXTRAS_H_
 
+#include "transcoder.h"
+
 int lpms_rtmp2hls(char *listen, char *outf, char *ts_tmpl, char *seg_time, char *seg_start);
-int lpms_is_bypass_needed(char *fname);
+
+// Strings point to static FFmpeg data and are never freed
+typedef struct {
+  int index;
+  const char *type;       // media type, e.g. "video"
+  const char *codec;
+  const char *profile;    // NULL if unknown
+  int64_t bit_rate;
+  int64_t duration;       // in AV_TIME_BASE units, or AV_NOPTS_VALUE
+  // video
+  int width, height;
+  const char *pix_fmt;    // NULL if unknown
+  AVRational frame_rate;
+  int rotation;           // clockwise degrees
+  // audio
+  int sample_rate;
+  int channels;
+} probe_stream;
+
+typedef struct {
+  const char *format;
+  int64_t duration;       // in AV_TIME_BASE units, or AV_NOPTS_VALUE
+  int64_t bit_rate;
+  int video_stream;       // best video stream index, or -1
+  int audio_stream;       // best audio stream index, or -1
+  int nb_streams;
+  probe_stream *streams;
+} probe_info;
+
+int lpms_probe(input_params *inp, probe_info *info);
+void lpms_probe_free(probe_info *info);
 
 #endif // _LPMS_EXTRAS_H_
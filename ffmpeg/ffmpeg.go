@@ -1,13 +1,19 @@
 package ffmpeg
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/golang/glog"
@@ -15,6 +21,8 @@ import (
 
 // #cgo pkg-config: libavformat libavfilter libavcodec libavutil libswscale gnutls
 // #include <stdlib.h>
+// #include <libavutil/imgutils.h>
+// #include <libavutil/pixdesc.h>
 // #include "transcoder.h"
 // #include "decoder.h"
 // #include "extras.h"
@@ -27,6 +35,16 @@ var ErrTranscoderStp = errors.New("TranscoderStopped")
 var ErrTranscoderFmt = errors.New("TranscoderUnrecognizedFormat")
 var ErrTranscoderPrf = errors.New("TranscoderUnrecognizedProfile")
 var ErrTranscoderGOP = errors.New("TranscoderInvalidGOP")
+var ErrTranscoderBuf = errors.New("TranscoderBufferReleased")
+var ErrTranscoderVcd = errors.New("TranscoderUnrecognizedVideoCodec")
+var ErrTranscoderMux = errors.New("TranscoderIncompatibleMuxer")
+var ErrTranscoderRC = errors.New("TranscoderInvalidRateControl")
+var ErrTranscoderTun = errors.New("TranscoderUnsupportedTuning")
+var ErrTranscoderTrm = errors.New("TranscoderInvalidTrim")
+var ErrTranscoderAsp = errors.New("TranscoderInvalidAspectRatio")
+var ErrTranscoderAud = errors.New("TranscoderInvalidAudioProfile")
+var ErrTranscoderOvl = errors.New("TranscoderInvalidOverlay")
+var ErrTranscoderSeg = errors.New("TranscoderInvalidSerializedSegment")
 
 type Acceleration int
 
@@ -44,29 +62,44 @@ type ComponentOptions struct {
 type Transcoder struct {
 	handle  *C.struct_transcode_thread
 	stopped bool
-	started bool
 	mu      *sync.Mutex
 }
 
 type TranscodeOptionsIn struct {
-	Fname  string
+	Fname string
+	// In-memory input, read instead of Fname. Fname may still be set as a
+	// hint for the container format. Data takes precedence over Reader,
+	// which is read in full before the segment is opened.
+	Data   []byte
+	Reader io.Reader
 	Accel  Acceleration
 	Device string
+	// Maximum number of decoded frames buffered per segment.
+	// Zero for the default of 1000 frames.
+	MaxFrames int
+	// In and out points. Frames before the in point and from the out point
+	// on are dropped, so outputs start with a keyframe at the in point.
+	// Points are either times from the start of the input or video frame
+	// numbers counting from zero, but not both. Zero for no trimming.
+	// Copied streams are only trimmed to the nearest packet.
+	InTime, OutTime   time.Duration
+	InFrame, OutFrame int
 }
 
 type EncodeOptionsIn struct {
 	Fname     string
-	DframeBuf DframeBuffer
+	DframeBuf *DframeBuffer
 	Accel     Acceleration
 	Device    string
-	DecHandle *C.struct_transcode_thread
-	// Ictx *C.struct_input_ctx
-	Dmeta  *C.struct_decode_meta
-	Pixels int64
+	DecHandle *DecoderHandle
+	Pixels    int64
 }
 
 type TranscodeOptions struct {
-	Oname   string
+	Oname string
+	// Optional destination for the output, written once the segment has
+	// been fully encoded. Oname is then only used as a hint for the muxer.
+	Writer  io.Writer `json:"-"`
 	Profile VideoProfile
 	Accel   Acceleration
 	Device  string
@@ -74,11 +107,39 @@ type TranscodeOptions struct {
 	Muxer        ComponentOptions
 	VideoEncoder ComponentOptions
 	AudioEncoder ComponentOptions
+	// Format of transcoded audio. Unused if audio is copied or dropped.
+	Audio AudioProfile
+	// Optional image composed onto the video, eg a watermark
+	Overlay *Overlay
+	// Custom video filters in ffmpeg filtergraph syntax, applied before and
+	// after scaling respectively, eg "yadif,crop=iw-16:ih-16" or "drawtext=..."
+	// Pre-filters always take software frames. Post-filters take frames on
+	// the GPU when encoding in hardware.
+	PreFilters  string
+	PostFilters string
 }
 
 type MediaInfo struct {
 	Frames int
 	Pixels int64
+
+	// Time spent in each stage. Decoding applies to the input; filtering,
+	// encoding (including opening the encoder) and muxing to the outputs.
+	DecodeTime time.Duration
+	FilterTime time.Duration
+	EncodeTime time.Duration
+	MuxTime    time.Duration
+}
+
+func mediaInfo(r *C.output_results) MediaInfo {
+	return MediaInfo{
+		Frames:     int(r.frames),
+		Pixels:     int64(r.pixels),
+		DecodeTime: time.Duration(r.decode_us) * time.Microsecond,
+		FilterTime: time.Duration(r.filter_us) * time.Microsecond,
+		EncodeTime: time.Duration(r.encode_us) * time.Microsecond,
+		MuxTime:    time.Duration(r.mux_us) * time.Microsecond,
+	}
 }
 
 type TranscodeResults struct {
@@ -87,28 +148,243 @@ type TranscodeResults struct {
 }
 
 type DecodeResults struct {
-	Decoded   MediaInfo
-	DframeBuf DframeBuffer
-	Ictx      *C.struct_input_ctx
-	DecHandle *C.struct_transcode_thread
-	Dmeta     *C.struct_decode_meta
+	Decoded MediaInfo
+	// Decoded frames of the segment. The caller holds one reference and
+	// should Release it once the buffer is no longer needed.
+	DframeBuf *DframeBuffer
+	DecHandle *DecoderHandle
+	// Bytes held by the decoded frames in host memory, and in hardware
+	// frames (eg, GPU memory) when decoding with acceleration.
+	HostBytes int64
+	HWBytes   int64
 }
 
 type Decoder struct {
+	// Incremented whenever the handle is replaced or stopped. Accessed
+	// atomically; kept first for alignment.
+	gen     uint64
 	handle  *C.struct_transcode_thread
 	stopped bool
-	started bool
 	mu      *sync.Mutex
+	pool    *dframePool
+}
+
+// DecoderHandle refers to the decoder state a segment was decoded with. It
+// becomes stale once the decoder is reset after a cancellation, or stopped.
+type DecoderHandle struct {
+	d   *Decoder
+	gen uint64
 }
 
+func (d *Decoder) currentHandle() *DecoderHandle {
+	return &DecoderHandle{d: d, gen: atomic.LoadUint64(&d.gen)}
+}
+
+// Stale reports whether the decoder state has gone away since the handle
+// was returned.
+func (h *DecoderHandle) Stale() bool {
+	return atomic.LoadUint64(&h.d.gen) != h.gen
+}
+
+// Replaces an interrupted handle, invalidating any DecoderHandles.
+// Expects the lock to be held.
+func (d *Decoder) reset() {
+	resetHandle(&d.handle)
+	atomic.AddUint64(&d.gen, 1)
+}
+
+// DframeBuffer holds the decoded frames of a segment along with the decoder
+// state needed to encode them. Buffers are reference counted so one decoded
+// segment can be encoded by several Encoders; the frames are freed once the
+// last reference is released. A finalizer frees buffers that are dropped
+// without being released.
 type DframeBuffer struct {
-	Dframebuffer *C.dframe_buffer
+	mu    sync.Mutex
+	refs  int
+	buf   *C.dframe_buffer
+	dmeta *C.struct_decode_meta
+	pool  *dframePool
+}
+
+func newDframeBuffer(pool *dframePool) *DframeBuffer {
+	d := &DframeBuffer{
+		refs:  1,
+		buf:   pool.get(),
+		dmeta: C.alloc_decode_meta(),
+		pool:  pool,
+	}
+	runtime.SetFinalizer(d, (*DframeBuffer).free)
+	return d
+}
+
+// Retain adds a reference to the buffer. Every call should be paired with a
+// call to Release. Fails if the buffer has already been freed.
+func (d *DframeBuffer) Retain() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refs <= 0 {
+		return ErrTranscoderBuf
+	}
+	d.refs++
+	return nil
+}
+
+// Release drops a reference to the buffer, freeing it if none remain.
+func (d *DframeBuffer) Release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refs <= 0 {
+		return
+	}
+	d.refs--
+	if d.refs == 0 {
+		d.freeLocked()
+		runtime.SetFinalizer(d, nil)
+	}
+}
+
+func (d *DframeBuffer) free() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.freeLocked()
+}
+
+func (d *DframeBuffer) freeLocked() {
+	d.refs = 0
+	d.pool.put(d.buf)
+	C.free_decode_meta(d.dmeta)
+	d.buf = nil
+	d.dmeta = nil
+}
+
+// Frame is a decoded video picture. Where possible the planes point directly
+// into the decoded frame rather than a copy, so they must not be modified,
+// and are only valid until the function the Frame was passed to returns.
+type Frame struct {
+	Index       int           // position among the video frames of the segment
+	PTS         int64         // in the time base of the input video stream
+	Timestamp   time.Duration // PTS in units of time
+	Width       int
+	Height      int
+	PixelFormat string // eg, "yuv420p"; hardware frames are downloaded
+	Planes      [][]byte
+	Strides     []int
+}
+
+// VideoFrames calls fn with each decoded video frame in the buffer, in order.
+// Iteration stops at the first error returned by fn, which is then returned.
+func (d *DframeBuffer) VideoFrames(fn func(f *Frame) error) error {
+	if err := d.Retain(); err != nil {
+		return err
+	}
+	defer d.Release()
+	if d.buf.cnt <= 0 {
+		return nil
+	}
+	vi := d.dmeta.vi
+	tb := d.dmeta.time_base
+	dframes := (*[1 << 30]C.dframemeta)(unsafe.Pointer(d.buf.dframes))[:d.buf.cnt:d.buf.cnt]
+	hostFrame := C.av_frame_alloc()
+	if hostFrame == nil {
+		return errors.New("Unable to allocate frame")
+	}
+	defer C.av_frame_free(&hostFrame)
+	idx := 0
+	for i := range dframes {
+		df := &dframes[i]
+		if df.has_frame == 0 || df.in_pkt.stream_index != vi {
+			continue
+		}
+		var sizes [C.AV_NUM_DATA_POINTERS]C.int
+		nbPlanes := int(C.map_host_frame(hostFrame, df.dec_frame, &sizes[0]))
+		if nbPlanes < 0 {
+			return ErrorMap[nbPlanes]
+		}
+		f := &Frame{
+			Index:       idx,
+			PTS:         int64(hostFrame.pts),
+			Width:       int(hostFrame.width),
+			Height:      int(hostFrame.height),
+			PixelFormat: C.GoString(C.av_get_pix_fmt_name(C.enum_AVPixelFormat(hostFrame.format))),
+			Planes:      make([][]byte, nbPlanes),
+			Strides:     make([]int, nbPlanes),
+		}
+		if tb.den != 0 {
+			us := C.av_rescale_q(hostFrame.pts, tb, C.AVRational{num: 1, den: 1000000})
+			f.Timestamp = time.Duration(us) * time.Microsecond
+		}
+		for p := 0; p < nbPlanes; p++ {
+			n := int(sizes[p])
+			f.Planes[p] = (*[1 << 30]byte)(unsafe.Pointer(hostFrame.data[p]))[:n:n]
+			f.Strides[p] = int(hostFrame.linesize[p])
+		}
+		err := fn(f)
+		C.av_frame_unref(hostFrame)
+		if err != nil {
+			return err
+		}
+		idx++
+	}
+	return nil
+}
+
+// Number of released frame buffers each decoder keeps around for reuse
+const dframePoolSize = 4
+
+// dframePool recycles frame buffers between the segments of a decode session
+// so the frame allocations can be reused. A nil pool allocates and frees
+// buffers directly.
+type dframePool struct {
+	mu      sync.Mutex
+	bufs    []*C.dframe_buffer
+	stopped bool
+}
+
+func (p *dframePool) get() *C.dframe_buffer {
+	if p == nil {
+		return C.alloc_dframe_buffer()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.bufs); n > 0 {
+		buf := p.bufs[n-1]
+		p.bufs = p.bufs[:n-1]
+		return buf
+	}
+	return C.alloc_dframe_buffer()
+}
+
+func (p *dframePool) put(buf *C.dframe_buffer) {
+	if buf == nil {
+		return
+	}
+	if p == nil {
+		C.free_dframe_buffer(buf)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped || len(p.bufs) >= dframePoolSize {
+		C.free_dframe_buffer(buf)
+		return
+	}
+	C.reset_dframe_buffer(buf)
+	p.bufs = append(p.bufs, buf)
+}
+
+func (p *dframePool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, buf := range p.bufs {
+		C.free_dframe_buffer(buf)
+	}
+	p.bufs = nil
+	p.stopped = true
 }
 
 type Encoder struct {
 	handle  *C.struct_transcode_thread
 	stopped bool
-	started bool
 	mu      *sync.Mutex
 }
 
@@ -162,34 +438,301 @@ func newAVOpts(opts map[string]string) *C.AVDictionary {
 	return dict
 }
 
+// Video encoders for each acceleration and codec. SVT-AV1 isn't offered for
+// AV1 since the FFmpeg this is built against predates its wrapper.
+var VideoEncoders = map[Acceleration]map[VideoCodec]string{
+	Software: {
+		H264: "libx264",
+		H265: "libx265",
+		VP9:  "libvpx-vp9",
+		AV1:  "libaom-av1",
+	},
+	Nvidia: {
+		H264: "h264_nvenc",
+		H265: "hevc_nvenc",
+	},
+}
+
 // return encoding specific options for the given accel
-func configAccel(inAcc, outAcc Acceleration, inDev, outDev string) (string, string, error) {
+func configAccel(inAcc, outAcc Acceleration, codec VideoCodec, inDev, outDev string) (string, string, error) {
+	var filter string
 	switch inAcc {
 	case Software:
 		switch outAcc {
 		case Software:
-			return "libx264", "scale", nil
+			filter = "scale"
 		case Nvidia:
 			upload := "hwupload_cuda"
 			if outDev != "" {
 				upload = upload + "=device=" + outDev
 			}
-			return "h264_nvenc", upload + ",scale_cuda", nil
+			filter = upload + ",scale_cuda"
 		}
 	case Nvidia:
 		switch outAcc {
 		case Software:
-			return "libx264", "scale_cuda", nil
+			filter = "scale_cuda"
 		case Nvidia:
 			// If we encode on a different device from decode then need to transfer
 			if outDev != "" && outDev != inDev {
 				return "", "", ErrTranscoderInp // XXX not allowed
 			}
-			return "h264_nvenc", "scale_cuda", nil
+			filter = "scale_cuda"
+		}
+	}
+	if filter == "" {
+		return "", "", ErrTranscoderHw
+	}
+	encoder, ok := VideoEncoders[outAcc][codec]
+	if !ok {
+		return "", "", ErrTranscoderVcd
+	}
+	return encoder, filter, nil
+}
+
+// aspectFilters returns the filter scaling the video for a w x h output, and
+// any filters that then fit it to the output according to the profile's
+// aspect mode. The latter only take software frames.
+func aspectFilters(scale_filter string, p VideoProfile, w, h int) (string, string, error) {
+	if p.AspectMode == AspectKeep {
+		// preserve aspect ratio along the larger dimension when rescaling
+		return fmt.Sprintf("%s='w=if(gte(iw,ih),%d,-2):h=if(lt(iw,ih),%d,-2)'", scale_filter, w, h), "", nil
+	}
+	sn, sd, err := sampleAspect(p, w, h)
+	if err != nil {
+		return "", "", err
+	}
+	setsar := fmt.Sprintf("setsar=%d/%d", sn, sd)
+	// Sizes are in output pixels, which display at sn/sd. The source is
+	// wider than the output if its display aspect ratio is greater.
+	wider := fmt.Sprintf("gt(dar*%d*%d,%d*%d)", sd, h, sn, w)
+	width := fmt.Sprintf("%d*dar*%d/%d", h, sd, sn)
+	height := fmt.Sprintf("%d*%d/(dar*%d)", w, sn, sd)
+	switch p.AspectMode {
+	case AspectStretch:
+		return fmt.Sprintf("%s=w=%d:h=%d,%s", scale_filter, w, h, setsar), "", nil
+	case AspectPad:
+		scale := fmt.Sprintf("%s='w=if(%s,%d,2*trunc(%s/2)):h=if(%s,2*trunc(%s/2),%d)'",
+			scale_filter, wider, w, width, wider, height, h)
+		return scale, fmt.Sprintf("pad=%d:%d:(ow-iw)/2:(oh-ih)/2,%s", w, h, setsar), nil
+	case AspectCrop:
+		scale := fmt.Sprintf("%s='w=if(%s,2*ceil(%s/2),%d):h=if(%s,%d,2*ceil(%s/2))'",
+			scale_filter, wider, width, w, wider, h, height)
+		return scale, fmt.Sprintf("crop=%d:%d,%s", w, h, setsar), nil
+	}
+	return "", "", ErrTranscoderAsp
+}
+
+// return the default options for the encoder, including the profile and level
+func configEncoder(encoder string, p VideoProfile) (map[string]string, error) {
+	opts := map[string]string{}
+	switch encoder {
+	case "libx264", "h264_nvenc", "libx265", "hevc_nvenc":
+		opts["forced-idr"] = "1"
+	}
+	if p.Profile != ProfileNone {
+		codec, ok := ProfileCodecs[p.Profile]
+		if !ok || codec != p.Encoder {
+			return nil, ErrTranscoderPrf
+		}
+		opts["profile"] = ProfileParameters[p.Profile]
+		if p.Profile == ProfileH264ConstrainedHigh {
+			opts["bf"] = "0"
+		}
+	}
+	if p.Level != "" {
+		switch encoder {
+		case "libx265":
+			opts["x265-params"] = "level-idc=" + p.Level
+		case "libaom-av1", "libvpx-vp9":
+			// Level is derived from the stream parameters; libvpx would
+			// silently ignore the option
+			return nil, ErrTranscoderPrf
+		default:
+			opts["level"] = p.Level
+		}
+	}
+	return opts, nil
+}
+
+// Encoder options for each preset, from fastest to slowest
+var encoderPresets = map[string]map[Preset]map[string]string{
+	"libx264": {
+		PresetFastest: {"preset": "ultrafast"},
+		PresetFast:    {"preset": "veryfast"},
+		PresetMedium:  {"preset": "medium"},
+		PresetSlow:    {"preset": "slow"},
+		PresetSlowest: {"preset": "veryslow"},
+	},
+	"libx265": {
+		PresetFastest: {"preset": "ultrafast"},
+		PresetFast:    {"preset": "veryfast"},
+		PresetMedium:  {"preset": "medium"},
+		PresetSlow:    {"preset": "slow"},
+		PresetSlowest: {"preset": "veryslow"},
+	},
+	"h264_nvenc": {
+		PresetFastest: {"preset": "hp"},
+		PresetFast:    {"preset": "fast"},
+		PresetMedium:  {"preset": "medium"},
+		PresetSlow:    {"preset": "hq"},
+		PresetSlowest: {"preset": "slow"},
+	},
+	"hevc_nvenc": {
+		PresetFastest: {"preset": "hp"},
+		PresetFast:    {"preset": "fast"},
+		PresetMedium:  {"preset": "medium"},
+		PresetSlow:    {"preset": "hq"},
+		PresetSlowest: {"preset": "slow"},
+	},
+	"libvpx-vp9": {
+		PresetFastest: {"deadline": "realtime", "cpu-used": "8"},
+		PresetFast:    {"deadline": "good", "cpu-used": "4"},
+		PresetMedium:  {"deadline": "good", "cpu-used": "2"},
+		PresetSlow:    {"deadline": "good", "cpu-used": "1"},
+		PresetSlowest: {"deadline": "good", "cpu-used": "0"},
+	},
+	"libaom-av1": {
+		PresetFastest: {"cpu-used": "8"},
+		PresetFast:    {"cpu-used": "6"},
+		PresetMedium:  {"cpu-used": "4"},
+		PresetSlow:    {"cpu-used": "2"},
+		PresetSlowest: {"cpu-used": "0"},
+	},
+}
+
+// Encoder options for each tune. Encoders lacking a tune don't list it.
+var encoderTunes = map[string]map[Tune]map[string]string{
+	"libx264": {
+		TuneZeroLatency: {"tune": "zerolatency"},
+		TuneFilm:        {"tune": "film"},
+		TuneAnimation:   {"tune": "animation"},
+	},
+	"libx265": {
+		TuneZeroLatency: {"tune": "zerolatency"},
+		TuneAnimation:   {"tune": "animation"},
+	},
+	"h264_nvenc": {
+		TuneZeroLatency: {"zerolatency": "1", "delay": "0"},
+	},
+	"hevc_nvenc": {
+		TuneZeroLatency: {"zerolatency": "1", "delay": "0"},
+	},
+	"libvpx-vp9": {
+		TuneZeroLatency: {"lag-in-frames": "0"},
+		TuneFilm:        {"tune-content": "film"},
+	},
+	"libaom-av1": {
+		TuneZeroLatency: {"lag-in-frames": "0"},
+	},
+}
+
+// return the encoder options for the profile's preset and tune
+func configPreset(encoder string, p VideoProfile) (map[string]string, error) {
+	opts := map[string]string{}
+	if p.Preset != PresetDefault {
+		preset, ok := encoderPresets[encoder][p.Preset]
+		if !ok {
+			return nil, ErrTranscoderTun
+		}
+		for k, v := range preset {
+			opts[k] = v
+		}
+	}
+	if p.Tune != TuneNone {
+		tune, ok := encoderTunes[encoder][p.Tune]
+		if !ok {
+			return nil, ErrTranscoderTun
+		}
+		for k, v := range tune {
+			opts[k] = v
+		}
+	}
+	return opts, nil
+}
+
+// return the encoder options for the profile's rate control, or nothing if
+// the profile leaves it to the defaults
+func configRateControl(encoder string, p VideoProfile) (map[string]string, error) {
+	rc := p.RateControl
+	if rc.Mode == RateControlDefault {
+		return nil, nil
+	}
+	nvenc := encoder == "h264_nvenc" || encoder == "hevc_nvenc"
+	opts := map[string]string{}
+	var bitrate, maxrate int
+	var err error
+	if rc.Mode != RateControlCRF {
+		bitrate, err = parseBitrate(p.Bitrate)
+		if err != nil || bitrate <= 0 {
+			return nil, ErrTranscoderRC
+		}
+		opts["b"] = strconv.Itoa(bitrate)
+	}
+	if rc.MaxBitrate != "" {
+		maxrate, err = parseBitrate(rc.MaxBitrate)
+		if err != nil || maxrate <= 0 || maxrate < bitrate {
+			return nil, ErrTranscoderRC
+		}
+	}
+	switch rc.Mode {
+	case RateControlCBR:
+		maxrate = bitrate
+		opts["minrate"] = opts["b"]
+		if encoder == "libx264" {
+			opts["nal-hrd"] = "cbr"
+		} else if nvenc {
+			opts["rc"] = "cbr"
+		}
+	case RateControlVBR:
+		if maxrate <= 0 {
+			return nil, ErrTranscoderRC
+		}
+		if encoder == "libx264" {
+			opts["nal-hrd"] = "vbr"
+		} else if nvenc {
+			opts["rc"] = "vbr"
+		}
+	case RateControlCRF:
+		maxQuality := 51
+		if encoder == "libvpx-vp9" || encoder == "libaom-av1" {
+			maxQuality = 63
+		}
+		if rc.Quality < 1 || rc.Quality > maxQuality {
+			return nil, ErrTranscoderRC
+		}
+		quality := strconv.Itoa(rc.Quality)
+		switch {
+		case encoder == "libx264" || encoder == "libx265":
+			opts["crf"] = quality
+		case encoder == "libvpx-vp9" || encoder == "libaom-av1":
+			// a zero target bitrate selects constant quality
+			opts["crf"] = quality
+			opts["b"] = "0"
+		case nvenc:
+			opts["rc"] = "vbr"
+			opts["cq"] = quality
+			opts["b"] = "0"
+		default:
+			return nil, ErrTranscoderRC
+		}
+	default:
+		return nil, ErrTranscoderRC
+	}
+	if maxrate > 0 {
+		bufsize := maxrate
+		if rc.BufferSize != "" {
+			bufsize, err = parseBitrate(rc.BufferSize)
+			if err != nil || bufsize <= 0 {
+				return nil, ErrTranscoderRC
+			}
 		}
+		opts["maxrate"] = strconv.Itoa(maxrate)
+		opts["bufsize"] = strconv.Itoa(bufsize)
 	}
-	return "", "", ErrTranscoderHw
+	return opts, nil
 }
+
 func accelDeviceType(accel Acceleration) (C.enum_AVHWDeviceType, error) {
 	switch accel {
 	case Software:
@@ -212,63 +755,188 @@ func Transcode3(input *TranscodeOptionsIn, ps []TranscodeOptions) (*TranscodeRes
 	return t.Transcode(input, ps)
 }
 
-func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions) (*TranscodeResults, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	if t.stopped || t.handle == nil {
-		return nil, ErrTranscoderStp
+// bufferInput reads a Reader input in full into Data, so that the input may
+// be opened more than once.
+func bufferInput(input *TranscodeOptionsIn) error {
+	if input.Data != nil || input.Reader == nil {
+		return nil
 	}
-	if input == nil {
-		return nil, ErrTranscoderInp
+	data, err := ioutil.ReadAll(input.Reader)
+	if err != nil {
+		return err
+	}
+	input.Data = data
+	return nil
+}
+
+// validTrim checks that the in and out points of the input are consistent.
+func validTrim(input *TranscodeOptionsIn) bool {
+	if input.InTime < 0 || input.OutTime < 0 || input.InFrame < 0 || input.OutFrame < 0 {
+		return false
+	}
+	// Each point is a time or a frame
+	if (input.InTime != 0 && input.InFrame != 0) || (input.OutTime != 0 && input.OutFrame != 0) {
+		return false
+	}
+	if input.OutTime != 0 && input.OutTime <= input.InTime {
+		return false
 	}
+	if input.OutFrame != 0 && input.OutFrame <= input.InFrame {
+		return false
+	}
+	return true
+}
+
+// inputParams converts the input options into C input params, along with a
+// function to free them. In-memory input is copied so the C side may hold
+// on to it until the function is called.
+func inputParams(input *TranscodeOptionsIn) (*C.input_params, func(), error) {
 	hw_type, err := accelDeviceType(input.Accel)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	fname := C.CString(input.Fname)
-	defer C.free(unsafe.Pointer(fname))
-	if !t.started {
-		ret := int(C.lpms_is_bypass_needed(fname))
-		if ret != 1 {
-			// Stream is either OK or completely broken, let the transcoder handle it
-			t.started = true
-		} else {
-			// Audio-only segment, fail fast right here as we cannot handle them nicely
-			return nil, errors.New("No video parameters found while initializing stream")
+	data := input.Data
+	if data == nil && input.Reader != nil {
+		data, err = ioutil.ReadAll(input.Reader)
+		if err != nil {
+			return nil, nil, err
 		}
 	}
+	if data != nil && len(data) == 0 {
+		return nil, nil, ErrTranscoderInp
+	}
+	if !validTrim(input) {
+		return nil, nil, ErrTranscoderTrm
+	}
+	inp := &C.input_params{fname: C.CString(input.Fname), hw_type: hw_type,
+		max_frames:    C.int(input.MaxFrames),
+		trim_in_us:    C.int64_t(input.InTime.Microseconds()),
+		trim_out_us:   C.int64_t(input.OutTime.Microseconds()),
+		trim_in_frame: C.int(input.InFrame), trim_out_frame: C.int(input.OutFrame)}
+	if data != nil {
+		inp.data = (*C.uint8_t)(C.CBytes(data))
+		inp.data_size = C.int64_t(len(data))
+	}
+	if input.Device != "" {
+		inp.device = C.CString(input.Device)
+	}
+	free := func() {
+		C.free(unsafe.Pointer(inp.fname))
+		C.free(unsafe.Pointer(inp.data))
+		C.free(unsafe.Pointer(inp.device))
+	}
+	return inp, free, nil
+}
+
+// outputParams converts the transcode options into C output params. The
+// returned function frees the params and must be called once they are no
+// longer in use.
+func outputParams(inAccel Acceleration, inDevice string, ps []TranscodeOptions) ([]C.output_params, func(), error) {
 	params := make([]C.output_params, len(ps))
+	cstrs := []*C.char{}
+	cstr := func(s string) *C.char {
+		c := C.CString(s)
+		cstrs = append(cstrs, c)
+		return c
+	}
+	tmpFiles := []string{}
+	free := func() {
+		for _, c := range cstrs {
+			C.free(unsafe.Pointer(c))
+		}
+		for _, f := range tmpFiles {
+			os.Remove(f)
+		}
+		for i := range params {
+			// Work around the ownership rules:
+			// ffmpeg normally takes ownership of the following AVDictionary options
+			// However, if we don't pass these opts to ffmpeg, then we need to free
+			param := &params[i]
+			if param.muxer.opts != nil {
+				C.av_dict_free(&param.muxer.opts)
+			}
+			if param.audio.opts != nil {
+				C.av_dict_free(&param.audio.opts)
+			}
+			if param.video.opts != nil {
+				C.av_dict_free(&param.video.opts)
+			}
+		}
+	}
 	for i, p := range ps {
-		oname := C.CString(p.Oname)
-		defer C.free(unsafe.Pointer(oname))
+		oname := cstr(p.Oname)
 
 		param := p.Profile
 		w, h, err := VideoProfileResolution(param)
 		if err != nil {
 			if "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name {
-				return nil, err
+				free()
+				return nil, nil, err
 			}
 		}
-		br := strings.Replace(param.Bitrate, "k", "000", 1)
-		bitrate, err := strconv.Atoi(br)
+		bitrate, err := parseBitrate(param.Bitrate)
 		if err != nil {
-			if "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name {
-				return nil, err
+			// constant quality has no use for a bitrate
+			crf := param.RateControl.Mode == RateControlCRF && param.Bitrate == ""
+			if "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name && !crf {
+				free()
+				return nil, nil, err
 			}
 		}
 		encoder, scale_filter := p.VideoEncoder.Name, "scale"
 		if encoder == "" {
-			encoder, scale_filter, err = configAccel(input.Accel, p.Accel, input.Device, p.Device)
+			encoder, scale_filter, err = configAccel(inAccel, p.Accel, param.Encoder, inDevice, p.Device)
 			if err != nil {
-				return nil, err
+				free()
+				return nil, nil, err
 			}
 		}
-		// preserve aspect ratio along the larger dimension when rescaling
-		var filters string
-		filters = fmt.Sprintf("%s='w=if(gte(iw,ih),%d,-2):h=if(lt(iw,ih),%d,-2)'", scale_filter, w, h)
-		if input.Accel != Software && p.Accel == Software {
+		filters, fitFilters, err := aspectFilters(scale_filter, param, w, h)
+		if err != nil {
+			if "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name {
+				free()
+				return nil, nil, err
+			}
+		}
+		if p.PreFilters != "" {
+			pre := p.PreFilters
+			if inAccel != Software {
+				// hardware decoded frames are on the GPU, so give the custom
+				// filters software frames and upload them again for scaling
+				reupload := "hwupload_cuda"
+				if inDevice != "" {
+					reupload += "=device=" + inDevice
+				}
+				pre = "hwdownload,format=nv12," + pre + "," + reupload
+			}
+			filters = pre + "," + filters
+		}
+		if inAccel != Software && p.Accel == Software {
 			// needed for hw dec -> hw rescale -> sw enc
 			filters = filters + ",hwdownload,format=nv12"
+			if encoder != "libx264" {
+				// other software encoders don't take nv12
+				filters = filters + ",format=yuv420p"
+			}
+		}
+		// Frames are still on the GPU if the encoder is there too, so filters
+		// that only take software frames need a round trip
+		upload := ""
+		if p.Accel == Nvidia && scale_filter != "scale" {
+			upload = "hwupload_cuda"
+			if device := p.Device; device != "" || inDevice != "" {
+				if device == "" {
+					device = inDevice
+				}
+				upload += "=device=" + device
+			}
+		}
+		if fitFilters != "" {
+			if upload != "" {
+				filters += ",hwdownload,format=nv12," + fitFilters + "," + upload
+			} else {
+				filters += "," + fitFilters
+			}
 		}
 		// set FPS denominator to 1 if unset by user
 		if param.FramerateDen == 0 {
@@ -288,6 +956,24 @@ func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions)
 			filters += fmt.Sprintf(",fps=%d/%d", param.Framerate, param.FramerateDen)
 			fps = C.AVRational{num: C.int(param.Framerate), den: C.int(param.FramerateDen)}
 		}
+		if p.PostFilters != "" {
+			filters += "," + p.PostFilters
+		}
+		if p.Overlay != nil && "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name {
+			img, tmp, err := overlayImage(p.Overlay)
+			if tmp != "" {
+				tmpFiles = append(tmpFiles, tmp)
+			}
+			if err != nil {
+				free()
+				return nil, nil, err
+			}
+			filters, err = overlayFilters(filters, p.Overlay, img, upload)
+			if err != nil {
+				free()
+				return nil, nil, err
+			}
+		}
 		var muxOpts C.component_opts
 		var muxName string
 		switch p.Profile.Format {
@@ -305,33 +991,59 @@ func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions)
 				opts: newAVOpts(map[string]string{"movflags": "faststart"}),
 			}
 		default:
-			return nil, ErrTranscoderFmt
+			free()
+			return nil, nil, ErrTranscoderFmt
 		}
 		if muxName != "" {
-			muxOpts.name = C.CString(muxName)
-			defer C.free(unsafe.Pointer(muxOpts.name))
+			muxOpts.name = cstr(muxName)
+		}
+		if len(p.VideoEncoder.Name) <= 0 {
+			// Check the muxer can carry the selected codec
+			mux := muxName
+			if mux == "" && ExtensionFormats[path.Ext(p.Oname)] == FormatMPEGTS {
+				mux = "mpegts"
+			}
+			if !muxerSupportsCodec(mux, param.Encoder) {
+				free()
+				return nil, nil, ErrTranscoderMux
+			}
 		}
-		// Set video encoder options
-		if len(p.VideoEncoder.Name) <= 0 && len(p.VideoEncoder.Opts) <= 0 {
-			p.VideoEncoder.Opts = map[string]string{
-				"forced-idr": "1",
+		// Set video encoder options. Defaults only apply to encoders selected
+		// by the profile, and the caller's options take precedence over
+		// anything derived from the profile.
+		vopts := map[string]string{}
+		if "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name {
+			configs := []func(string, VideoProfile) (map[string]string, error){
+				configPreset, configRateControl}
+			if len(p.VideoEncoder.Name) <= 0 {
+				configs = append(configs, configEncoder)
+			}
+			for _, config := range configs {
+				opts, err := config(encoder, param)
+				if err != nil {
+					free()
+					return nil, nil, err
+				}
+				for k, v := range opts {
+					vopts[k] = v
+				}
 			}
-			switch p.Profile.Profile {
-			case ProfileH264Baseline, ProfileH264Main, ProfileH264High:
-				p.VideoEncoder.Opts["profile"] = ProfileParameters[p.Profile.Profile]
-			case ProfileH264ConstrainedHigh:
-				p.VideoEncoder.Opts["profile"] = ProfileParameters[p.Profile.Profile]
-				p.VideoEncoder.Opts["bf"] = "0"
-			case ProfileNone:
-				// Do nothing, the encoder will use default profile
-			default:
-				return nil, ErrTranscoderPrf
+			if param.RateControl.Mode != RateControlDefault {
+				// Otherwise the encoder is set up for the default rate control.
+				// The rates are in the encoder options, so outputs with
+				// different rates don't share a hardware session.
+				bitrate = 0
 			}
 		}
+		for k, v := range p.VideoEncoder.Opts {
+			vopts[k] = v
+		}
+		p.VideoEncoder.Opts = vopts
 		gopMs := 0
 		if param.GOP != 0 {
 			if param.GOP <= GOPInvalid {
-				return nil, ErrTranscoderGOP
+				free()
+				return nil, nil, ErrTranscoderGOP
 			}
 			// Check for intra-only
 			if param.GOP == GOPIntraOnly {
@@ -351,77 +1063,115 @@ func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions)
 			p.VideoEncoder.Opts["max_height"] = "1080"
 		}
 		vidOpts := C.component_opts{
-			name: C.CString(encoder),
+			name: cstr(encoder),
 			opts: newAVOpts(p.VideoEncoder.Opts),
 		}
 		audioEncoder := p.AudioEncoder.Name
 		if audioEncoder == "" {
 			audioEncoder = "aac"
 		}
+		afilters, err := audioFilters(p.Audio)
+		if err != nil {
+			free()
+			return nil, nil, err
+		}
+		audioBr, err := audioBitrate(p.Audio)
+		if err != nil {
+			free()
+			return nil, nil, err
+		}
+		audioEncOpts := p.AudioEncoder.Opts
+		if _, ok := audioEncOpts["b"]; audioBr > 0 && !ok {
+			// copy rather than modify the caller's options
+			audioEncOpts = map[string]string{"b": strconv.Itoa(audioBr)}
+			for k, v := range p.AudioEncoder.Opts {
+				audioEncOpts[k] = v
+			}
+		}
 		audioOpts := C.component_opts{
-			name: C.CString(audioEncoder),
-			opts: newAVOpts(p.AudioEncoder.Opts),
+			name: cstr(audioEncoder),
+			opts: newAVOpts(audioEncOpts),
 		}
-		vfilt := C.CString(filters)
-		defer C.free(unsafe.Pointer(vidOpts.name))
-		defer C.free(unsafe.Pointer(audioOpts.name))
-		defer C.free(unsafe.Pointer(vfilt))
+		vfilt := cstr(filters)
 		params[i] = C.output_params{fname: oname, fps: fps,
 			w: C.int(w), h: C.int(h), bitrate: C.int(bitrate),
 			gop_time: C.int(gopMs),
-			muxer:    muxOpts, audio: audioOpts, video: vidOpts, vfilters: vfilt}
-		defer func(param *C.output_params) {
-			// Work around the ownership rules:
-			// ffmpeg normally takes ownership of the following AVDictionary options
-			// However, if we don't pass these opts to ffmpeg, then we need to free
-			if param.muxer.opts != nil {
-				C.av_dict_free(&param.muxer.opts)
-			}
-			if param.audio.opts != nil {
-				C.av_dict_free(&param.audio.opts)
-			}
-			if param.video.opts != nil {
-				C.av_dict_free(&param.video.opts)
-			}
-		}(&params[i])
+			muxer:    muxOpts, audio: audioOpts, video: vidOpts, vfilters: vfilt,
+			afilters: cstr(afilters)}
+		if p.Writer != nil {
+			params[i].to_memory = 1
+		}
 	}
-	var device *C.char
-	if input.Device != "" {
-		device = C.CString(input.Device)
-		defer C.free(unsafe.Pointer(device))
+	return params, free, nil
+}
+
+// writeOutputs hands the outputs that were written to memory over to their
+// writers, then frees them. Nothing is written unless the segment succeeded.
+func writeOutputs(ps []TranscodeOptions, results []C.output_results, ok bool) error {
+	var err error
+	for i := range results {
+		r := &results[i]
+		if r.data == nil {
+			continue
+		}
+		if ok && err == nil && ps[i].Writer != nil {
+			data := (*[1 << 30]byte)(unsafe.Pointer(r.data))[:r.data_size:r.data_size]
+			_, err = ps[i].Writer.Write(data)
+		}
+		C.av_free(unsafe.Pointer(r.data))
+		r.data = nil
 	}
-	inp := &C.input_params{fname: fname, hw_type: hw_type, device: device,
-		handle: t.handle}
-	results := make([]C.output_results, len(ps))
-	decoded := &C.output_results{}
-	var (
-		paramsPointer  *C.output_params
-		resultsPointer *C.output_results
-	)
-	if len(params) > 0 {
-		paramsPointer = (*C.output_params)(&params[0])
-		resultsPointer = (*C.output_results)(&results[0])
+	return err
+}
+
+// outputError returns the error for ret, along with any details reported by
+// the outputs, eg which filters couldn't be set up.
+func outputError(ret int, results []C.output_results) error {
+	for i := range results {
+		if results[i].err[0] != 0 {
+			return &OutputError{Err: ErrorMap[ret], Detail: C.GoString(&results[i].err[0])}
+		}
 	}
-	ret := int(C.lpms_transcode(inp, paramsPointer, resultsPointer, C.int(len(params)), decoded))
-	if 0 != ret {
-		glog.Error("Transcoder Return : ", ErrorMap[ret])
-		return nil, ErrorMap[ret]
+	return ErrorMap[ret]
+}
+
+// interruptOnDone aborts the call in progress on the handle once the context
+// is done. The returned function must be called after the call returns.
+func interruptOnDone(ctx context.Context, h *C.struct_transcode_thread) func() {
+	if ctx.Done() == nil {
+		return func() {}
 	}
-	tr := make([]MediaInfo, len(ps))
-	for i, r := range results {
-		tr[i] = MediaInfo{
-			Frames: int(r.frames),
-			Pixels: int64(r.pixels),
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			C.lpms_transcode_interrupt(h, 1)
+		case <-stop:
 		}
+		close(stopped)
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		C.lpms_transcode_interrupt(h, 0)
 	}
-	dec := MediaInfo{
-		Frames: int(decoded.frames),
-		Pixels: int64(decoded.pixels),
-	}
-	return &TranscodeResults{Encoded: tr, Decoded: dec}, nil
 }
 
-func (t *Decoder) Decode(input *TranscodeOptionsIn) (*DecodeResults, error) {
+// Replaces an interrupted handle, which may have been left mid-segment.
+func resetHandle(h **C.struct_transcode_thread) {
+	C.lpms_transcode_stop(*h)
+	*h = C.lpms_transcode_new()
+}
+
+func (t *Transcoder) Transcode(input *TranscodeOptionsIn, ps []TranscodeOptions) (*TranscodeResults, error) {
+	return t.TranscodeContext(context.Background(), input, ps)
+}
+
+// TranscodeContext is like Transcode, but aborts if the context is done
+// before the segment has been transcoded. The transcoder is then reset to
+// its initial state and the context's error is returned.
+func (t *Transcoder) TranscodeContext(ctx context.Context, input *TranscodeOptionsIn, ps []TranscodeOptions) (*TranscodeResults, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if t.stopped || t.handle == nil {
@@ -430,48 +1180,257 @@ func (t *Decoder) Decode(input *TranscodeOptionsIn) (*DecodeResults, error) {
 	if input == nil {
 		return nil, ErrTranscoderInp
 	}
-	hw_type, err := accelDeviceType(input.Accel)
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	fname := C.CString(input.Fname)
-	defer C.free(unsafe.Pointer(fname))
-	if !t.started {
-		ret := int(C.lpms_is_bypass_needed(fname))
-		if ret != 1 {
-			// Stream is either OK or completely broken, let the transcoder handle it
-			t.started = true
-		} else {
-			// Audio-only segment, fail fast right here as we cannot handle them nicely
-			return nil, errors.New("No video parameters found while initializing stream")
+	inp, freeInput, err := inputParams(input)
+	if err != nil {
+		return nil, err
+	}
+	defer freeInput()
+	params, freeParams, err := outputParams(input.Accel, input.Device, ps)
+	if err != nil {
+		return nil, err
+	}
+	defer freeParams()
+	inp.handle = t.handle
+	stopInterrupt := interruptOnDone(ctx, t.handle)
+	results := make([]C.output_results, len(ps))
+	decoded := &C.output_results{}
+	var (
+		paramsPointer  *C.output_params
+		resultsPointer *C.output_results
+	)
+	if len(params) > 0 {
+		paramsPointer = (*C.output_params)(&params[0])
+		resultsPointer = (*C.output_results)(&results[0])
+	}
+	ret := int(C.lpms_transcode(inp, paramsPointer, resultsPointer, C.int(len(params)), decoded))
+	stopInterrupt()
+	err = writeOutputs(ps, results, 0 == ret)
+	if 0 != ret {
+		if ctx.Err() != nil {
+			resetHandle(&t.handle)
+			return nil, ctx.Err()
 		}
+		err := outputError(ret, results)
+		glog.Error("Transcoder Return : ", err)
+		return nil, err
 	}
-	var device *C.char
-	if input.Device != "" {
-		device = C.CString(input.Device)
-		defer C.free(unsafe.Pointer(device))
+	if err != nil {
+		return nil, err
 	}
-	inp := &C.input_params{fname: fname, hw_type: hw_type, device: device,
-		dec_handle: t.handle}
+	tr := make([]MediaInfo, len(ps))
+	for i := range results {
+		tr[i] = mediaInfo(&results[i])
+	}
+	dec := mediaInfo(decoded)
+	return &TranscodeResults{Encoded: tr, Decoded: dec}, nil
+}
+
+func (t *Decoder) Decode(input *TranscodeOptionsIn) (*DecodeResults, error) {
+	return t.DecodeContext(context.Background(), input)
+}
+
+// DecodeContext is like Decode, but aborts if the context is done before
+// the segment has been decoded. The decoder is then reset to its initial
+// state and the context's error is returned.
+func (t *Decoder) DecodeContext(ctx context.Context, input *TranscodeOptionsIn) (*DecodeResults, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped || t.handle == nil {
+		return nil, ErrTranscoderStp
+	}
+	if input == nil {
+		return nil, ErrTranscoderInp
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	inp, freeInput, err := inputParams(input)
+	if err != nil {
+		return nil, err
+	}
+	defer freeInput()
+	inp.dec_handle = t.handle
+	stopInterrupt := interruptOnDone(ctx, t.handle)
 
 	// results := make([]C.output_results, len(ps))
 	decoded := &C.output_results{}
-	dframe_buffer := &C.dframe_buffer{}
+	buf := newDframeBuffer(t.pool)
 
-	ictx := &C.struct_input_ctx{}
-	// decode_meta := C.alloc_decode_meta()
-	decode_meta := &C.struct_decode_meta{}
-	ret := int(C.lpms_decode(inp, decoded, dframe_buffer, ictx, decode_meta))
+	ret := int(C.lpms_decode(inp, decoded, buf.buf, buf.dmeta))
+	stopInterrupt()
 	if 0 != ret {
+		buf.Release()
+		if ctx.Err() != nil {
+			t.reset()
+			return nil, ctx.Err()
+		}
 		glog.Error("Transcoder Return : ", ErrorMap[ret])
 		return nil, ErrorMap[ret]
 	}
 
-	dec := MediaInfo{
-		Frames: int(decoded.frames),
-		Pixels: int64(decoded.pixels),
+	var hostBytes, hwBytes C.int64_t
+	C.dframe_buffer_footprint(buf.buf, &hostBytes, &hwBytes)
+
+	dec := mediaInfo(decoded)
+	return &DecodeResults{Decoded: dec, DframeBuf: buf, DecHandle: t.currentHandle(),
+		HostBytes: int64(hostBytes), HWBytes: int64(hwBytes)}, nil
+}
+
+// Number of decoded frames a stream buffers ahead of its consumer
+const frameStreamSize = 16
+
+// DecodedFrame is a single frame of a segment, or a demuxed packet if the
+// stream was not decoded (eg, for stream copy).
+type DecodedFrame struct {
+	df *C.dframemeta
+}
+
+// Release frees the frame. Frames received from a FrameStream must be
+// released by whoever consumes them; EncodeStream does this automatically.
+func (f *DecodedFrame) Release() {
+	C.free_dframe(f.df)
+	f.df = nil
+}
+
+// FrameStream delivers the frames of a segment as they are decoded.
+// Frames is closed once the segment has been fully decoded, the context is
+// cancelled or decoding fails; Err reports which. The stream must be closed
+// once it is no longer needed.
+type FrameStream struct {
+	Frames <-chan *DecodedFrame
+
+	accel  Acceleration
+	device string
+	dmeta  *C.struct_decode_meta
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// only valid once done is closed
+	decoded MediaInfo
+	err     error
+}
+
+// Wait blocks until decoding has finished and returns the decode statistics.
+func (s *FrameStream) Wait() (MediaInfo, error) {
+	<-s.done
+	return s.decoded, s.err
+}
+
+// Close stops decoding if necessary and frees the stream along with any
+// frames that have not been consumed.
+func (s *FrameStream) Close() {
+	s.cancel()
+	for f := range s.Frames {
+		f.Release()
+	}
+	<-s.done
+	C.free_decode_meta(s.dmeta)
+	s.dmeta = nil
+}
+
+// DecodeStream decodes a segment frame by frame, making each frame available
+// to consumers as soon as it is decoded. The decoder is busy until the stream
+// has finished decoding. If the context is done or the stream is closed
+// before then, decoding is aborted and the decoder is reset to its initial
+// state.
+func (t *Decoder) DecodeStream(ctx context.Context, input *TranscodeOptionsIn) (*FrameStream, error) {
+	t.mu.Lock()
+	unlock := true
+	defer func() {
+		if unlock {
+			t.mu.Unlock()
+		}
+	}()
+	if t.stopped || t.handle == nil {
+		return nil, ErrTranscoderStp
+	}
+	if input == nil {
+		return nil, ErrTranscoderInp
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	inp, freeInput, err := inputParams(input)
+	if err != nil {
+		return nil, err
+	}
+	inp.dec_handle = t.handle
+	// Closing the stream interrupts decoding as well
+	ctx, cancel := context.WithCancel(ctx)
+	stopInterrupt := interruptOnDone(ctx, t.handle)
+	dmeta := C.alloc_decode_meta()
+	ret := int(C.lpms_decode_begin(inp, dmeta))
+	if 0 != ret {
+		stopInterrupt()
+		err := ctx.Err()
+		cancel()
+		C.free_decode_meta(dmeta)
+		freeInput()
+		if err != nil {
+			t.reset()
+			return nil, err
+		}
+		glog.Error("Transcoder Return : ", ErrorMap[ret])
+		return nil, ErrorMap[ret]
+	}
+
+	frames := make(chan *DecodedFrame, frameStreamSize)
+	s := &FrameStream{
+		Frames: frames,
+		accel:  input.Accel,
+		device: input.Device,
+		dmeta:  dmeta,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	unlock = false // handed off to the decode goroutine
+	go func() {
+		decoded := &C.output_results{}
+		s.err = t.decodeFrames(ctx, inp, decoded, frames)
+		C.lpms_decode_end(inp, s.dmeta)
+		stopInterrupt()
+		if s.err != nil && ctx.Err() != nil {
+			t.reset()
+			s.err = ctx.Err()
+		}
+		s.decoded = mediaInfo(decoded)
+		close(frames)
+		close(s.done)
+		freeInput()
+		t.mu.Unlock()
+	}()
+	return s, nil
+}
+
+func (t *Decoder) decodeFrames(ctx context.Context, inp *C.input_params, decoded *C.output_results, frames chan<- *DecodedFrame) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		df := C.alloc_dframe()
+		if df == nil {
+			return errors.New("Unable to allocate frame")
+		}
+		ret := int(C.lpms_decode_frame(inp, df, decoded))
+		if C.AVERROR_EOF == ret {
+			C.free_dframe(df)
+			return nil
+		} else if 0 != ret {
+			C.free_dframe(df)
+			glog.Error("Transcoder Return : ", ErrorMap[ret])
+			return ErrorMap[ret]
+		}
+		f := &DecodedFrame{df: df}
+		select {
+		case frames <- f:
+		case <-ctx.Done():
+			f.Release()
+			return ctx.Err()
+		}
 	}
-	return &DecodeResults{Decoded: dec, DframeBuf: DframeBuffer{Dframebuffer: dframe_buffer}, Ictx: ictx, DecHandle: t.handle, Dmeta: decode_meta}, nil
 }
 
 func NewTranscoder() *Transcoder {
@@ -503,6 +1462,7 @@ func NewDecoder() *Decoder {
 		// handle: C.lpms_decode_new(),
 		handle: C.lpms_transcode_new(),
 		mu:     &sync.Mutex{},
+		pool:   &dframePool{},
 	}
 }
 
@@ -514,8 +1474,10 @@ func (d *Decoder) StopDecoder() {
 	}
 	// C.lpms_decode_stop(d.handle)
 	C.lpms_transcode_stop(d.handle)
+	d.pool.close() // outstanding buffers are freed as they're released
 	d.handle = nil // prevent accidental reuse
 	d.stopped = true
+	atomic.AddUint64(&d.gen, 1)
 }
 
 func Encode(input *EncodeOptionsIn, ps []TranscodeOptions) (*TranscodeResults, error) {
@@ -542,182 +1504,68 @@ func (e *Encoder) StopEncoder() {
 	e.stopped = true
 }
 
+// Number of hardware encoder sessions held by the encoder
+func (e *Encoder) hwSessions() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stopped || e.handle == nil {
+		return 0
+	}
+	return int(C.lpms_hw_sessions(e.handle))
+}
+
 func (t *Encoder) Encode(input *EncodeOptionsIn, ps []TranscodeOptions) (*TranscodeResults, error) {
+	return t.EncodeContext(context.Background(), input, ps)
+}
+
+// EncodeContext is like Encode, but aborts if the context is done before
+// the segment has been encoded. The encoder is then reset to its initial
+// state and the context's error is returned.
+func (t *Encoder) EncodeContext(ctx context.Context, input *EncodeOptionsIn, ps []TranscodeOptions) (*TranscodeResults, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if t.stopped || t.handle == nil {
 		return nil, ErrTranscoderStp
 	}
-	if input == nil {
+	if input == nil || input.DframeBuf == nil {
 		return nil, ErrTranscoderInp
 	}
-	hw_type, err := accelDeviceType(input.Accel)
-	if err != nil {
+	if input.DecHandle != nil && input.DecHandle.Stale() {
+		return nil, ErrTranscoderStp
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Hold a reference for the duration of the encode in case the caller
+	// releases the buffer from elsewhere
+	buf := input.DframeBuf
+	if err := buf.Retain(); err != nil {
+		return nil, err
+	}
+	defer buf.Release()
+	if _, err := accelDeviceType(input.Accel); err != nil {
 		return nil, err
 	}
 	fname := C.CString(input.Fname)
 	defer C.free(unsafe.Pointer(fname))
-	if !t.started {
-		ret := int(C.lpms_is_bypass_needed(fname))
-		if ret != 1 {
-			// Stream is either OK or completely broken, let the transcoder handle it
-			t.started = true
-		} else {
-			// Audio-only segment, fail fast right here as we cannot handle them nicely
-			return nil, errors.New("No video parameters found while initializing stream")
-		}
-	}
-	params := make([]C.output_params, len(ps))
-	for i, p := range ps {
-		oname := C.CString(p.Oname)
-		defer C.free(unsafe.Pointer(oname))
+	return t.encode(ctx, fname, input.Accel, input.Device, buf, ps)
+}
 
-		param := p.Profile
-		w, h, err := VideoProfileResolution(param)
-		if err != nil {
-			if "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name {
-				return nil, err
-			}
-		}
-		br := strings.Replace(param.Bitrate, "k", "000", 1)
-		bitrate, err := strconv.Atoi(br)
-		if err != nil {
-			if "drop" != p.VideoEncoder.Name && "copy" != p.VideoEncoder.Name {
-				return nil, err
-			}
-		}
-		encoder, scale_filter := p.VideoEncoder.Name, "scale"
-		if encoder == "" {
-			encoder, scale_filter, err = configAccel(input.Accel, p.Accel, input.Device, p.Device)
-			if err != nil {
-				return nil, err
-			}
-		}
-		// preserve aspect ratio along the larger dimension when rescaling
-		var filters string
-		filters = fmt.Sprintf("%s='w=if(gte(iw,ih),%d,-2):h=if(lt(iw,ih),%d,-2)'", scale_filter, w, h)
-		if input.Accel != Software && p.Accel == Software {
-			// needed for hw dec -> hw rescale -> sw enc
-			filters = filters + ",hwdownload,format=nv12"
-		}
-		// set FPS denominator to 1 if unset by user
-		if param.FramerateDen == 0 {
-			param.FramerateDen = 1
-		}
-		// Add fps filter *after* scale filter because otherwise we could
-		// be scaling duplicate frames unnecessarily. This becomes a DoS vector
-		// when a user submits two frames that are "far apart" in pts and
-		// the fps filter duplicates frames to fill out the difference to maintain
-		// a consistent frame rate.
-		// Once we allow for alternating segments, this issue should be mitigated
-		// and the fps filter can come *before* the scale filter to minimize work
-		// when going from high fps to low fps (much more common when transcoding
-		// than going from low fps to high fps)
-		var fps C.AVRational
-		if param.Framerate > 0 {
-			filters += fmt.Sprintf(",fps=%d/%d", param.Framerate, param.FramerateDen)
-			fps = C.AVRational{num: C.int(param.Framerate), den: C.int(param.FramerateDen)}
-		}
-		var muxOpts C.component_opts
-		var muxName string
-		switch p.Profile.Format {
-		case FormatNone:
-			muxOpts = C.component_opts{
-				// don't free this bc of avformat_write_header API
-				opts: newAVOpts(p.Muxer.Opts),
-			}
-			muxName = p.Muxer.Name
-		case FormatMPEGTS:
-			muxName = "mpegts"
-		case FormatMP4:
-			muxName = "mp4"
-			muxOpts = C.component_opts{
-				opts: newAVOpts(map[string]string{"movflags": "faststart"}),
-			}
-		default:
-			return nil, ErrTranscoderFmt
-		}
-		if muxName != "" {
-			muxOpts.name = C.CString(muxName)
-			defer C.free(unsafe.Pointer(muxOpts.name))
-		}
-		// Set video encoder options
-		if len(p.VideoEncoder.Name) <= 0 && len(p.VideoEncoder.Opts) <= 0 {
-			p.VideoEncoder.Opts = map[string]string{
-				"forced-idr": "1",
-			}
-			switch p.Profile.Profile {
-			case ProfileH264Baseline, ProfileH264Main, ProfileH264High:
-				p.VideoEncoder.Opts["profile"] = ProfileParameters[p.Profile.Profile]
-			case ProfileH264ConstrainedHigh:
-				p.VideoEncoder.Opts["profile"] = ProfileParameters[p.Profile.Profile]
-				p.VideoEncoder.Opts["bf"] = "0"
-			case ProfileNone:
-				// Do nothing, the encoder will use default profile
-			default:
-				return nil, ErrTranscoderPrf
-			}
-		}
-		gopMs := 0
-		if param.GOP != 0 {
-			if param.GOP <= GOPInvalid {
-				return nil, ErrTranscoderGOP
-			}
-			// Check for intra-only
-			if param.GOP == GOPIntraOnly {
-				p.VideoEncoder.Opts["g"] = "0"
-			} else {
-				if param.Framerate > 0 {
-					gop := param.GOP.Seconds()
-					interval := strconv.Itoa(int(gop * float64(param.Framerate)))
-					p.VideoEncoder.Opts["g"] = interval
-				} else {
-					gopMs = int(param.GOP.Milliseconds())
-				}
-			}
-		}
-		if encoder == "h264_nvenc" {
-			p.VideoEncoder.Opts["max_width"] = "1920"
-			p.VideoEncoder.Opts["max_height"] = "1080"
-		}
-		vidOpts := C.component_opts{
-			name: C.CString(encoder),
-			opts: newAVOpts(p.VideoEncoder.Opts),
-		}
-		audioEncoder := p.AudioEncoder.Name
-		if audioEncoder == "" {
-			audioEncoder = "aac"
-		}
-		audioOpts := C.component_opts{
-			name: C.CString(audioEncoder),
-			opts: newAVOpts(p.AudioEncoder.Opts),
-		}
-		vfilt := C.CString(filters)
-		defer C.free(unsafe.Pointer(vidOpts.name))
-		defer C.free(unsafe.Pointer(audioOpts.name))
-		defer C.free(unsafe.Pointer(vfilt))
-		params[i] = C.output_params{fname: oname, fps: fps,
-			w: C.int(w), h: C.int(h), bitrate: C.int(bitrate),
-			gop_time: C.int(gopMs),
-			muxer:    muxOpts, audio: audioOpts, video: vidOpts, vfilters: vfilt}
-		defer func(param *C.output_params) {
-			// Work around the ownership rules:
-			// ffmpeg normally takes ownership of the following AVDictionary options
-			// However, if we don't pass these opts to ffmpeg, then we need to free
-			if param.muxer.opts != nil {
-				C.av_dict_free(&param.muxer.opts)
-			}
-			if param.audio.opts != nil {
-				C.av_dict_free(&param.audio.opts)
-			}
-			if param.video.opts != nil {
-				C.av_dict_free(&param.video.opts)
-			}
-		}(&params[i])
+// Encodes the frames in buf to all outputs. Expects the lock to be held.
+func (t *Encoder) encode(ctx context.Context, fname *C.char, accel Acceleration, dev string,
+	buf *DframeBuffer, ps []TranscodeOptions) (*TranscodeResults, error) {
+	hw_type, err := accelDeviceType(accel)
+	if err != nil {
+		return nil, err
 	}
+	params, freeParams, err := outputParams(accel, dev, ps)
+	if err != nil {
+		return nil, err
+	}
+	defer freeParams()
 	var device *C.char
-	if input.Device != "" {
-		device = C.CString(input.Device)
+	if dev != "" {
+		device = C.CString(dev)
 		defer C.free(unsafe.Pointer(device))
 	}
 
@@ -733,21 +1581,262 @@ func (t *Encoder) Encode(input *EncodeOptionsIn, ps []TranscodeOptions) (*Transc
 		paramsPointer = (*C.output_params)(&params[0])
 		resultsPointer = (*C.output_results)(&results[0])
 	}
-	ret := int(C.lpms_encode1(inp, input.DframeBuf.Dframebuffer, paramsPointer, resultsPointer, C.int(len(params)), decoded, input.Dmeta))
+	stopInterrupt := interruptOnDone(ctx, t.handle)
+	ret := int(C.lpms_encode1(inp, buf.buf, paramsPointer, resultsPointer, C.int(len(params)), decoded, buf.dmeta))
+	stopInterrupt()
+	err = writeOutputs(ps, results, 0 == ret)
 	if 0 != ret {
-		glog.Error("Transcoder Return : ", ErrorMap[ret])
-		return nil, ErrorMap[ret]
+		if ctx.Err() != nil {
+			resetHandle(&t.handle)
+			return nil, ctx.Err()
+		}
+		err := outputError(ret, results)
+		glog.Error("Transcoder Return : ", err)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
 	}
 	tr := make([]MediaInfo, len(ps))
-	for i, r := range results {
-		tr[i] = MediaInfo{
-			Frames: int(r.frames),
-			Pixels: int64(r.pixels),
+	for i := range results {
+		tr[i] = mediaInfo(&results[i])
+	}
+	dec := mediaInfo(decoded)
+	return &TranscodeResults{Encoded: tr, Decoded: dec}, nil
+}
+
+// RawFramesIn describes video frames produced in Go, eg slates or test
+// patterns, for Encoder.EncodeFrames.
+type RawFramesIn struct {
+	// Frames in presentation order. Only the dimensions, pixel format,
+	// planes, strides and timestamp of each frame are used. All frames must
+	// have the same dimensions and pixel format.
+	Frames       []*Frame
+	Framerate    uint
+	FramerateDen uint
+}
+
+// Time base that timestamps of raw frames are converted to
+var rawFramesTimeBase = C.AVRational{num: 1, den: 90000}
+
+// Copies raw frames into a new frame buffer
+func newRawDframeBuffer(in *RawFramesIn) (*DframeBuffer, error) {
+	if len(in.Frames) <= 0 || in.Framerate <= 0 {
+		return nil, ErrTranscoderInp
+	}
+	fpsDen := in.FramerateDen
+	if fpsDen == 0 {
+		fpsDen = 1
+	}
+	buf := newDframeBuffer(nil)
+	for _, f := range in.Frames {
+		if err := appendRawFrame(buf, f, len(in.Frames)); err != nil {
+			buf.Release()
+			return nil, err
+		}
+	}
+	fps := C.AVRational{num: C.int(in.Framerate), den: C.int(fpsDen)}
+	ret := int(C.set_dmeta_frames(buf.dmeta, buf.buf, rawFramesTimeBase, fps))
+	if ret < 0 {
+		buf.Release()
+		return nil, ErrTranscoderInp
+	}
+	return buf, nil
+}
+
+func appendRawFrame(buf *DframeBuffer, f *Frame, max int) error {
+	if f == nil || f.Width <= 0 || f.Height <= 0 {
+		return ErrTranscoderRes
+	}
+	pixfmt := C.CString(f.PixelFormat)
+	defer C.free(unsafe.Pointer(pixfmt))
+	format := C.av_get_pix_fmt(pixfmt)
+	var widths, heights [4]C.int
+	nbPlanes := int(C.picture_planes(format, C.int(f.Width), C.int(f.Height), &widths[0], &heights[0]))
+	if nbPlanes < 0 {
+		return ErrTranscoderFmt
+	}
+	if len(f.Planes) != nbPlanes || len(f.Strides) != nbPlanes {
+		return ErrTranscoderInp
+	}
+	for p := 0; p < nbPlanes; p++ {
+		rows, width, stride := int(heights[p]), int(widths[p]), f.Strides[p]
+		if stride < width || len(f.Planes[p]) < (rows-1)*stride+width {
+			return ErrTranscoderInp
+		}
+	}
+
+	var df *C.dframemeta
+	ret := int(C.append_dframe(buf.buf, C.int(max), &df))
+	if ret < 0 {
+		return ErrorMap[ret]
+	}
+	frame := df.dec_frame
+	frame.format = C.int(format)
+	frame.width = C.int(f.Width)
+	frame.height = C.int(f.Height)
+	us := C.AVRational{num: 1, den: 1000000}
+	frame.pts = C.av_rescale_q(C.int64_t(f.Timestamp/time.Microsecond), us, rawFramesTimeBase)
+	ret = int(C.av_frame_get_buffer(frame, 0))
+	if ret < 0 {
+		return ErrorMap[ret]
+	}
+	for p := 0; p < nbPlanes; p++ {
+		C.av_image_copy_plane(frame.data[p], frame.linesize[p],
+			(*C.uint8_t)(unsafe.Pointer(&f.Planes[p][0])), C.int(f.Strides[p]),
+			widths[p], heights[p])
+	}
+	df.has_frame = 1
+	return nil
+}
+
+// EncodeFrames encodes frames produced in Go rather than by a Decoder, using
+// the same filters, encoders and muxers as Encode. The input is video only.
+func (t *Encoder) EncodeFrames(in *RawFramesIn, ps []TranscodeOptions) (*TranscodeResults, error) {
+	if in == nil {
+		return nil, ErrTranscoderInp
+	}
+	buf, err := newRawDframeBuffer(in)
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Release()
+	res, err := t.encodeHost(buf, ps)
+	if err != nil {
+		return nil, err
+	}
+	res.Decoded.Frames = len(in.Frames)
+	for _, f := range in.Frames {
+		res.Decoded.Pixels += int64(f.Width * f.Height)
+	}
+	return res, nil
+}
+
+// Encodes frames in host memory that weren't decoded from an input file in
+// this process.
+func (t *Encoder) encodeHost(buf *DframeBuffer, ps []TranscodeOptions) (*TranscodeResults, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped || t.handle == nil {
+		return nil, ErrTranscoderStp
+	}
+	if err := buf.Retain(); err != nil {
+		return nil, err
+	}
+	defer buf.Release()
+	fname := C.CString("")
+	defer C.free(unsafe.Pointer(fname))
+	return t.encode(context.Background(), fname, Software, "", buf, ps)
+}
+
+// EncodeStream encodes frames from the stream as they are decoded, consuming
+// the stream. Outputs are encoded in lockstep so each output uses its own
+// encoding session. If the context is done before the stream has been
+// encoded, decoding is stopped, the encoder is reset to its initial state
+// and the context's error is returned.
+func (t *Encoder) EncodeStream(ctx context.Context, s *FrameStream, ps []TranscodeOptions) (*TranscodeResults, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped || t.handle == nil {
+		return nil, ErrTranscoderStp
+	}
+	if s == nil {
+		return nil, ErrTranscoderInp
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	hw_type, err := accelDeviceType(s.accel)
+	if err != nil {
+		return nil, err
+	}
+	params, freeParams, err := outputParams(s.accel, s.device, ps)
+	if err != nil {
+		return nil, err
+	}
+	defer freeParams()
+	var device *C.char
+	if s.device != "" {
+		device = C.CString(s.device)
+		defer C.free(unsafe.Pointer(device))
+	}
+	inp := &C.input_params{hw_type: hw_type, device: device, handle: t.handle}
+	results := make([]C.output_results, len(ps))
+	var (
+		paramsPointer  *C.output_params
+		resultsPointer *C.output_results
+	)
+	if len(params) > 0 {
+		paramsPointer = (*C.output_params)(&params[0])
+		resultsPointer = (*C.output_results)(&results[0])
+	}
+	stopInterrupt := interruptOnDone(ctx, t.handle)
+	ret := int(C.lpms_encode_begin(inp, paramsPointer, resultsPointer, C.int(len(params)), s.dmeta))
+	if 0 != ret {
+		stopInterrupt()
+		writeOutputs(ps, results, false)
+		if ctx.Err() != nil {
+			resetHandle(&t.handle)
+			return nil, ctx.Err()
+		}
+		err := outputError(ret, results)
+		glog.Error("Transcoder Return : ", err)
+		return nil, err
+	}
+	// Stop decoding too once the context is done
+	stopCancel := make(chan struct{})
+	defer close(stopCancel)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.cancel()
+		case <-stopCancel:
+		}
+	}()
+	for f := range s.Frames {
+		if 0 == ret {
+			ret = int(C.lpms_encode_frame(inp, f.df, s.dmeta))
+			if 0 != ret {
+				// Stop decoding; remaining frames are drained below
+				s.cancel()
+			}
+		}
+		f.Release()
+	}
+	dec, err := s.Wait()
+	if 0 != ret || err != nil {
+		C.lpms_encode_end(inp, s.dmeta, 0)
+		stopInterrupt()
+		writeOutputs(ps, results, false)
+		if ctx.Err() != nil {
+			resetHandle(&t.handle)
+			return nil, ctx.Err()
 		}
+		if 0 != ret {
+			err := outputError(ret, results)
+			glog.Error("Transcoder Return : ", err)
+			return nil, err
+		}
+		return nil, err
+	}
+	ret = int(C.lpms_encode_end(inp, s.dmeta, 1))
+	stopInterrupt()
+	err = writeOutputs(ps, results, 0 == ret)
+	if 0 != ret {
+		if ctx.Err() != nil {
+			resetHandle(&t.handle)
+			return nil, ctx.Err()
+		}
+		err := outputError(ret, results)
+		glog.Error("Transcoder Return : ", err)
+		return nil, err
 	}
-	dec := MediaInfo{
-		Frames: int(decoded.frames),
-		Pixels: int64(decoded.pixels),
+	if err != nil {
+		return nil, err
+	}
+	tr := make([]MediaInfo, len(ps))
+	for i := range results {
+		tr[i] = mediaInfo(&results[i])
 	}
 	return &TranscodeResults{Encoded: tr, Decoded: dec}, nil
 }
@@ -35,9 +35,12 @@ func error_map() map[int]error {
 	}{
 		{code: C.lpms_ERR_INPUT_PIXFMT, desc: "Unsupported input pixel format"},
 		{code: C.lpms_ERR_FILTERS, desc: "Error initializing filtergraph"},
-		{code: C.lpms_ERR_OUTPUTS, desc: "Too many outputs"},
+		{code: C.lpms_ERR_FILTER_PARSE, desc: "Invalid video filter description"},
+		{code: C.lpms_ERR_FILTER_CONFIG, desc: "Unable to configure video filters"},
+		{code: C.lpms_ERR_OUTPUTS, desc: "Number of outputs changed between segments of the same stream"},
 		{code: C.lpms_ERR_DTS, desc: "Segment out of order"},
 		{code: C.lpms_ERR_INPUT_CODEC, desc: "Unsupported input codec"},
+		{code: C.lpms_ERR_DFRAME_LIMIT, desc: "Too many frames in segment"},
 	}
 	for _, v := range lpmsErrors {
 		m[int(v.code)] = errors.New(v.desc)
@@ -48,6 +51,24 @@ func error_map() map[int]error {
 
 var ErrorMap = error_map()
 
+// OutputError is an error from ErrorMap along with details reported by the
+// outputs, eg which filters couldn't be set up. It unwraps to the former.
+type OutputError struct {
+	Err    error
+	Detail string
+}
+
+func (e *OutputError) Error() string {
+	if e.Err == nil {
+		return e.Detail
+	}
+	return e.Err.Error() + " " + e.Detail
+}
+
+func (e *OutputError) Unwrap() error {
+	return e.Err
+}
+
 // Use of this source code is governed by a MIT license that can be found in the LICENSE file.
 // Corbatto (luca@corbatto.de)
 
@@ -6,6 +6,41 @@
 
 #include <libavutil/opt.h>
 
+// Reports the filter description that failed, and why, to the caller
+static void filter_error(struct output_ctx *octx, const char *msg,
+  char *filters_descr, int err)
+{
+    char errstr[AV_ERROR_MAX_STRING_SIZE] = {0};
+    av_strerror(err, errstr, sizeof errstr);
+    av_log(NULL, AV_LOG_ERROR, "%s \"%s\" : %s\n", msg, filters_descr, errstr);
+    if (octx->res) {
+      snprintf(octx->res->err, sizeof octx->res->err, "\"%s\": %s",
+               filters_descr, errstr);
+    }
+}
+
+// Links the graph described by filters_descr between the buffer source and
+// sink. Custom filters come from callers, so failures are reported along
+// with the description and tell apart a malformed graph from an unusable one.
+static int parse_video_filters(struct output_ctx *octx, char *filters_descr,
+  AVFilterInOut **inputs, AVFilterInOut **outputs)
+{
+    struct filter_ctx *vf = &octx->vf;
+    int ret = avfilter_graph_parse_ptr(vf->graph, filters_descr,
+                                       inputs, outputs, NULL);
+    if (ret < 0) {
+      filter_error(octx, "Unable to parse video filters", filters_descr, ret);
+      return lpms_ERR_FILTER_PARSE;
+    }
+
+    ret = avfilter_graph_config(vf->graph, NULL);
+    if (ret < 0) {
+      filter_error(octx, "Unable to configure video filters", filters_descr, ret);
+      return lpms_ERR_FILTER_CONFIG;
+    }
+    return 0;
+}
+
 int init_video_filters(struct input_ctx *ictx, struct output_ctx *octx)
 {
     char args[512];
@@ -89,12 +124,8 @@ int init_video_filters(struct input_ctx *ictx, struct output_ctx *octx)
     inputs->pad_idx    = 0;
     inputs->next       = NULL;
 
-    ret = avfilter_graph_parse_ptr(vf->graph, filters_descr,
-                                    &inputs, &outputs, NULL);
-    if (ret < 0) LPMS_ERR(vf_init_cleanup, "Unable to parse video filters desc");
-
-    ret = avfilter_graph_config(vf->graph, NULL);
-    if (ret < 0) LPMS_ERR(vf_init_cleanup, "Unable configure video filtergraph");
+    ret = parse_video_filters(octx, filters_descr, &inputs, &outputs);
+    if (ret < 0) LPMS_ERR(vf_init_cleanup, "Unable to initialize video filters");
 
     vf->frame = av_frame_alloc();
     if (!vf->frame) LPMS_ERR(vf_init_cleanup, "Unable to allocate video frame");
@@ -113,7 +144,7 @@ int init_audio_filters(struct input_ctx *ictx, struct output_ctx *octx)
 {
   int ret = 0;
   char args[512];
-  char filters_descr[256];
+  const char *filters_descr = octx->afilters;
   const AVFilter *buffersrc  = avfilter_get_by_name("abuffer");
   const AVFilter *buffersink = avfilter_get_by_name("abuffersink");
   AVFilterInOut *outputs = NULL;
@@ -143,8 +174,9 @@ int init_audio_filters(struct input_ctx *ictx, struct output_ctx *octx)
 
   // TODO set sample format and rate based on encoder support,
   //      rather than hardcoding
-  snprintf(filters_descr, sizeof filters_descr,
-    "aformat=sample_fmts=fltp:channel_layouts=stereo:sample_rates=44100");
+  if (!filters_descr) {
+    filters_descr = "aformat=sample_fmts=fltp:channel_layouts=stereo:sample_rates=44100";
+  }
 
   ret = avfilter_graph_create_filter(&af->src_ctx, buffersrc,
                                      "in", args, NULL, af->graph);
@@ -332,14 +364,14 @@ int init_video_filters1(struct decode_meta *dmeta, struct output_ctx *octx)
     ret = avfilter_graph_create_filter(&vf->src_ctx, buffersrc,
                                        "in", args, NULL, vf->graph);
     if (ret < 0) LPMS_ERR(vf_init_cleanup, "Cannot create video buffer source");
-    // if (ictx->vc && ictx->vc->hw_frames_ctx) {
-    //   // XXX a bit problematic in that it's set before decoder is fully ready
+    if (dmeta->hw_frames_ctx) {
+      // XXX a bit problematic in that it's set before decoder is fully ready
       AVBufferSrcParameters *srcpar = av_buffersrc_parameters_alloc();
       srcpar->hw_frames_ctx = dmeta->hw_frames_ctx;
       vf->hwframes = dmeta->hw_frames_ctx->data;
       av_buffersrc_parameters_set(vf->src_ctx, srcpar);
       av_freep(&srcpar);
-    // }
+    }
 
     /* buffer video sink: to terminate the filter chain. */
     ret = avfilter_graph_create_filter(&vf->sink_ctx, buffersink,
@@ -377,12 +409,8 @@ int init_video_filters1(struct decode_meta *dmeta, struct output_ctx *octx)
     inputs->pad_idx    = 0;
     inputs->next       = NULL;
 
-    ret = avfilter_graph_parse_ptr(vf->graph, filters_descr,
-                                    &inputs, &outputs, NULL);
-    if (ret < 0) LPMS_ERR(vf_init_cleanup, "Unable to parse video filters desc");
-
-    ret = avfilter_graph_config(vf->graph, NULL);
-    if (ret < 0) LPMS_ERR(vf_init_cleanup, "Unable configure video filtergraph");
+    ret = parse_video_filters(octx, filters_descr, &inputs, &outputs);
+    if (ret < 0) LPMS_ERR(vf_init_cleanup, "Unable to initialize video filters");
 
     vf->frame = av_frame_alloc();
     if (!vf->frame) LPMS_ERR(vf_init_cleanup, "Unable to allocate video frame");
@@ -396,9 +424,86 @@ vf_init_cleanup:
     return ret;
 }
 
+int init_audio_filters1(struct decode_meta *dmeta, struct output_ctx *octx)
+{
+  int ret = 0;
+  char args[512];
+  const char *filters_descr = octx->afilters;
+  const AVFilter *buffersrc  = avfilter_get_by_name("abuffer");
+  const AVFilter *buffersink = avfilter_get_by_name("abuffersink");
+  AVFilterInOut *outputs = NULL;
+  AVFilterInOut *inputs  = NULL;
+  struct filter_ctx *af = &octx->af;
+  AVRational time_base = dmeta->a_time_base;
+
+  // no need for filters with the following conditions
+  if (af->active) goto af_init_cleanup; // already initialized
+  if (!needs_decoder(octx->audio->name)) goto af_init_cleanup;
+
+  outputs = avfilter_inout_alloc();
+  inputs = avfilter_inout_alloc();
+  af->graph = avfilter_graph_alloc();
+
+  if (!outputs || !inputs || !af->graph) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(af_init_cleanup, "Unable to allocate audio filters");
+  }
+
+  /* buffer audio source: the decoded frames from the decoder will be inserted here. */
+  snprintf(args, sizeof args,
+      "sample_rate=%d:sample_fmt=%d:channel_layout=0x%"PRIx64":channels=%d:"
+      "time_base=%d/%d",
+      dmeta->sample_rate, dmeta->sample_fmt, dmeta->channel_layout,
+      dmeta->channels, time_base.num, time_base.den);
+
+  // TODO set sample format and rate based on encoder support,
+  //      rather than hardcoding
+  if (!filters_descr) {
+    filters_descr = "aformat=sample_fmts=fltp:channel_layouts=stereo:sample_rates=44100";
+  }
+
+  ret = avfilter_graph_create_filter(&af->src_ctx, buffersrc,
+                                     "in", args, NULL, af->graph);
+  if (ret < 0) LPMS_ERR(af_init_cleanup, "Cannot create audio buffer source");
+
+  /* buffer audio sink: to terminate the filter chain. */
+  ret = avfilter_graph_create_filter(&af->sink_ctx, buffersink,
+                                     "out", NULL, NULL, af->graph);
+  if (ret < 0) LPMS_ERR(af_init_cleanup, "Cannot create audio buffer sink");
+
+  outputs->name       = av_strdup("in");
+  outputs->filter_ctx = af->src_ctx;
+  outputs->pad_idx    = 0;
+  outputs->next       = NULL;
+
+  inputs->name       = av_strdup("out");
+  inputs->filter_ctx = af->sink_ctx;
+  inputs->pad_idx    = 0;
+  inputs->next       = NULL;
+
+  ret = avfilter_graph_parse_ptr(af->graph, filters_descr,
+                                &inputs, &outputs, NULL);
+  if (ret < 0) LPMS_ERR(af_init_cleanup, "Unable to parse audio filters desc");
+
+  ret = avfilter_graph_config(af->graph, NULL);
+  if (ret < 0) LPMS_ERR(af_init_cleanup, "Unable configure audio filtergraph");
+
+  af->frame = av_frame_alloc();
+  if (!af->frame) LPMS_ERR(af_init_cleanup, "Unable to allocate audio frame");
+
+  af->active = 1;
+
+af_init_cleanup:
+  avfilter_inout_free(&inputs);
+  avfilter_inout_free(&outputs);
+
+  return ret;
+}
+
 int filtergraph_write1(AVFrame *inf, struct decode_meta *dmeta, struct output_ctx *octx, struct filter_ctx *filter, int is_video)
 {
   int ret = 0;
+  void *opaque = NULL;
   // Sometimes we have to reset the filter if the HW context is updated
   // because we initially set the filter before the decoder is fully ready
   // and the decoder may change HW params
@@ -412,7 +517,7 @@ int filtergraph_write1(AVFrame *inf, struct decode_meta *dmeta, struct output_ct
   // Timestamp handling code
   // AVStream *vst = ictx->ic->streams[ictx->vi];
   if (inf) { // Non-Flush Frame
-    inf->opaque = (void *) inf->pts; // Store original PTS for calc later
+    opaque = (void *) inf->pts; // Store original PTS for calc later
     if (is_video && octx->fps.den) {
       // Custom PTS set when FPS filter is used
       filter->custom_pts += av_rescale_q(1, av_inv_q(dmeta->r_frame_rate), dmeta->time_base);
@@ -422,7 +527,7 @@ int filtergraph_write1(AVFrame *inf, struct decode_meta *dmeta, struct output_ct
   } else if (!filter->flushed) { // Flush Frame
     int ts_step;
     inf = (is_video) ? dmeta->last_frame_v : dmeta->last_frame_a;
-    inf->opaque = (void *) (INT64_MIN); // Store INT64_MIN as pts for flush frames
+    opaque = (void *) (INT64_MIN); // Store INT64_MIN as pts for flush frames
     filter->flushing = 1;
     if (is_video) {
       ts_step = av_rescale_q(1, av_inv_q(dmeta->r_frame_rate), dmeta->time_base);
@@ -439,11 +544,17 @@ int filtergraph_write1(AVFrame *inf, struct decode_meta *dmeta, struct output_ct
   }
 
   if (inf) {
-    // Apply the custom pts, then reset for the next output
-    int old_pts = inf->pts;
-    inf->pts = filter->custom_pts;
-    ret = av_buffersrc_write_frame(filter->src_ctx, inf);
-    inf->pts = old_pts;
+    // Apply the custom pts to a new reference rather than the input frame,
+    // since decoded frames may be shared between concurrent encoders
+    AVFrame *frame = av_frame_clone(inf);
+    if (!frame) {
+      ret = AVERROR(ENOMEM);
+      LPMS_ERR(fg_write_cleanup, "Unable to reference input frame");
+    }
+    frame->opaque = opaque;
+    frame->pts = filter->custom_pts;
+    ret = av_buffersrc_write_frame(filter->src_ctx, frame);
+    av_frame_free(&frame);
     if (ret < 0) LPMS_ERR(fg_write_cleanup, "Error feeding the filtergraph");
   }
 fg_write_cleanup:
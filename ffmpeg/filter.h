@@ -36,9 +36,19 @@ struct filter_ctx {
   int flushing;
 };
 
+// Hardware encoder session shared between the outputs of a handle. Only
+// ever used by one call at a time, like the rest of the handle.
+struct hw_session {
+  AVCodecContext *vc;
+  AVDictionary *opts; // encoder options vc was opened with
+};
+
 struct output_ctx {
   char *fname;         // required output file name
+  int to_memory;       // whether to write into memory rather than fname
+  AVIOInterruptCB interrupt_cb; // aborts IO and encoding when triggered
   char *vfilters;      // required output video filters
+  char *afilters;      // optional output audio filters
   int width, height, bitrate; // w, h, br required
   AVRational fps;
   AVFormatContext *oc; // muxer required
@@ -50,6 +60,8 @@ struct output_ctx {
 
   // Optional hardware encoding support
   enum AVHWDeviceType hw_type;
+  int share_session; // whether the HW encoder may be shared with other outputs
+  struct hw_session *session; // owned by the handle
 
   // muxer and encoder information (name + options)
   component_opts *muxer;
@@ -71,6 +83,7 @@ int filtergraph_read(struct input_ctx *ictx, struct output_ctx *octx, struct fil
 void free_filter(struct filter_ctx *filter);
 
 int init_video_filters1(struct decode_meta *dmeta, struct output_ctx *octx);
+int init_audio_filters1(struct decode_meta *dmeta, struct output_ctx *octx);
 int filtergraph_write1(AVFrame *inf, struct decode_meta *dmeta, struct output_ctx *octx, struct filter_ctx *filter, int is_video);
 int filtergraph_read1(struct decode_meta *dmeta, struct output_ctx *octx, struct filter_ctx *filter, int is_video);
 
@@ -0,0 +1,183 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Per-title ladders. The source is encoded once at a low resolution with a
+// fast preset and constant quality; the bitrate that takes indicates how
+// complex the title is. Bitrates for each rendition are extrapolated from
+// there, so static content gets fewer bits and high-motion content more.
+
+type LadderOptions struct {
+	// Quality the renditions should reach, as an x264 CRF where lower is
+	// better. Defaults to 23.
+	Quality int
+	// Most renditions to recommend. Defaults to 5.
+	MaxRenditions int
+	// Cap on the bitrate of any rendition, in bits per second.
+	// Defaults to 8Mbps.
+	MaxBitrate int
+}
+
+const (
+	defaultLadderQuality    = 23
+	defaultLadderRenditions = 5
+	defaultLadderMaxBitrate = 8000000
+
+	// Height of the complexity encode
+	complexityHeight = 360
+	// Bitrate grows slower than the pixel count at the same quality
+	complexityScaling = 0.75
+	// The fastest preset needs more bits for the same quality than the
+	// default one used for the renditions
+	complexityPresetFactor = 0.7
+	// Bits per pixel bounds for any rendition
+	ladderMinBPP = 0.01
+	ladderMaxBPP = 0.25
+	// Renditions closer than this in bitrate are redundant
+	ladderMinStep = 1.5
+)
+
+// Rendition heights to pick from, highest first
+var ladderHeights = []int{1080, 720, 480, 360, 240, 144}
+
+// PerTitleLadder analyzes the input with a fast complexity encode and
+// recommends renditions for it, highest first. Inputs are given as for
+// Decode; the whole input is analyzed. As with Probe, a Reader input is read
+// into Data.
+func PerTitleLadder(input *TranscodeOptionsIn, opts LadderOptions) ([]VideoProfile, error) {
+	if input == nil {
+		return nil, ErrTranscoderInp
+	}
+	// The input is opened twice
+	if err := bufferInput(input); err != nil {
+		return nil, err
+	}
+	info, err := Probe(input)
+	if err != nil {
+		return nil, err
+	}
+	if info.Video == nil || info.Video.Width <= 0 || info.Video.Height <= 0 {
+		return nil, ErrTranscoderInp
+	}
+	src := *info.Video
+	if opts.Quality == 0 {
+		opts.Quality = defaultLadderQuality
+	}
+	if opts.MaxRenditions <= 0 {
+		opts.MaxRenditions = defaultLadderRenditions
+	}
+	if opts.MaxBitrate <= 0 {
+		opts.MaxBitrate = defaultLadderMaxBitrate
+	}
+
+	h := complexityHeight
+	if src.Height < h {
+		h = src.Height
+	}
+	p := VideoProfile{
+		Name:        "complexity",
+		Resolution:  fmt.Sprintf("%dx%d", ladderWidth(src, h), h),
+		Format:      FormatMPEGTS,
+		Preset:      PresetFastest,
+		RateControl: RateControl{Mode: RateControlCRF, Quality: opts.Quality},
+	}
+	var encoded bytes.Buffer
+	out := []TranscodeOptions{{
+		Oname:        "complexity.ts",
+		Writer:       &encoded,
+		Profile:      p,
+		AudioEncoder: ComponentOptions{Name: "drop"},
+	}}
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+	s, err := dec.DecodeStream(context.Background(), input)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	res, err := enc.EncodeStream(context.Background(), s, out)
+	if err != nil {
+		return nil, err
+	}
+	frames := res.Encoded[0].Frames
+	if frames <= 0 {
+		return nil, ErrTranscoderInp
+	}
+	bitrate := float64(encoded.Len()*8) * ladderFPS(src) / float64(frames)
+	return ladderFromComplexity(src, h, bitrate, opts), nil
+}
+
+// ladderFromComplexity picks renditions for a source that took the given
+// bitrate to encode at the given height.
+func ladderFromComplexity(src StreamInfo, height int, bitrate float64, opts LadderOptions) []VideoProfile {
+	fps := ladderFPS(src)
+	basePixels := float64(ladderWidth(src, height) * height)
+	heights := []int{}
+	for _, h := range ladderHeights {
+		if h <= src.Height {
+			heights = append(heights, h)
+		}
+	}
+	if len(heights) <= 0 {
+		// Smaller than any rendition, so only offer the source size
+		heights = append(heights, src.Height)
+	}
+	aw, ah := ladderAspect(src.Width, src.Height)
+	ladder := []VideoProfile{}
+	prev := math.Inf(1)
+	for _, h := range heights {
+		if len(ladder) >= opts.MaxRenditions {
+			break
+		}
+		w := ladderWidth(src, h)
+		pixels := float64(w * h)
+		br := bitrate * complexityPresetFactor * math.Pow(pixels/basePixels, complexityScaling)
+		br = math.Max(br, ladderMinBPP*pixels*fps)
+		br = math.Min(br, ladderMaxBPP*pixels*fps)
+		br = math.Min(br, float64(opts.MaxBitrate))
+		if br*ladderMinStep > prev {
+			continue
+		}
+		prev = br
+		ladder = append(ladder, VideoProfile{
+			Name:         fmt.Sprintf("P%dp%dfps%dx%d", h, int(math.Round(fps)), aw, ah),
+			Bitrate:      strconv.Itoa(int(br/1000)) + "k",
+			Framerate:    src.Framerate,
+			FramerateDen: src.FramerateDen,
+			Resolution:   fmt.Sprintf("%dx%d", w, h),
+			AspectRatio:  fmt.Sprintf("%d:%d", aw, ah),
+		})
+	}
+	return ladder
+}
+
+// ladderWidth returns the even width that keeps the source aspect ratio at
+// the given height.
+func ladderWidth(src StreamInfo, height int) int {
+	return 2 * int(math.Round(float64(src.Width*height)/float64(src.Height)/2))
+}
+
+// ladderFPS returns the source framerate, or a typical one if unknown.
+func ladderFPS(src StreamInfo) float64 {
+	if src.Framerate > 0 && src.FramerateDen > 0 {
+		return float64(src.Framerate) / float64(src.FramerateDen)
+	}
+	return 30
+}
+
+// ladderAspect reduces the dimensions to an aspect ratio, eg 16 and 9.
+func ladderAspect(w, h int) (int, int) {
+	a, b := w, h
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return w / a, h / a
+}
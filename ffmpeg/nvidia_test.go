@@ -3,6 +3,7 @@
 package ffmpeg
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -546,6 +547,36 @@ func TestNvidia_CountFrames(t *testing.T) {
 	tc.StopTranscoder()
 }
 
+func TestNvidia_DecodeFootprint(t *testing.T) {
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+    ffmpeg -loglevel warning -i "$1"/../transcoder/test.ts -c:a copy -c:v copy -t 1 test.ts
+  `
+	run(cmd)
+
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	in := &TranscodeOptionsIn{
+		Fname:  dir + "/test.ts",
+		Accel:  Nvidia,
+		Device: "0",
+	}
+	res, err := dec.Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.DframeBuf.Release()
+	// Decoded pictures stay on the GPU; only packets are in host memory
+	if res.HWBytes < res.Decoded.Pixels || res.HostBytes <= 0 {
+		t.Error("Unexpected memory footprint ", res.HostBytes, res.HWBytes)
+	}
+	if res.HostBytes >= res.HWBytes {
+		t.Error("Expected decoded frames to be held in GPU memory")
+	}
+}
+
 func TestNvidia_CountEncodedFrames(t *testing.T) {
 	countEncodedFrames(t, Nvidia)
 }
@@ -788,4 +819,94 @@ func TestNvidia_AudioOnly(t *testing.T) {
 	audioOnlySegment(t, Nvidia)
 }
 
+func TestNvidia_Overlay(t *testing.T) {
+	overlay(t, Nvidia)
+}
+
+func TestNvidia_AspectModes(t *testing.T) {
+	aspectModes(t, Nvidia)
+}
+
+func TestNvidia_SharedRateControl(t *testing.T) {
+	sharedRateControl(t, Nvidia)
+}
+
+func TestNvidia_SharedPresets(t *testing.T) {
+	sharedPresets(t, Nvidia)
+}
+
+func TestNvidia_PreFilters(t *testing.T) {
+	preFilters(t, Nvidia)
+}
+
+func TestNvidia_StreamSessions(t *testing.T) {
+	// Streamed outputs reuse the encoder's sessions between calls, and only
+	// one of them takes the session shared by the segmented API
+	run, dir := setupTest(t)
+	defer os.RemoveAll(dir)
+
+	cmd := `
+    ffmpeg -loglevel warning -i "$1"/../transcoder/test.ts -c:a copy -c:v copy -t 1 test.ts
+  `
+	run(cmd)
+
+	in := &TranscodeOptionsIn{Fname: dir + "/test.ts", Accel: Nvidia}
+	out := []TranscodeOptions{{
+		Oname:   dir + "/out_144p.ts",
+		Profile: P144p30fps16x9,
+		Accel:   Nvidia,
+	}, {
+		Oname:   dir + "/out_240p.ts",
+		Profile: P240p30fps16x9,
+		Accel:   Nvidia,
+	}}
+	dec := NewDecoder()
+	defer dec.StopDecoder()
+	streamDec := NewDecoder()
+	defer streamDec.StopDecoder()
+	enc := NewEncoder()
+	defer enc.StopEncoder()
+
+	dres, err := dec.Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dres.DframeBuf.Release()
+	encode := func() {
+		if _, err := enc.Encode(&EncodeOptionsIn{DframeBuf: dres.DframeBuf, Accel: Nvidia}, out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encodeStream := func() {
+		s, err := streamDec.DecodeStream(context.Background(), in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if _, err := enc.EncodeStream(context.Background(), s, out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSessions := func(stage string, expected int) {
+		if n := enc.hwSessions(); n != expected {
+			t.Errorf("%s: expected %d sessions but got %d", stage, expected, n)
+		}
+	}
+
+	encode()
+	checkSessions("encode", 1)
+	encodeStream()
+	checkSessions("first stream", 2)
+	encodeStream()
+	checkSessions("second stream", 2)
+	encode()
+	checkSessions("encode after streams", 2)
+
+	cmd = `
+    ffprobe -loglevel warning -count_frames -show_streams -select_streams v out_144p.ts | grep nb_read_frames=30
+    ffprobe -loglevel warning -count_frames -show_streams -select_streams v out_240p.ts | grep nb_read_frames=30
+  `
+	run(cmd)
+}
+
 // XXX test bframes or delayed frames
@@ -0,0 +1,117 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+type OverlayPosition int
+
+const (
+	OverlayTopLeft OverlayPosition = iota
+	OverlayTopRight
+	OverlayBottomLeft
+	OverlayBottomRight
+	OverlayCenter
+)
+
+// Overlay expressions for each position. W and H are the size of the video
+// and w and h of the image; corners are inset by 2% of the video height.
+var overlayPositions = map[OverlayPosition]string{
+	OverlayTopLeft:     "x=H*0.02:y=H*0.02",
+	OverlayTopRight:    "x=W-w-H*0.02:y=H*0.02",
+	OverlayBottomLeft:  "x=H*0.02:y=H-h-H*0.02",
+	OverlayBottomRight: "x=W-w-H*0.02:y=H-h-H*0.02",
+	OverlayCenter:      "x=(W-w)/2:y=(H-h)/2",
+}
+
+// Image composed onto the video of an output, eg a watermark
+type Overlay struct {
+	// Image file to overlay. Any format that ffmpeg decodes, eg PNG.
+	Path string
+	// In-memory image, used instead of Path
+	Data     []byte
+	Position OverlayPosition
+	// Width of the image relative to the width of the video, eg 0.1 for a
+	// tenth. Zero keeps the size of the image.
+	Scale float64
+	// Ranges from 0 for transparent to 1 for opaque. Zero is treated as
+	// opaque since a transparent overlay would have no effect.
+	Opacity float64
+}
+
+// overlayImage returns the path of the overlay image, writing in-memory
+// images into a temporary file that the caller should remove when non-empty.
+func overlayImage(o *Overlay) (string, string, error) {
+	if len(o.Data) <= 0 {
+		if o.Path == "" {
+			return "", "", ErrTranscoderOvl
+		}
+		if _, err := os.Stat(o.Path); err != nil {
+			return "", "", err
+		}
+		return o.Path, "", nil
+	}
+	f, err := ioutil.TempFile("", "overlay")
+	if err != nil {
+		return "", "", err
+	}
+	_, err = f.Write(o.Data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+	return f.Name(), f.Name(), nil
+}
+
+// escapeFilterArg escapes a filter option value for a filtergraph
+// description, which is unescaped once when the graph is parsed and again
+// when the options of each filter are parsed.
+func escapeFilterArg(s string) string {
+	escape := func(s, special string) string {
+		var b strings.Builder
+		for _, r := range s {
+			if strings.ContainsRune(special, r) {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	}
+	return escape(escape(s, `\':`), `\'[],;`)
+}
+
+// overlayFilters composes the image at path onto the video produced by the
+// given filters. Hardware frames are downloaded for the overlay, then
+// uploaded again with the given filter.
+func overlayFilters(filters string, o *Overlay, path string, upload string) (string, error) {
+	position, ok := overlayPositions[o.Position]
+	if !ok || o.Scale < 0 || o.Scale > 1 || o.Opacity < 0 || o.Opacity > 1 {
+		return "", ErrTranscoderOvl
+	}
+	main := filters
+	if upload != "" {
+		main += ",hwdownload,format=nv12"
+	}
+	image := "movie=filename=" + escapeFilterArg(path) + ",format=rgba"
+	if o.Opacity > 0 && o.Opacity < 1 {
+		image += fmt.Sprintf(",colorchannelmixer=aa=%g", o.Opacity)
+	}
+	var graph string
+	if o.Scale > 0 {
+		// Size the image against the video it is composed onto
+		graph = fmt.Sprintf("%s[main];%s[img];[img][main]scale2ref=w=main_w*%g:h=ow/a[ovl][base];[base][ovl]overlay=%s",
+			main, image, o.Scale, position)
+	} else {
+		graph = fmt.Sprintf("%s[main];%s[ovl];[main][ovl]overlay=%s", main, image, position)
+	}
+	if upload != "" {
+		graph += "," + upload
+	}
+	return graph, nil
+}
@@ -0,0 +1,121 @@
+package ffmpeg
+
+// #cgo pkg-config: libavformat libavcodec libavutil
+// #include "extras.h"
+import "C"
+
+import (
+	"time"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+type ProbeInfo struct {
+	// Name of the container format, eg "mpegts" or "mov,mp4,m4a,3gp,3g2,mj2"
+	Format string
+	// Zero if unknown
+	Duration time.Duration
+	Bitrate  int64
+	Streams  []StreamInfo
+	// The streams the transcoder would pick, if any
+	Video *StreamInfo
+	Audio *StreamInfo
+}
+
+type StreamInfo struct {
+	Index int
+	// Media type, eg "video" or "audio"
+	Type    string
+	Codec   string
+	Profile string
+	// Zero if unknown
+	Bitrate  int64
+	Duration time.Duration
+
+	// Video only
+	Width        int
+	Height       int
+	PixelFormat  string
+	Framerate    uint
+	FramerateDen uint
+	// Degrees clockwise that the video should be rotated for display
+	Rotation int
+
+	// Audio only
+	SampleRate int
+	Channels   int
+}
+
+// Durations are in AV_TIME_BASE units, ie microseconds. Unknown durations
+// are AV_NOPTS_VALUE, which is negative.
+func probeDuration(d C.int64_t) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d) * time.Microsecond
+}
+
+// Probe opens the input and describes its container and streams without
+// decoding it. Inputs are given as for Transcode; acceleration is ignored.
+// A Reader input is read into Data, so the same input may be transcoded
+// afterwards.
+func Probe(input *TranscodeOptionsIn) (*ProbeInfo, error) {
+	if input == nil {
+		return nil, ErrTranscoderInp
+	}
+	if err := bufferInput(input); err != nil {
+		return nil, err
+	}
+	inp, freeInput, err := inputParams(input)
+	if err != nil {
+		return nil, err
+	}
+	defer freeInput()
+	info := C.probe_info{}
+	defer C.lpms_probe_free(&info)
+	ret := int(C.lpms_probe(inp, &info))
+	if ret != 0 {
+		glog.Error("Probe Return : ", ErrorMap[ret])
+		return nil, ErrorMap[ret]
+	}
+	res := &ProbeInfo{
+		Format:   C.GoString(info.format),
+		Duration: probeDuration(info.duration),
+		Bitrate:  int64(info.bit_rate),
+		Streams:  make([]StreamInfo, int(info.nb_streams)),
+	}
+	var streams []C.probe_stream
+	if info.nb_streams > 0 {
+		streams = (*[1 << 20]C.probe_stream)(unsafe.Pointer(info.streams))[:info.nb_streams:info.nb_streams]
+	}
+	for i, s := range streams {
+		// GoString returns an empty string for NULL
+		st := StreamInfo{
+			Index:       int(s.index),
+			Type:        C.GoString(s._type),
+			Codec:       C.GoString(s.codec),
+			Profile:     C.GoString(s.profile),
+			Bitrate:     int64(s.bit_rate),
+			Duration:    probeDuration(s.duration),
+			Width:       int(s.width),
+			Height:      int(s.height),
+			PixelFormat: C.GoString(s.pix_fmt),
+			Rotation:    int(s.rotation),
+			SampleRate:  int(s.sample_rate),
+			Channels:    int(s.channels),
+		}
+		if s.frame_rate.num > 0 && s.frame_rate.den > 0 {
+			st.Framerate = uint(s.frame_rate.num)
+			st.FramerateDen = uint(s.frame_rate.den)
+		}
+		res.Streams[i] = st
+	}
+	if info.video_stream >= 0 {
+		res.Video = &res.Streams[info.video_stream]
+	}
+	if info.audio_stream >= 0 {
+		res.Audio = &res.Streams[info.audio_stream]
+	}
+	return res, nil
+}
@@ -0,0 +1,541 @@
+package ffmpeg
+
+// #cgo pkg-config: libavformat libavcodec libavutil
+// #include <stdlib.h>
+// #include <libavutil/hwcontext.h>
+// #include "transcoder.h"
+import "C"
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"unsafe"
+)
+
+// Serialized segments start with this tag and version, followed by the
+// libavutil version. Enumerations such as pixel formats are written as their
+// numeric values, so both ends must be built against the same FFmpeg.
+var segMagic = [4]byte{'L', 'P', 'D', 'F'}
+
+const segVersion = 1
+
+// Upper bounds on the sizes read from a serialized segment, to avoid
+// allocating unbounded amounts of memory for corrupt input.
+const (
+	segMaxEntries   = 1 << 16
+	segMaxPlanes    = 64
+	segMaxPlaneSize = 1 << 28
+	segMaxDataSize  = 1 << 26
+)
+
+const (
+	segFrameNone = iota
+	segFrameVideo
+	segFrameAudio
+)
+
+// WriteTo serializes the decoded frames and metadata of the segment so it
+// can be encoded by another process with ReadDframeBuffer. Frames held in
+// hardware memory are downloaded, so the reader always gets software frames.
+func (d *DframeBuffer) WriteTo(w io.Writer) (int64, error) {
+	if err := d.Retain(); err != nil {
+		return 0, err
+	}
+	defer d.Release()
+	sw := &segWriter{w: bufio.NewWriter(w)}
+	sw.write(segMagic[:])
+	sw.u32(segVersion)
+	sw.u32(uint32(C.avutil_version()))
+	sw.dmeta(d.dmeta)
+	sw.u32(uint32(d.buf.cnt))
+	if d.buf.cnt > 0 {
+		dframes := (*[1 << 30]C.dframemeta)(unsafe.Pointer(d.buf.dframes))[:d.buf.cnt:d.buf.cnt]
+		for i := range dframes {
+			sw.dframe(&dframes[i])
+		}
+	}
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	return sw.n, sw.err
+}
+
+// ReadDframeBuffer reads a segment serialized with DframeBuffer.WriteTo.
+// The caller holds one reference to the returned buffer. The frames are in
+// host memory, so the buffer should be encoded with Software acceleration.
+func ReadDframeBuffer(r io.Reader) (*DframeBuffer, error) {
+	sr := &segReader{r: r}
+	var magic [4]byte
+	sr.read(magic[:])
+	if sr.err != nil {
+		return nil, sr.err
+	}
+	if magic != segMagic || sr.u32() != segVersion || sr.u32() != uint32(C.avutil_version()) {
+		if sr.err != nil {
+			return nil, sr.err
+		}
+		return nil, ErrTranscoderSeg
+	}
+	buf := newDframeBuffer(nil)
+	sr.dmeta(buf.dmeta)
+	cnt := int(sr.u32())
+	if sr.err == nil && cnt > segMaxEntries {
+		sr.err = ErrTranscoderSeg
+	}
+	for i := 0; i < cnt && sr.err == nil; i++ {
+		var df *C.dframemeta
+		if ret := int(C.append_dframe(buf.buf, C.int(cnt), &df)); ret < 0 {
+			sr.err = ErrorMap[ret]
+			break
+		}
+		sr.dframe(df)
+	}
+	if sr.err != nil {
+		buf.Release()
+		if sr.err == io.EOF {
+			sr.err = io.ErrUnexpectedEOF
+		}
+		return nil, sr.err
+	}
+	return buf, nil
+}
+
+type segWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+	b   [8]byte
+}
+
+func (s *segWriter) write(p []byte) {
+	if s.err != nil {
+		return
+	}
+	n, err := s.w.Write(p)
+	s.n += int64(n)
+	s.err = err
+}
+
+func (s *segWriter) u8(v uint8) {
+	s.b[0] = v
+	s.write(s.b[:1])
+}
+
+func (s *segWriter) u32(v uint32) {
+	binary.LittleEndian.PutUint32(s.b[:4], v)
+	s.write(s.b[:4])
+}
+
+func (s *segWriter) u64(v uint64) {
+	binary.LittleEndian.PutUint64(s.b[:8], v)
+	s.write(s.b[:8])
+}
+
+func (s *segWriter) i32(v C.int) {
+	s.u32(uint32(int32(v)))
+}
+
+func (s *segWriter) i64(v C.int64_t) {
+	s.u64(uint64(int64(v)))
+}
+
+func (s *segWriter) rational(v C.AVRational) {
+	s.i32(v.num)
+	s.i32(v.den)
+}
+
+func (s *segWriter) data(p *C.uint8_t, size C.int) {
+	s.i32(size)
+	if size > 0 {
+		s.write((*[1 << 30]byte)(unsafe.Pointer(p))[:size:size])
+	}
+}
+
+func (s *segWriter) dmeta(dmeta *C.struct_decode_meta) {
+	s.i32(dmeta.vi)
+	s.i32(dmeta.ai)
+	if dmeta.vi >= 0 {
+		s.codecpar(dmeta.v_codecpar)
+		pixfmt := dmeta.in_pix_fmt
+		if dmeta.hw_frames_ctx != nil {
+			// frames are downloaded, so describe them in their software format
+			hwframes := (*C.AVHWFramesContext)(unsafe.Pointer(dmeta.hw_frames_ctx.data))
+			pixfmt = hwframes.sw_format
+		}
+		s.i32(dmeta.v_width)
+		s.i32(dmeta.v_height)
+		s.i32(C.int(pixfmt))
+		s.rational(dmeta.time_base)
+		s.rational(dmeta.sample_aspect_ratio)
+		s.rational(dmeta.framerate)
+		s.rational(dmeta.r_frame_rate)
+		s.rational(dmeta.avg_frame_rate)
+	}
+	if dmeta.ai >= 0 {
+		s.codecpar(dmeta.a_codecpar)
+		s.rational(dmeta.a_time_base)
+		s.i32(dmeta.has_ac)
+		s.i32(dmeta.sample_rate)
+		s.i32(dmeta.channels)
+		s.u64(uint64(dmeta.channel_layout))
+		s.i32(C.int(dmeta.sample_fmt))
+	}
+	s.frame(dmeta.last_frame_v)
+	s.frame(dmeta.last_frame_a)
+}
+
+func (s *segWriter) codecpar(par *C.AVCodecParameters) {
+	if par == nil {
+		s.u8(0)
+		return
+	}
+	s.u8(1)
+	s.i32(C.int(par.codec_type))
+	s.i32(C.int(par.codec_id))
+	s.u32(uint32(par.codec_tag))
+	s.data(par.extradata, par.extradata_size)
+	s.i32(par.format)
+	s.i64(par.bit_rate)
+	s.i32(par.bits_per_coded_sample)
+	s.i32(par.bits_per_raw_sample)
+	s.i32(par.profile)
+	s.i32(par.level)
+	s.i32(par.width)
+	s.i32(par.height)
+	s.rational(par.sample_aspect_ratio)
+	s.i32(C.int(par.field_order))
+	s.i32(C.int(par.color_range))
+	s.i32(C.int(par.color_primaries))
+	s.i32(C.int(par.color_trc))
+	s.i32(C.int(par.color_space))
+	s.i32(C.int(par.chroma_location))
+	s.i32(par.video_delay)
+	s.u64(uint64(par.channel_layout))
+	s.i32(par.channels)
+	s.i32(par.sample_rate)
+	s.i32(par.block_align)
+	s.i32(par.frame_size)
+	s.i32(par.initial_padding)
+	s.i32(par.trailing_padding)
+	s.i32(par.seek_preroll)
+}
+
+func (s *segWriter) dframe(df *C.dframemeta) {
+	s.i32(df.in_pkt.stream_index)
+	if df.in_pkt.data != nil {
+		s.u8(1)
+		s.i64(df.in_pkt.pts)
+		s.i64(df.in_pkt.dts)
+		s.i64(df.in_pkt.duration)
+		s.i32(df.in_pkt.flags)
+		s.data(df.in_pkt.data, df.in_pkt.size)
+	} else {
+		s.u8(0)
+	}
+	if df.has_frame != 0 {
+		s.frame(df.dec_frame)
+	} else {
+		s.frame(nil)
+	}
+}
+
+func (s *segWriter) frame(f *C.AVFrame) {
+	if s.err != nil {
+		return
+	}
+	if f == nil || (f.nb_samples == 0 && (f.width == 0 || f.height == 0)) {
+		s.u8(segFrameNone)
+		return
+	}
+	if f.hw_frames_ctx != nil {
+		// Download to host memory first
+		hostFrame := C.av_frame_alloc()
+		if hostFrame == nil {
+			s.err = errors.New("Unable to allocate frame")
+			return
+		}
+		defer C.av_frame_free(&hostFrame)
+		var sizes [C.AV_NUM_DATA_POINTERS]C.int
+		if ret := int(C.map_host_frame(hostFrame, f, &sizes[0])); ret < 0 {
+			s.err = ErrorMap[ret]
+			return
+		}
+		f = hostFrame
+	}
+	var widths, heights [segMaxPlanes]C.int
+	nbPlanes := int(C.frame_planes(f, &widths[0], &heights[0], segMaxPlanes))
+	if nbPlanes < 0 {
+		s.err = ErrorMap[nbPlanes]
+		return
+	}
+	if f.nb_samples > 0 {
+		s.u8(segFrameAudio)
+		s.i32(f.nb_samples)
+		s.i32(f.channels)
+		s.u64(uint64(f.channel_layout))
+		s.i32(f.sample_rate)
+	} else {
+		s.u8(segFrameVideo)
+		s.i32(f.width)
+		s.i32(f.height)
+		s.rational(f.sample_aspect_ratio)
+		s.i32(C.int(f.color_range))
+		s.i32(C.int(f.color_primaries))
+		s.i32(C.int(f.color_trc))
+		s.i32(C.int(f.colorspace))
+		s.i32(C.int(f.chroma_location))
+		s.i32(f.key_frame)
+	}
+	s.i32(f.format)
+	s.i64(f.pts)
+	s.i64(f.pkt_duration)
+	// Planes are written row by row without any padding
+	planes := (*[segMaxPlanes]*C.uint8_t)(unsafe.Pointer(f.extended_data))[:nbPlanes:nbPlanes]
+	linesize := int(f.linesize[0])
+	for p := 0; p < nbPlanes; p++ {
+		if f.nb_samples == 0 {
+			linesize = int(f.linesize[p])
+		}
+		width, rows := int(widths[p]), int(heights[p])
+		data := (*[1 << 30]byte)(unsafe.Pointer(planes[p]))
+		for y := 0; y < rows; y++ {
+			s.write(data[y*linesize : y*linesize+width : y*linesize+width])
+		}
+	}
+}
+
+type segReader struct {
+	r   io.Reader
+	err error
+	b   [8]byte
+}
+
+func (s *segReader) read(p []byte) {
+	if s.err != nil {
+		return
+	}
+	_, s.err = io.ReadFull(s.r, p)
+}
+
+func (s *segReader) u8() uint8 {
+	s.read(s.b[:1])
+	return s.b[0]
+}
+
+func (s *segReader) u32() uint32 {
+	if s.read(s.b[:4]); s.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(s.b[:4])
+}
+
+func (s *segReader) u64() uint64 {
+	if s.read(s.b[:8]); s.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(s.b[:8])
+}
+
+func (s *segReader) i32() C.int {
+	return C.int(int32(s.u32()))
+}
+
+func (s *segReader) i64() C.int64_t {
+	return C.int64_t(int64(s.u64()))
+}
+
+func (s *segReader) rational() C.AVRational {
+	num := s.i32()
+	return C.AVRational{num: num, den: s.i32()}
+}
+
+// Reads length-prefixed data into a buffer allocated with av_malloc,
+// followed by `padding` zeroed bytes.
+func (s *segReader) data(padding int) (*C.uint8_t, C.int) {
+	size := int(s.i32())
+	if s.err != nil {
+		return nil, 0
+	}
+	if size < 0 || size > segMaxDataSize {
+		s.err = ErrTranscoderSeg
+		return nil, 0
+	}
+	if size == 0 {
+		return nil, 0
+	}
+	p := (*C.uint8_t)(C.av_mallocz(C.size_t(size + padding)))
+	if p == nil {
+		s.err = errors.New("Unable to allocate data")
+		return nil, 0
+	}
+	s.read((*[1 << 30]byte)(unsafe.Pointer(p))[:size:size])
+	return p, C.int(size)
+}
+
+func (s *segReader) dmeta(dmeta *C.struct_decode_meta) {
+	dmeta.vi = s.i32()
+	dmeta.ai = s.i32()
+	dmeta.hw_type = C.AV_HWDEVICE_TYPE_NONE
+	if s.err == nil && dmeta.vi >= 0 {
+		dmeta.v_codecpar = s.codecpar()
+		dmeta.v_width = s.i32()
+		dmeta.v_height = s.i32()
+		dmeta.in_pix_fmt = C.enum_AVPixelFormat(s.i32())
+		dmeta.time_base = s.rational()
+		dmeta.sample_aspect_ratio = s.rational()
+		dmeta.framerate = s.rational()
+		dmeta.r_frame_rate = s.rational()
+		dmeta.avg_frame_rate = s.rational()
+	}
+	if s.err == nil && dmeta.ai >= 0 {
+		dmeta.a_codecpar = s.codecpar()
+		dmeta.a_time_base = s.rational()
+		dmeta.has_ac = s.i32()
+		dmeta.sample_rate = s.i32()
+		dmeta.channels = s.i32()
+		dmeta.channel_layout = C.uint64_t(s.u64())
+		dmeta.sample_fmt = C.enum_AVSampleFormat(s.i32())
+	}
+	dmeta.last_frame_v = C.av_frame_alloc()
+	dmeta.last_frame_a = C.av_frame_alloc()
+	if dmeta.last_frame_v == nil || dmeta.last_frame_a == nil {
+		s.err = errors.New("Unable to allocate frame")
+		return
+	}
+	s.frame(dmeta.last_frame_v)
+	s.frame(dmeta.last_frame_a)
+}
+
+func (s *segReader) codecpar() *C.AVCodecParameters {
+	if s.u8() == 0 || s.err != nil {
+		return nil
+	}
+	par := C.avcodec_parameters_alloc()
+	if par == nil {
+		s.err = errors.New("Unable to allocate codec parameters")
+		return nil
+	}
+	par.codec_type = C.enum_AVMediaType(s.i32())
+	par.codec_id = C.enum_AVCodecID(s.i32())
+	par.codec_tag = C.uint32_t(s.u32())
+	par.extradata, par.extradata_size = s.data(C.AV_INPUT_BUFFER_PADDING_SIZE)
+	par.format = s.i32()
+	par.bit_rate = s.i64()
+	par.bits_per_coded_sample = s.i32()
+	par.bits_per_raw_sample = s.i32()
+	par.profile = s.i32()
+	par.level = s.i32()
+	par.width = s.i32()
+	par.height = s.i32()
+	par.sample_aspect_ratio = s.rational()
+	par.field_order = C.enum_AVFieldOrder(s.i32())
+	par.color_range = C.enum_AVColorRange(s.i32())
+	par.color_primaries = C.enum_AVColorPrimaries(s.i32())
+	par.color_trc = C.enum_AVColorTransferCharacteristic(s.i32())
+	par.color_space = C.enum_AVColorSpace(s.i32())
+	par.chroma_location = C.enum_AVChromaLocation(s.i32())
+	par.video_delay = s.i32()
+	par.channel_layout = C.uint64_t(s.u64())
+	par.channels = s.i32()
+	par.sample_rate = s.i32()
+	par.block_align = s.i32()
+	par.frame_size = s.i32()
+	par.initial_padding = s.i32()
+	par.trailing_padding = s.i32()
+	par.seek_preroll = s.i32()
+	return par
+}
+
+func (s *segReader) dframe(df *C.dframemeta) {
+	df.in_pkt.stream_index = s.i32()
+	if s.u8() != 0 && s.err == nil {
+		pts, dts, duration, flags := s.i64(), s.i64(), s.i64(), s.i32()
+		size := int(s.i32())
+		if s.err != nil {
+			return
+		}
+		if size < 0 || size > segMaxDataSize {
+			s.err = ErrTranscoderSeg
+			return
+		}
+		if ret := int(C.av_new_packet(&df.in_pkt, C.int(size))); ret < 0 {
+			s.err = ErrorMap[ret]
+			return
+		}
+		df.in_pkt.pts = pts
+		df.in_pkt.dts = dts
+		df.in_pkt.duration = duration
+		df.in_pkt.flags = flags
+		if size > 0 {
+			s.read((*[1 << 30]byte)(unsafe.Pointer(df.in_pkt.data))[:size:size])
+		}
+	}
+	if s.frame(df.dec_frame) {
+		df.has_frame = 1
+	}
+}
+
+// Reads a frame into f; returns whether one was present
+func (s *segReader) frame(f *C.AVFrame) bool {
+	kind := s.u8()
+	if s.err != nil || kind == segFrameNone {
+		return false
+	}
+	switch kind {
+	case segFrameAudio:
+		f.nb_samples = s.i32()
+		f.channels = s.i32()
+		f.channel_layout = C.uint64_t(s.u64())
+		f.sample_rate = s.i32()
+	case segFrameVideo:
+		f.width = s.i32()
+		f.height = s.i32()
+		f.sample_aspect_ratio = s.rational()
+		f.color_range = C.enum_AVColorRange(s.i32())
+		f.color_primaries = C.enum_AVColorPrimaries(s.i32())
+		f.color_trc = C.enum_AVColorTransferCharacteristic(s.i32())
+		f.colorspace = C.enum_AVColorSpace(s.i32())
+		f.chroma_location = C.enum_AVChromaLocation(s.i32())
+		f.key_frame = s.i32()
+	default:
+		s.err = ErrTranscoderSeg
+		return false
+	}
+	f.format = s.i32()
+	f.pts = s.i64()
+	f.pkt_duration = s.i64()
+	if s.err != nil {
+		return false
+	}
+	var widths, heights [segMaxPlanes]C.int
+	nbPlanes := int(C.frame_planes(f, &widths[0], &heights[0], segMaxPlanes))
+	if nbPlanes < 0 {
+		s.err = ErrTranscoderSeg
+		return false
+	}
+	for p := 0; p < nbPlanes; p++ {
+		if int64(widths[p])*int64(heights[p]) > segMaxPlaneSize {
+			s.err = ErrTranscoderSeg
+			return false
+		}
+	}
+	if ret := int(C.av_frame_get_buffer(f, 0)); ret < 0 {
+		s.err = ErrorMap[ret]
+		return false
+	}
+	planes := (*[segMaxPlanes]*C.uint8_t)(unsafe.Pointer(f.extended_data))[:nbPlanes:nbPlanes]
+	linesize := int(f.linesize[0])
+	for p := 0; p < nbPlanes; p++ {
+		if f.nb_samples == 0 {
+			linesize = int(f.linesize[p])
+		}
+		width, rows := int(widths[p]), int(heights[p])
+		data := (*[1 << 30]byte)(unsafe.Pointer(planes[p]))
+		for y := 0; y < rows; y++ {
+			s.read(data[y*linesize : y*linesize+width : y*linesize+width])
+		}
+	}
+	return s.err == nil
+}
@@ -6,15 +6,21 @@
 
 #include <libavcodec/avcodec.h>
 #include <libavformat/avformat.h>
+#include <libavutil/imgutils.h>
+#include <libavutil/pixdesc.h>
+#include <libavutil/time.h>
 
 // Not great to appropriate internal API like this...
 const int lpms_ERR_INPUT_PIXFMT = FFERRTAG('I','N','P','X');
 const int lpms_ERR_INPUT_CODEC = FFERRTAG('I','N','P','C');
 const int lpms_ERR_FILTERS = FFERRTAG('F','L','T','R');
+const int lpms_ERR_FILTER_PARSE = FFERRTAG('F','L','P','S');
+const int lpms_ERR_FILTER_CONFIG = FFERRTAG('F','L','C','F');
 const int lpms_ERR_PACKET_ONLY = FFERRTAG('P','K','O','N');
 const int lpms_ERR_FILTER_FLUSHED = FFERRTAG('F','L','F','L');
 const int lpms_ERR_OUTPUTS = FFERRTAG('O','U','T','P');
 const int lpms_ERR_DTS = FFERRTAG('-','D','T','S');
+const int lpms_ERR_DFRAME_LIMIT = FFERRTAG('D','F','L','M');
 
 //
 //  Notes on transcoder internals:
@@ -66,18 +72,46 @@ const int lpms_ERR_DTS = FFERRTAG('-','D','T','S');
 //           avcodec_flush_buffers to flush the encoder.
 //
 
-#define MAX_OUTPUT_SIZE 10
-
 struct transcode_thread {
   int initialized;
 
+  // Set from another thread to abort the call in progress
+  volatile int interrupt;
+
   struct input_ctx ictx;
-  struct output_ctx outputs[MAX_OUTPUT_SIZE];
 
-  int nb_outputs;
+  // Output contexts persist between segments; allocated as needed
+  struct output_ctx *outputs;
+  int nb_outputs; // number of outputs in use
+  int max_outputs; // number of outputs allocated
 
+  // Decoded frames of the current segment; allocations are reused
+  dframe_buffer dframe_buf;
+
+  // Hardware encoder session shared between outputs
+  struct hw_session session;
 };
 
+// Makes sure there are at least nb_outputs output contexts. Existing
+// contexts are kept since they may hold sessions from previous segments.
+static int alloc_outputs(struct transcode_thread *h, int nb_outputs)
+{
+  int i = 0;
+  struct output_ctx *outputs = NULL;
+  if (nb_outputs <= h->max_outputs) return 0;
+  outputs = av_realloc_array(h->outputs, nb_outputs, sizeof(*outputs));
+  if (!outputs) return AVERROR(ENOMEM);
+  memset(outputs + h->max_outputs, 0,
+         (nb_outputs - h->max_outputs) * sizeof(*outputs));
+  for (i = h->max_outputs; i < nb_outputs; i++) {
+    outputs[i].interrupt_cb = h->ictx.interrupt_cb;
+    outputs[i].session = &h->session;
+  }
+  h->outputs = outputs;
+  h->max_outputs = nb_outputs;
+  return 0;
+}
+
 void lpms_init(enum LPMSLogLevel max_level)
 {
   av_log_set_level(max_level);
@@ -96,6 +130,7 @@ static int flush_outputs(struct input_ctx *ictx, struct output_ctx *octx)
   // only issue w this flushing method is it's not necessarily sequential
   // wrt all the outputs; might want to iterate on each output per frame?
   int ret = 0;
+  int64_t start = 0;
   if (octx->vc) { // flush video
     while (!ret || ret == AVERROR(EAGAIN)) {
       ret = process_out(ictx, octx, octx->vc, octx->oc->streams[octx->vi], &octx->vf, NULL);
@@ -107,8 +142,11 @@ static int flush_outputs(struct input_ctx *ictx, struct output_ctx *octx)
       ret = process_out(ictx, octx, octx->ac, octx->oc->streams[octx->ai], &octx->af, NULL);
     }
   }
+  start = av_gettime_relative();
   av_interleaved_write_frame(octx->oc, NULL); // flush muxer
-  return av_write_trailer(octx->oc);
+  ret = av_write_trailer(octx->oc);
+  octx->res->mux_us += av_gettime_relative() - start;
+  return ret;
 }
 
 static int flush_outputs1(struct decode_meta *dmeta, struct output_ctx *octx)
@@ -116,6 +154,7 @@ static int flush_outputs1(struct decode_meta *dmeta, struct output_ctx *octx)
   // only issue w this flushing method is it's not necessarily sequential
   // wrt all the outputs; might want to iterate on each output per frame?
   int ret = 0;
+  int64_t start = 0;
   if (octx->vc) { // flush video
     while (!ret || ret == AVERROR(EAGAIN)) {
       ret = process_out1(dmeta, octx, octx->vc, octx->oc->streams[octx->vi], &octx->vf, NULL);
@@ -127,58 +166,295 @@ static int flush_outputs1(struct decode_meta *dmeta, struct output_ctx *octx)
       ret = process_out1(dmeta, octx, octx->ac, octx->oc->streams[octx->ai], &octx->af, NULL);
     }
   }
+  start = av_gettime_relative();
   av_interleaved_write_frame(octx->oc, NULL); // flush muxer
-  return av_write_trailer(octx->oc);
+  ret = av_write_trailer(octx->oc);
+  octx->res->mux_us += av_gettime_relative() - start;
+  return ret;
 }
 
-int transcode(struct transcode_thread *h,
-  input_params *inp, output_params *params,
-  output_results *results, output_results *decoded_results)
+// Ensure the buffer has an entry at `idx`, growing it if necessary.
+// Fails with lpms_ERR_DFRAME_LIMIT once the ceiling `max` is reached.
+static int grow_dframe_buffer(dframe_buffer *dframe_buf, int idx, int max)
 {
-  int ret = 0, i = 0;
-  int reopen_decoders = 1;
-  struct input_ctx *ictx = &h->ictx;
-  struct output_ctx *outputs = h->outputs;
-  int nb_outputs = h->nb_outputs;
-  AVPacket ipkt = {0};
-  // AVFrame *dframe = NULL;
-  dframemeta dframe[MAX_DFRAME_CNT]; 
-  if (!inp) LPMS_ERR(transcode_cleanup, "Missing input params")
+  int ret = 0, cap = 0, i = 0;
+  dframemeta *dframes = NULL;
+  if (idx < dframe_buf->cap) return 0;
+  if (max <= 0) max = MAX_DFRAME_CNT;
+  if (idx >= max) return lpms_ERR_DFRAME_LIMIT;
+
+  cap = dframe_buf->cap ? dframe_buf->cap * 2 : DFRAME_BUFFER_INIT;
+  if (cap > max) cap = max;
+  dframes = realloc(dframe_buf->dframes, cap * sizeof(dframemeta));
+  if (!dframes) return AVERROR(ENOMEM);
+  dframe_buf->dframes = dframes;
+  for (i = dframe_buf->cap; i < cap; i++) {
+    memset(&dframes[i], 0, sizeof(dframemeta));
+    av_init_packet(&dframes[i].in_pkt);
+    dframes[i].dec_frame = av_frame_alloc();
+    if (!dframes[i].dec_frame) {
+      ret = AVERROR(ENOMEM);
+      break;
+    }
+  }
+  dframe_buf->cap = i; // only count fully initialized entries
+  return ret;
+}
+
+static void free_dframes(dframe_buffer *dframe_buf)
+{
+  for (int i = 0; i < dframe_buf->cap; i++) {
+    av_frame_free(&dframe_buf->dframes[i].dec_frame);
+    av_packet_unref(&dframe_buf->dframes[i].in_pkt);
+  }
+  free(dframe_buf->dframes);
+  dframe_buf->dframes = NULL;
+  dframe_buf->cnt = dframe_buf->cap = 0;
+}
+
+static int has_trim(input_params *inp)
+{
+  return inp->trim_in_us || inp->trim_out_us || inp->trim_in_frame || inp->trim_out_frame;
+}
+
+static int is_trimming(struct input_ctx *ictx)
+{
+  return AV_NOPTS_VALUE != ictx->trim_in || AV_NOPTS_VALUE != ictx->trim_out ||
+         ictx->trim_in_frame || ictx->trim_out_frame;
+}
+
+// Sets up the in and out points for the segment, seeking to the in point
+// if it is a time. Frames between the preceding keyframe and the in point
+// are still decoded, then dropped.
+static void init_trim(input_params *inp, struct input_ctx *ictx)
+{
+  AVFormatContext *ic = ictx->ic;
+  ictx->trim_in = inp->trim_in_us ? inp->trim_in_us : AV_NOPTS_VALUE;
+  ictx->trim_out = inp->trim_out_us ? inp->trim_out_us : AV_NOPTS_VALUE;
+  ictx->trim_in_frame = inp->trim_in_frame;
+  ictx->trim_out_frame = inp->trim_out_frame;
+  ictx->nb_video_frames = 0;
+  ictx->trim_done = 0;
+  if (AV_NOPTS_VALUE == ictx->trim_in || ictx->trim_in_frame) return;
+
+  int64_t ts = ictx->trim_in;
+  if (AV_NOPTS_VALUE != ic->start_time) ts += ic->start_time;
+  if (avformat_seek_file(ic, -1, INT64_MIN, ts, ts, 0) < 0) {
+    LPMS_WARN("Unable to seek to the in point; decoding from the start");
+    return;
+  }
+  // Discard anything decoded from before the seek
+  if (ictx->vc) avcodec_flush_buffers(ictx->vc);
+  if (ictx->ac) avcodec_flush_buffers(ictx->ac);
+  ictx->pkt_diff = 0;
+}
+
+// Timestamp in AV_TIME_BASE units from the start of the input
+static int64_t input_time(struct input_ctx *ictx, AVStream *ist, int64_t ts)
+{
+  if (AV_NOPTS_VALUE == ts) return AV_NOPTS_VALUE;
+  ts = av_rescale_q(ts, ist->time_base, AV_TIME_BASE_Q);
+  if (AV_NOPTS_VALUE != ictx->ic->start_time) ts -= ictx->ic->start_time;
+  return ts;
+}
 
+// Whether a decoded frame falls outside the in and out points
+static int trim_frame(struct input_ctx *ictx, AVStream *ist, AVFrame *frame)
+{
+  int is_video = ist->index == ictx->vi;
+  int64_t t = input_time(ictx, ist, frame->best_effort_timestamp);
+  if (is_video) {
+    int n = ictx->nb_video_frames++;
+    if (ictx->trim_in_frame) {
+      if (n < ictx->trim_in_frame) return 1;
+      // Audio is trimmed to the time of the first video frame
+      if (n == ictx->trim_in_frame) ictx->trim_in = t;
+    }
+    if (ictx->trim_out_frame && n >= ictx->trim_out_frame) {
+      if (AV_NOPTS_VALUE == ictx->trim_out) ictx->trim_out = t;
+      ictx->trim_done = 1;
+      return 1;
+    }
+  } else if (ictx->trim_in_frame && AV_NOPTS_VALUE == ictx->trim_in) {
+    return 1; // video hasn't reached the in point yet
+  }
+  if (AV_NOPTS_VALUE == t) return 0;
+  if (AV_NOPTS_VALUE != ictx->trim_in && t < ictx->trim_in) return 1;
+  if (AV_NOPTS_VALUE != ictx->trim_out && t >= ictx->trim_out) {
+    // Frames come out of the decoder in order, so the rest are past it too
+    if (is_video || ictx->vi < 0) ictx->trim_done = 1;
+    return 1;
+  }
+  return 0;
+}
+
+// Whether a packet falls outside the in and out points. Only used for
+// stream copy, which can't be trimmed more precisely than packets.
+static int trim_packet(struct input_ctx *ictx, AVStream *ist, AVPacket *pkt)
+{
+  int64_t t = input_time(ictx, ist, pkt->pts);
+  if (AV_NOPTS_VALUE == t) return 0;
+  if (ictx->trim_in_frame && AV_NOPTS_VALUE == ictx->trim_in) return 1;
+  if (AV_NOPTS_VALUE != ictx->trim_in && t < ictx->trim_in) return 1;
+  if (AV_NOPTS_VALUE != ictx->trim_out && t >= ictx->trim_out) return 1;
+  return 0;
+}
+
+// Reopens the demuxer and decoders for a new segment if necessary
+static int reopen_input(input_params *inp, struct input_ctx *ictx)
+{
+  int ret = 0;
+  int reopen_decoders = 1;
+  // In and out points are relative to the start of this input, so a
+  // demuxer carried over from the previous segment has to be probed afresh
+  if (ictx->ic && !ictx->ic->pb && has_trim(inp)) close_demuxer(ictx);
   // by default we re-use decoder between segments of same stream
   // unless we are using SW deocder and had to re-open IO or demuxer
   if (!ictx->ic) {
     // reopen demuxer for the input segment if needed
-    // XXX could open_input() be re-used here?
-    ret = avformat_open_input(&ictx->ic, inp->fname, NULL, NULL);
-    if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen demuxer");
-    ret = avformat_find_stream_info(ictx->ic, NULL);
-    if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to find info for reopened stream")
+    ret = open_demuxer(inp, ictx);
+    if (ret < 0) LPMS_ERR(reopen_input_err, "Unable to reopen demuxer");
   } else if (!ictx->ic->pb) {
-    // reopen input segment file IO context if needed
-    ret = avio_open(&ictx->ic->pb, inp->fname, AVIO_FLAG_READ);
-    if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen file");
+    // reopen input segment IO context if needed
+    ret = open_input_io(inp, ictx);
+    if (ret < 0) LPMS_ERR(reopen_input_err, "Unable to reopen input");
   } else reopen_decoders = 0;
   if (reopen_decoders) {
     // XXX check to see if we can also reuse decoder for sw decoding
     if (AV_HWDEVICE_TYPE_CUDA != ictx->hw_type) {
       ret = open_video_decoder(inp, ictx);
-      if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen video decoder");
+      if (ret < 0) LPMS_ERR(reopen_input_err, "Unable to reopen video decoder");
     }
     ret = open_audio_decoder(inp, ictx);
-    if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen audio decoder")
+    if (ret < 0) LPMS_ERR(reopen_input_err, "Unable to reopen audio decoder")
   }
+  init_trim(inp, ictx);
+reopen_input_err:
+  return ret;
+}
+
+// Prepares the input for the next segment
+static void reset_input(struct input_ctx *ictx)
+{
+  if (ictx->ic) {
+    // Only mpegts reuse the demuxer for subsequent segments.
+    // Close the demuxer for everything else. Audio-only segments are also
+    // closed so streams get probed again in case video starts next segment,
+    // as are trimmed segments which may have been left partway through.
+    // TODO might be reusable with fmp4 ; check!
+    if (!is_mpegts(ictx->ic) || ictx->vi < 0 || is_trimming(ictx)) close_demuxer(ictx);
+    else if (ictx->ic->pb) {
+      // Reset leftovers from demuxer internals to prepare for next segment
+      avio_flush(ictx->ic->pb);
+      avformat_flush(ictx->ic);
+    }
+  }
+  // In-memory input also needs closing if the demuxer couldn't be opened
+  close_input_io(ictx);
+  ictx->flushed = 0;
+  ictx->flushing = 0;
+  ictx->pkt_diff = 0;
+  ictx->sentinel_count = 0;
+  ictx->trim_in = ictx->trim_out = AV_NOPTS_VALUE;
+  ictx->trim_in_frame = ictx->trim_out_frame = 0;
+  if (ictx->first_pkt) av_packet_free(&ictx->first_pkt);
+  if (ictx->ac) avcodec_free_context(&ictx->ac);
+  if (ictx->vc && AV_HWDEVICE_TYPE_NONE == ictx->hw_type) avcodec_free_context(&ictx->vc);
+}
+
+// Reads the next decoded frame into `df`. Packets are kept even if nothing
+// was decoded since they're needed for stream copy.
+// Returns AVERROR_EOF once the segment is exhausted.
+static int decode_frame(struct input_ctx *ictx, dframemeta *df, output_results *decoded_results)
+{
+  int ret = 0;
+  while (1) {
+    // DEMUXING & DECODING
+    int has_frame = 0;
+    AVStream *ist = NULL;
+    AVFrame *last_frame = NULL;
+    av_frame_unref(df->dec_frame);
+    av_packet_unref(&df->in_pkt);
+    if (is_interrupted(&ictx->interrupt_cb)) return AVERROR_EXIT;
+
+    int64_t start = av_gettime_relative();
+    ret = process_in(ictx, df->dec_frame, &df->in_pkt);
+    decoded_results->decode_us += av_gettime_relative() - start;
+    // an interrupted read may look like the end of the segment
+    if (ret == AVERROR_EOF) return is_interrupted(&ictx->interrupt_cb) ? AVERROR_EXIT : ret;
+                            // Bail out on streams that appear to be broken
+    else if (lpms_ERR_PACKET_ONLY == ret) ; // keep going for stream copy
+    else if (ret < 0) LPMS_ERR(decode_frame_err, "Could not decode; stopping");
+    ist = ictx->ic->streams[df->in_pkt.stream_index];
+    has_frame = lpms_ERR_PACKET_ONLY != ret;
+    if (AVMEDIA_TYPE_VIDEO == ist->codecpar->codec_type) {
+      if (is_flush_frame(df->dec_frame)) continue;
+      // width / height will be zero for pure streamcopy (no decoding)
+      decoded_results->frames += df->dec_frame->width && df->dec_frame->height;
+      decoded_results->pixels += df->dec_frame->width * df->dec_frame->height;
+      has_frame = has_frame && df->dec_frame->width && df->dec_frame->height;
+      if (has_frame) last_frame = ictx->last_frame_v;
+    } else if (AVMEDIA_TYPE_AUDIO == ist->codecpar->codec_type) {
+      has_frame = has_frame && df->dec_frame->nb_samples;
+      if (has_frame) last_frame = ictx->last_frame_a;
+    }
+    if (is_trimming(ictx)) {
+      if (has_frame && trim_frame(ictx, ist, df->dec_frame)) {
+        has_frame = 0;
+        av_frame_unref(df->dec_frame);
+      }
+      if (trim_packet(ictx, ist, &df->in_pkt)) av_packet_unref(&df->in_pkt);
+      // Stop reading once past the out point. Hardware decoders are kept
+      // between segments, so those still need to be drained as usual.
+      if (ictx->trim_done && AV_HWDEVICE_TYPE_CUDA != ictx->hw_type) return AVERROR_EOF;
+    }
+    df->has_frame = has_frame;
+    if (has_frame) {
+      int64_t dur = 0;
+      if (df->dec_frame->pkt_duration) dur = df->dec_frame->pkt_duration;
+      else if (ist->r_frame_rate.den) {
+        dur = av_rescale_q(1, av_inv_q(ist->r_frame_rate), ist->time_base);
+      } else {
+        // TODO use better heuristics for this; look at how ffmpeg does it
+        LPMS_WARN("Could not determine next pts; filter might drop");
+      }
+      df->dec_frame->pkt_duration = dur;
+      av_frame_unref(last_frame);
+      av_frame_ref(last_frame, df->dec_frame);
+    }
+    if (has_frame || df->in_pkt.pts != AV_NOPTS_VALUE) return 0;
+  }
+decode_frame_err:
+  return ret;
+}
+
+int transcode(struct transcode_thread *h,
+  input_params *inp, output_params *params,
+  output_results *results, output_results *decoded_results)
+{
+  int ret = 0, i = 0;
+  struct input_ctx *ictx = &h->ictx;
+  struct output_ctx *outputs = h->outputs;
+  int nb_outputs = h->nb_outputs;
+  dframe_buffer *dframe_buf = &h->dframe_buf;
+  dframemeta *dframe = NULL;
+  if (!inp) LPMS_ERR(transcode_cleanup, "Missing input params")
+
+  ret = reopen_input(inp, ictx);
+  if (ret < 0) goto transcode_cleanup;
 
   // populate output contexts
   for (i = 0; i <  nb_outputs; i++) {
       struct output_ctx *octx = &outputs[i];
       octx->fname = params[i].fname;
+      octx->to_memory = params[i].to_memory;
       octx->width = params[i].w;
       octx->height = params[i].h;
       octx->muxer = &params[i].muxer;
       octx->audio = &params[i].audio;
       octx->video = &params[i].video;
       octx->vfilters = params[i].vfilters;
+      octx->afilters = params[i].afilters;
       if (params[i].bitrate) octx->bitrate = params[i].bitrate;
       if (params[i].fps.den) octx->fps = params[i].fps;
       if (params[i].gop_time) octx->gop_time = params[i].gop_time;
@@ -199,55 +475,17 @@ int transcode(struct transcode_thread *h,
       if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to re-open output for HW session");
   }
 
-  for(int dfcount=0; dfcount < MAX_DFRAME_CNT; dfcount++){
-    dframe[dfcount].dec_frame = av_frame_alloc();
-    av_init_packet(&dframe[dfcount].in_pkt);
-    if (!dframe[dfcount].dec_frame) LPMS_ERR(transcode_cleanup, "Unable to allocate frame");
-  }
   int dfcount = 0;
   while (1) {
-    // DEMUXING & DECODING
-    int has_frame = 0;
-    AVStream *ist = NULL;
-    AVFrame *last_frame = NULL;
-    av_frame_unref(dframe[dfcount].dec_frame);
-
-    ret = process_in(ictx, dframe[dfcount].dec_frame, &dframe[dfcount].in_pkt);
+    ret = grow_dframe_buffer(dframe_buf, dfcount, inp->max_frames);
+    if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to buffer decoded frame");
+    dframe = dframe_buf->dframes; // may have moved
+    ret = decode_frame(ictx, &dframe[dfcount], decoded_results);
     if (ret == AVERROR_EOF) break;
-                            // Bail out on streams that appear to be broken
-    else if (lpms_ERR_PACKET_ONLY == ret) ; // keep going for stream copy
-    else if (ret < 0) LPMS_ERR(transcode_cleanup, "Could not decode; stopping");
-    ist = ictx->ic->streams[dframe[dfcount].in_pkt.stream_index];
-    has_frame = lpms_ERR_PACKET_ONLY != ret;
-    dframe[dfcount].has_frame = has_frame;  //nick
-    if (AVMEDIA_TYPE_VIDEO == ist->codecpar->codec_type) {
-      if (is_flush_frame(dframe[dfcount].dec_frame)) continue;
-      // width / height will be zero for pure streamcopy (no decoding)
-      decoded_results->frames += dframe[dfcount].dec_frame->width && dframe[dfcount].dec_frame->height;
-      decoded_results->pixels += dframe[dfcount].dec_frame->width * dframe[dfcount].dec_frame->height;
-      has_frame = has_frame && dframe[dfcount].dec_frame->width && dframe[dfcount].dec_frame->height;
-      dframe[dfcount].has_frame = has_frame;
-      if (has_frame) last_frame = ictx->last_frame_v;
-    } else if (AVMEDIA_TYPE_AUDIO == ist->codecpar->codec_type) {
-      has_frame = has_frame && dframe[dfcount].dec_frame->nb_samples;
-      dframe[dfcount].has_frame = has_frame;
-      if (has_frame) last_frame = ictx->last_frame_a;
-    }
-    if (has_frame) {
-      int64_t dur = 0;
-      if (dframe[dfcount].dec_frame->pkt_duration) dur = dframe[dfcount].dec_frame->pkt_duration;
-      else if (ist->r_frame_rate.den) {
-        dur = av_rescale_q(1, av_inv_q(ist->r_frame_rate), ist->time_base);
-      } else {
-        // TODO use better heuristics for this; look at how ffmpeg does it
-        LPMS_WARN("Could not determine next pts; filter might drop");
-      }
-      dframe[dfcount].dec_frame->pkt_duration = dur;
-      av_frame_unref(last_frame);
-      av_frame_ref(last_frame, dframe[dfcount].dec_frame);
-      dfcount++;
-    }
+    else if (ret < 0) goto transcode_cleanup;
+    dfcount++;
   }
+  dframe_buf->cnt = dfcount;
   
   for (i = 0; i < nb_outputs; i++) {
     struct output_ctx *octx = &outputs[i];
@@ -258,6 +496,10 @@ int transcode(struct transcode_thread *h,
     int rewind_flag = 0;
     for(int cnt=0; cnt < dfcount; cnt++){
       ret = 0; // reset to avoid any carry-through
+      if (is_interrupted(&octx->interrupt_cb)) {
+        ret = AVERROR_EXIT;
+        goto transcode_cleanup;
+      }
       ist = ictx->ic->streams[dframe[cnt].in_pkt.stream_index];
       if (ist->index == ictx->vi) {
         if (octx->dv) continue; // drop video stream for this output
@@ -296,33 +538,11 @@ int transcode(struct transcode_thread *h,
     ret = flush_outputs(ictx, &outputs[i]);
     if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to fully flush outputs")
   }
-  for(int j=0; j < dfcount; j++)
-    av_packet_unref(&dframe[j].in_pkt);
 
 transcode_cleanup:
-  if (ictx->ic) {
-    // Only mpegts reuse the demuxer for subsequent segments.
-    // Close the demuxer for everything else.
-    // TODO might be reusable with fmp4 ; check!
-    if (!is_mpegts(ictx->ic)) avformat_close_input(&ictx->ic);
-    else if (ictx->ic->pb) {
-      // Reset leftovers from demuxer internals to prepare for next segment
-      avio_flush(ictx->ic->pb);
-      avformat_flush(ictx->ic);
-      avio_closep(&ictx->ic->pb);
-    }
-  }
-  for (int j=0; j < MAX_DFRAME_CNT; j++){
-    if (dframe[j].dec_frame) av_frame_free(&(dframe[j].dec_frame));
-  }
-  ictx->flushed = 0;
-  ictx->flushing = 0;
-  ictx->pkt_diff = 0;
-  ictx->sentinel_count = 0;
-  av_packet_unref(&ipkt);  // needed for early exits
-  if (ictx->first_pkt) av_packet_free(&ictx->first_pkt);
-  if (ictx->ac) avcodec_free_context(&ictx->ac);
-  if (ictx->vc && AV_HWDEVICE_TYPE_NONE == ictx->hw_type) avcodec_free_context(&ictx->vc);
+  reset_input(ictx);
+  // Drop frame references but keep the allocations for the next segment
+  reset_dframe_buffer(dframe_buf);
   for (i = 0; i < nb_outputs; i++) close_output(&outputs[i]);
   return ret == AVERROR_EOF ? 0 : ret;
 }
@@ -336,9 +556,8 @@ int lpms_transcode(input_params *inp, output_params *params,
   if (!h->initialized) {
     int i = 0;
     int decode_a = 0, decode_v = 0;
-    if (nb_outputs > MAX_OUTPUT_SIZE) {
-      return lpms_ERR_OUTPUTS;
-    }
+    ret = alloc_outputs(h, nb_outputs);
+    if (ret < 0) return ret;
 
     // Check to see if we can skip decoding
     for (i = 0; i < nb_outputs; i++) {
@@ -365,14 +584,38 @@ int lpms_transcode(input_params *inp, output_params *params,
   return ret;
 }
 
+static int transcode_interrupted(void *opaque)
+{
+  struct transcode_thread *h = opaque;
+  return h->interrupt;
+}
+
 struct transcode_thread* lpms_transcode_new() {
-  printf("new transcoder created\n");
   struct transcode_thread *h = malloc(sizeof (struct transcode_thread));
   if (!h) return NULL;
   memset(h, 0, sizeof *h);
+  AVIOInterruptCB cb = { .callback = transcode_interrupted, .opaque = h };
+  h->ictx.interrupt_cb = cb;
   return h;
 }
 
+void lpms_transcode_interrupt(struct transcode_thread *h, int interrupt)
+{
+  h->interrupt = interrupt;
+}
+
+int lpms_hw_sessions(struct transcode_thread *h)
+{
+  int i = 0, j = 0, n = 0;
+  for (i = 0; i < h->max_outputs; i++) {
+    AVCodecContext *vc = h->outputs[i].vc;
+    if (!vc || AV_HWDEVICE_TYPE_NONE == h->outputs[i].hw_type) continue;
+    for (j = 0; j < i && h->outputs[j].vc != vc; j++);
+    if (j == i) n++;
+  }
+  return n;
+}
+
 void lpms_transcode_stop(struct transcode_thread *handle) {
   // not threadsafe as-is; calling function must ensure exclusivity!
 
@@ -381,277 +624,186 @@ void lpms_transcode_stop(struct transcode_thread *handle) {
   if (!handle) return;
 
   free_input(&handle->ictx);
-  for (i = 0; i < MAX_OUTPUT_SIZE; i++) {
-    if(&handle->outputs[i]) {
-      free_output(&handle->outputs[i]);
-    }
+  free_dframes(&handle->dframe_buf);
+  for (i = 0; i < handle->max_outputs; i++) {
+    struct output_ctx *octx = &handle->outputs[i];
+    free_output(octx);
+    // Hardware encoders outlive segments; the shared one is freed below
+    if (octx->vc != handle->session.vc) avcodec_free_context(&octx->vc);
   }
+  av_free(handle->outputs);
+  avcodec_free_context(&handle->session.vc);
+  av_dict_free(&handle->session.opts);
 
   free(handle);
 }
 
 
-int lpms_encode(input_params *inp, dframe_buffer *dframe_buffer, output_params *params,
-  output_results *results, int nb_outputs, output_results *decoded_results, struct decode_meta *dmeta)
+static int open_outputs1(input_params *inp, output_params *params,
+  output_results *results, int nb_outputs, struct decode_meta *dmeta, int share_session)
 {
   int ret = 0, i = 0;
+  int session_used = 0; // by an output of this call
   struct transcode_thread *h = inp->handle;
-  // struct transcode_thread *dec_handle = inp->dec_handle;
+  struct output_ctx *outputs = NULL;
+  ret = alloc_outputs(h, nb_outputs);
+  if (ret < 0) return ret;
+  outputs = h->outputs;
   h->nb_outputs = nb_outputs;
-  int reopen_decoders = 1;
-  struct input_ctx *ictx = &h->ictx;
-  // printf("drop audio enc %d %x lastframe=%x\n", ictx->da, ictx->ic, ictx->last_frame_v);
-  struct output_ctx *outputs = h->outputs;
-  AVPacket ipkt = {0};
   // populate output contexts
   for (i = 0; i <  nb_outputs; i++) {
       struct output_ctx *octx = &outputs[i];
       octx->fname = params[i].fname;
+      octx->to_memory = params[i].to_memory;
       octx->width = params[i].w;
       octx->height = params[i].h;
       octx->muxer = &params[i].muxer;
       octx->audio = &params[i].audio;
       octx->video = &params[i].video;
       octx->vfilters = params[i].vfilters;
+      octx->afilters = params[i].afilters;
       if (params[i].bitrate) octx->bitrate = params[i].bitrate;
       if (params[i].fps.den) octx->fps = params[i].fps;
       if (params[i].gop_time) octx->gop_time = params[i].gop_time;
-      octx->dv = ictx->vi < 0 || is_drop(octx->video->name);
-      // octx->da = ictx->ai < 0 || is_drop(octx->audio->name);
-      octx->da = 1;   // temporary fix to force drop audio
+      octx->dv = dmeta->vi < 0 || is_drop(octx->video->name);
+      octx->da = dmeta->ai < 0 || is_drop(octx->audio->name);
       octx->res = &results[i];
+      // Interleaved outputs can't take turns on the shared session, so at
+      // most one of them uses it
+      octx->share_session = share_session || !session_used;
+      if (h->initialized && !octx->share_session && octx->vc &&
+          octx->vc == h->session.vc) {
+        // shared with another output in an earlier call; open its own
+        octx->vc = NULL;
+        octx->hw_type = AV_HWDEVICE_TYPE_NONE;
+      }
       // first segment of a stream, need to initalize output HW context
       // XXX valgrind this line up
       if (!h->initialized || AV_HWDEVICE_TYPE_NONE == octx->hw_type) {
-        ret = open_output(octx, ictx);
-        if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to open output");
-        continue;
-      }
-      // non-first segment of a HW session
-      ret = reopen_output(octx, ictx);
-      if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to re-open output for HW session");
-  }
-
-  for (i = 0; i < nb_outputs; i++) {
-    struct output_ctx *octx = &outputs[i];
-    struct filter_ctx *filter = NULL;
-    AVStream *ost = NULL;
-    AVStream *ist = NULL;
-    AVCodecContext *encoder = NULL;
-    int rewind_flag = 0;
-    for(int cnt=0; cnt < dframe_buffer->cnt; cnt++){
-      ret = 0; // reset to avoid any carry-through
-      ist = ictx->ic->streams[dframe_buffer->dframes[cnt].in_pkt.stream_index];
-      if (ist->index == ictx->vi) {
-        if (octx->dv) continue; // drop video stream for this output
-                
-        ost = octx->oc->streams[0];
-        if (ictx->vc) {
-          encoder = octx->vc;
-          filter = &octx->vf;
-        }
-      } else if (ist->index == ictx->ai) {
-        if (octx->da) continue; // drop audio stream for this output
-        ost = octx->oc->streams[!octx->dv]; // depends on whether video exists
-        if (ictx->ac) {
-          encoder = octx->ac;
-          filter = &octx->af;
-        }
-      } else continue; // dropped or unrecognized stream
-
-      if (!encoder && ost) {
-        // stream copy
-        AVPacket *pkt;
-        // we hit this case when decoder is flushing; will be no input packet
-        // (we don't need decoded frames since this stream is doing a copy)
-        if (dframe_buffer->dframes[cnt].in_pkt.pts == AV_NOPTS_VALUE) continue;
-
-        pkt = av_packet_clone(&dframe_buffer->dframes[cnt].in_pkt);
-        if (!pkt) LPMS_ERR(transcode_cleanup, "Error allocating packet for copy");
-        ret = mux(pkt, ist->time_base, octx, ost);
-        av_packet_free(&pkt);
-      } else if (dframe_buffer->dframes[cnt].has_frame) {
-        ret = process_out(ictx, octx, encoder, ost, filter, dframe_buffer->dframes[cnt].dec_frame);
+        ret = open_output1(octx, dmeta);
+        if (ret < 0) LPMS_ERR(open_outputs_err, "Unable to open output");
+      } else {
+        // non-first segment of a HW session
+        ret = reopen_output1(octx, dmeta);
+        if (ret < 0) LPMS_ERR(open_outputs_err, "Unable to re-open output for HW session");
       }
-      if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) continue;
-      else if (ret < 0) LPMS_ERR(transcode_cleanup, "Error encoding");
-    }
-    ret = flush_outputs(ictx, &outputs[i]);
-    if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to fully flush outputs")
+      if (octx->vc && octx->vc == h->session.vc) session_used = 1;
   }
-  for(int j=0; j < dframe_buffer->cnt; j++)
-    av_packet_unref(&dframe_buffer->dframes[j].in_pkt);
-  // if(dframe_buffer->dframes != NULL)
-  //   free(dframe_buffer->dframes);
+  return 0;
 
-transcode_cleanup:
-  // if (ictx->ic) {
-  //   // Only mpegts reuse the demuxer for subsequent segments.
-  //   // Close the demuxer for everything else.
-  //   // TODO might be reusable with fmp4 ; check!
-  //   if (!is_mpegts(ictx->ic)) avformat_close_input(&ictx->ic);
-  //   else if (ictx->ic->pb) {
-  //     // Reset leftovers from demuxer internals to prepare for next segment
-  //     avio_flush(ictx->ic->pb);
-  //     avformat_flush(ictx->ic);
-  //     avio_closep(&ictx->ic->pb);
-  //   }
-  // }
-  for (int j=0; j < MAX_DFRAME_CNT; j++){
-    if (dframe_buffer->dframes[j].dec_frame) av_frame_free(&(dframe_buffer->dframes[j].dec_frame));
-  }
-  // ictx->flushed = 0;
-  // ictx->flushing = 0;
-  // ictx->pkt_diff = 0;
-  // ictx->sentinel_count = 0;
-  // av_packet_unref(&ipkt);  // needed for early exits
-  // if (ictx->first_pkt) av_packet_free(&ictx->first_pkt);
-  // if (ictx->ac) avcodec_free_context(&ictx->ac);
-  // if (ictx->vc && AV_HWDEVICE_TYPE_NONE == ictx->hw_type) avcodec_free_context(&ictx->vc);
+open_outputs_err:
   for (i = 0; i < nb_outputs; i++) close_output(&outputs[i]);
   h->initialized = 1;
-  return ret == AVERROR_EOF ? 0 : ret;
+  return ret;
 }
 
+// Sends a single decoded frame (or packet for stream copy) to an output
+static int encode_frame1(struct output_ctx *octx, dframemeta *df, struct decode_meta *dmeta)
+{
+  int ret = 0;
+  struct filter_ctx *filter = NULL;
+  AVStream *ost = NULL;
+  AVRational ist_tb;
+  AVCodecContext *encoder = NULL;
+  int stream_index = df->in_pkt.stream_index;
+  if (is_interrupted(&octx->interrupt_cb)) return AVERROR_EXIT;
+  if (stream_index == dmeta->vi) {
+    if (octx->dv) return 0; // drop video stream for this output
+    ost = octx->oc->streams[0];
+    ist_tb = dmeta->time_base;
+    encoder = octx->vc;
+    filter = &octx->vf;
+  } else if (stream_index == dmeta->ai) {
+    if (octx->da) return 0; // drop audio stream for this output
+    ost = octx->oc->streams[!octx->dv]; // depends on whether video exists
+    ist_tb = dmeta->a_time_base;
+    encoder = octx->ac;
+    filter = &octx->af;
+  } else return 0; // dropped or unrecognized stream
+
+  if (!encoder && ost) {
+    // stream copy
+    AVPacket *pkt;
+    // we hit this case when decoder is flushing; will be no input packet
+    // (we don't need decoded frames since this stream is doing a copy)
+    if (df->in_pkt.pts == AV_NOPTS_VALUE) return 0;
+
+    pkt = av_packet_clone(&df->in_pkt);
+    if (!pkt) LPMS_ERR(encode_frame_err, "Error allocating packet for copy");
+    ret = mux(pkt, ist_tb, octx, ost);
+    av_packet_free(&pkt);
+  } else if (df->has_frame) {
+    ret = process_out1(dmeta, octx, encoder, ost, filter, df->dec_frame);
+  }
+  if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) return 0;
+  else if (ret < 0) LPMS_ERR(encode_frame_err, "Error encoding");
+encode_frame_err:
+  return ret;
+}
 
 int lpms_encode1(input_params *inp, dframe_buffer *dframe_buffer, output_params *params,
   output_results *results, int nb_outputs, output_results *decoded_results, struct decode_meta *dmeta)
 {
   int ret = 0, i = 0;
   struct transcode_thread *h = inp->handle;
-  h->nb_outputs = nb_outputs;
-  int reopen_decoders = 1;
-  
-  // printf("device=%s, initialized=%d\n", inp->device, inp->handle->initialized);
-  
-  struct output_ctx *outputs = h->outputs;
-  AVPacket ipkt = {0};
-  // populate output contexts
-  for (i = 0; i <  nb_outputs; i++) {
-      struct output_ctx *octx = &outputs[i];
-      octx->fname = params[i].fname;
-      octx->width = params[i].w;
-      octx->height = params[i].h;
-      octx->muxer = &params[i].muxer;
-      octx->audio = &params[i].audio;
-      octx->video = &params[i].video;
-      octx->vfilters = params[i].vfilters;
-      if (params[i].bitrate) octx->bitrate = params[i].bitrate;
-      if (params[i].fps.den) octx->fps = params[i].fps;
-      if (params[i].gop_time) octx->gop_time = params[i].gop_time;
-      octx->dv = dmeta->vi < 0 || is_drop(octx->video->name);
-      // octx->da = ictx->ai < 0 || is_drop(octx->audio->name);
-      octx->da = 1;   // temporary fix to force drop audio
-      octx->res = &results[i];
-      // first segment of a stream, need to initalize output HW context
-      // XXX valgrind this line up
-      if (!h->initialized || AV_HWDEVICE_TYPE_NONE == octx->hw_type) {
-        printf("device=%s, initialized=%d\n", inp->device, inp->handle->initialized);
-        ret = open_output1(octx, dmeta);
-        if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to open output");
-        continue;
-      }
-      // non-first segment of a HW session
-      ret = reopen_output1(octx, dmeta);
-      if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to re-open output for HW session");
-  }
+  struct output_ctx *outputs = NULL;
+
+  // Outputs are encoded one after another, so they can share a HW session
+  ret = open_outputs1(inp, params, results, nb_outputs, dmeta, 1);
+  if (ret < 0) return ret;
+  outputs = h->outputs; // may have been reallocated
 
   for (i = 0; i < nb_outputs; i++) {
     struct output_ctx *octx = &outputs[i];
-    struct filter_ctx *filter = NULL;
-    AVStream *ost = NULL;
-    AVStream *ist = NULL;
-    AVCodecContext *encoder = NULL;
-    int rewind_flag = 0;
-    clock_t t;
-    t = clock();
     for(int cnt=0; cnt < dframe_buffer->cnt; cnt++){
-      ret = 0; // reset to avoid any carry-through
-      // ist = ictx->ic->streams[dframe_buffer->dframes[cnt].in_pkt.stream_index];
-      int stream_index;
-      stream_index = dframe_buffer->dframes[cnt].in_pkt.stream_index;
-      if (stream_index == dmeta->vi) {
-        if (octx->dv) continue; // drop video stream for this output
-                
-        ost = octx->oc->streams[0];
-        // if (ictx->vc) {
-          encoder = octx->vc;
-          filter = &octx->vf;
-        // }
-      } else if (stream_index == dmeta->ai) {
-        if (octx->da) continue; // drop audio stream for this output
-        ost = octx->oc->streams[!octx->dv]; // depends on whether video exists
-        // if (ictx->ac) {
-          encoder = octx->ac;
-          filter = &octx->af;
-        // }
-      } else continue; // dropped or unrecognized stream
-
-      if (!encoder && ost) {
-        // stream copy
-        AVPacket *pkt;
-        // we hit this case when decoder is flushing; will be no input packet
-        // (we don't need decoded frames since this stream is doing a copy)
-        if (dframe_buffer->dframes[cnt].in_pkt.pts == AV_NOPTS_VALUE) continue;
-
-        pkt = av_packet_clone(&dframe_buffer->dframes[cnt].in_pkt);
-        if (!pkt) LPMS_ERR(transcode_cleanup, "Error allocating packet for copy");
-        ret = mux(pkt, ist->time_base, octx, ost);
-        av_packet_free(&pkt);
-      } else if (dframe_buffer->dframes[cnt].has_frame) {
-        ret = process_out1(dmeta, octx, encoder, ost, filter, dframe_buffer->dframes[cnt].dec_frame);
-      }
-      if (AVERROR(EAGAIN) == ret || AVERROR_EOF == ret) continue;
-      else if (ret < 0) LPMS_ERR(transcode_cleanup, "Error encoding");
+      ret = encode_frame1(octx, &dframe_buffer->dframes[cnt], dmeta);
+      if (ret < 0) goto transcode_cleanup;
     }
     ret = flush_outputs1(dmeta, &outputs[i]);
-    t = clock() - t;
-    float time_taken = ((float)t)/(CLOCKS_PER_SEC/1000); 
-    printf("Encoding segment %d x %d took %f milli seconds\n", octx->width, octx->height, time_taken);
     if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to fully flush outputs")
   }
-  for(int j=0; j < dframe_buffer->cnt; j++)
-    av_packet_unref(&dframe_buffer->dframes[j].in_pkt);
-
 
 transcode_cleanup:
-  // if (ictx->ic) {
-  //   // Only mpegts reuse the demuxer for subsequent segments.
-  //   // Close the demuxer for everything else.
-  //   // TODO might be reusable with fmp4 ; check!
-  //   if (!is_mpegts(ictx->ic)) avformat_close_input(&ictx->ic);
-  //   else if (ictx->ic->pb) {
-  //     // Reset leftovers from demuxer internals to prepare for next segment
-  //     avio_flush(ictx->ic->pb);
-  //     avformat_flush(ictx->ic);
-  //     avio_closep(&ictx->ic->pb);
-  //   }
-  // }
-  
-  // free dframes
-  for (int j=0; j < MAX_DFRAME_CNT; j++){
-    if (dframe_buffer->dframes[j].dec_frame) {
-      // printf("freeing dframes j=%d\n", j);
-      av_frame_free(&(dframe_buffer->dframes[j].dec_frame));
-    }
-  }
-  if (dframe_buffer->dframes){
-    free(dframe_buffer->dframes);
-  }
-  // ictx->flushed = 0;
-  // ictx->flushing = 0;
-  // ictx->pkt_diff = 0;
-  // ictx->sentinel_count = 0;
-  av_packet_unref(&ipkt);  // needed for early exits
-  if(dmeta->last_frame_v) av_frame_free(&dmeta->last_frame_v);
-  // if (ictx->first_pkt) av_packet_free(&ictx->first_pkt);
-  // if (ictx->ac) avcodec_free_context(&ictx->ac);
-  // if (ictx->vc && AV_HWDEVICE_TYPE_NONE == ictx->hw_type) avcodec_free_context(&ictx->vc);
+  // The decoded frames and metadata are owned by the caller and may be
+  // shared with other encoders, so leave them untouched here.
   for (i = 0; i < nb_outputs; i++) close_output(&outputs[i]);
   h->initialized = 1;
   return ret == AVERROR_EOF ? 0 : ret;
 }
 
+int lpms_encode_begin(input_params *inp, output_params *params,
+  output_results *results, int nb_outputs, struct decode_meta *dmeta)
+{
+  // Frames are interleaved between outputs, so only one of them may use the
+  // shared session. The others keep their own sessions between calls.
+  return open_outputs1(inp, params, results, nb_outputs, dmeta, 0);
+}
+
+int lpms_encode_frame(input_params *inp, dframemeta *df, struct decode_meta *dmeta)
+{
+  int ret = 0, i = 0;
+  struct transcode_thread *h = inp->handle;
+  for (i = 0; i < h->nb_outputs; i++) {
+    ret = encode_frame1(&h->outputs[i], df, dmeta);
+    if (ret < 0) return ret;
+  }
+  return 0;
+}
+
+int lpms_encode_end(input_params *inp, struct decode_meta *dmeta, int flush)
+{
+  int ret = 0, i = 0;
+  struct transcode_thread *h = inp->handle;
+  for (i = 0; flush && i < h->nb_outputs; i++) {
+    ret = flush_outputs1(dmeta, &h->outputs[i]);
+    if (ret < 0) LPMS_ERR(encode_end_err, "Unable to fully flush outputs")
+  }
+encode_end_err:
+  for (i = 0; i < h->nb_outputs; i++) close_output(&h->outputs[i]);
+  h->initialized = 1;
+  return ret == AVERROR_EOF ? 0 : ret;
+}
+
 void copy_ictx(struct input_ctx *dest, struct input_ctx *src){
   dest->vi = src->vi;
   dest->ai = src->ai;
@@ -715,184 +867,329 @@ void set_ictx(struct transcode_thread *h, struct input_ctx *ictx){
 };
 
 void set_dmeta(struct decode_meta *dmeta, struct input_ctx *ictx){
-  dmeta->v_width = ictx->vc->width;
-  dmeta->v_height = ictx->vc->height;
   dmeta->vi = ictx->vi;
   dmeta->ai = ictx->ai;
-  dmeta->in_pix_fmt = ictx->vc->pix_fmt;
-  dmeta->time_base = ictx->ic->streams[ictx->vi]->time_base;
-  dmeta->sample_aspect_ratio = ictx->vc->sample_aspect_ratio;
-  dmeta->r_frame_rate = ictx->ic->streams[ictx->vi]->r_frame_rate;
-  dmeta->framerate = ictx->vc->framerate;
   dmeta->hw_type = ictx->hw_type;
-  dmeta->hw_frames_ctx = ictx->vc->hw_frames_ctx;
+  if (ictx->vi >= 0) {
+    // Stream parameters are needed for copy even if video isn't decoded
+    AVStream *vst = ictx->ic->streams[ictx->vi];
+    dmeta->time_base = vst->time_base;
+    dmeta->r_frame_rate = vst->r_frame_rate;
+    dmeta->avg_frame_rate = vst->avg_frame_rate;
+    if (!dmeta->v_codecpar) dmeta->v_codecpar = avcodec_parameters_alloc();
+    if (dmeta->v_codecpar) avcodec_parameters_copy(dmeta->v_codecpar, vst->codecpar);
+  }
+  if (ictx->vc) {
+    dmeta->v_width = ictx->vc->width;
+    dmeta->v_height = ictx->vc->height;
+    dmeta->in_pix_fmt = ictx->vc->pix_fmt;
+    dmeta->sample_aspect_ratio = ictx->vc->sample_aspect_ratio;
+    dmeta->framerate = ictx->vc->framerate;
+    av_buffer_unref(&dmeta->hw_frames_ctx);
+    // Keep our own reference since the buffer may outlive the decoder
+    if (ictx->vc->hw_frames_ctx) dmeta->hw_frames_ctx = av_buffer_ref(ictx->vc->hw_frames_ctx);
+  }
+  dmeta->has_ac = !!ictx->ac;
+  if (ictx->ac) {
+    dmeta->sample_rate = ictx->ac->sample_rate;
+    dmeta->channels = ictx->ac->channels;
+    dmeta->channel_layout = ictx->ac->channel_layout;
+    dmeta->sample_fmt = ictx->ac->sample_fmt;
+  }
+  if (ictx->ai >= 0) {
+    AVStream *ast = ictx->ic->streams[ictx->ai];
+    dmeta->a_time_base = ast->time_base;
+    if (!dmeta->a_codecpar) dmeta->a_codecpar = avcodec_parameters_alloc();
+    if (dmeta->a_codecpar) avcodec_parameters_copy(dmeta->a_codecpar, ast->codecpar);
+  }
+};
+
+static void set_dmeta_last_frames(struct decode_meta *dmeta, struct input_ctx *ictx)
+{
   if (!dmeta->last_frame_v)
     dmeta->last_frame_v = av_frame_alloc();
   av_frame_unref(dmeta->last_frame_v);
-      // av_frame_ref(last_frame, dframe[dfcount].dec_frame);
   av_frame_ref(dmeta->last_frame_v, ictx->last_frame_v);
+  if (!dmeta->last_frame_a)
+    dmeta->last_frame_a = av_frame_alloc();
+  av_frame_unref(dmeta->last_frame_a);
+  av_frame_ref(dmeta->last_frame_a, ictx->last_frame_a);
 };
 
-int decode(struct transcode_thread *h,
-  input_params *inp, output_results *decoded_results, dframe_buffer *dframe_buf, struct input_ctx *ictx_temp, struct decode_meta *dmeta)
+int lpms_decode_begin(input_params *inp, struct decode_meta *dmeta)
 {
-  int ret = 0, i = 0;
-  int reopen_decoders = 1;
+  int ret = 0;
+  struct transcode_thread *h = inp->dec_handle;
   struct input_ctx *ictx = &h->ictx;
-  ictx->da = 1; //temporary fix to drop audio
-  AVPacket ipkt = {0};
+  if (!dmeta) return AVERROR(ENOMEM);
+  if (!h->initialized) {
+    // populate input context
+    ret = open_input(inp, ictx);
+    if (ret < 0) return ret;
+    h->initialized = 1;
+  }
+  ret = reopen_input(inp, ictx);
+  if (ret < 0) {
+    reset_input(ictx);
+    return ret;
+  }
+  set_dmeta(dmeta, ictx);
+  return 0;
+}
+
+int lpms_decode_frame(input_params *inp, dframemeta *df, output_results *decoded_results)
+{
+  if (!df || !df->dec_frame) return AVERROR(EINVAL);
+  return decode_frame(&inp->dec_handle->ictx, df, decoded_results);
+}
+
+void lpms_decode_end(input_params *inp, struct decode_meta *dmeta)
+{
+  struct input_ctx *ictx = &inp->dec_handle->ictx;
+  // Populate the flush frames before the decoders are torn down
+  if (dmeta) set_dmeta_last_frames(dmeta, ictx);
+  reset_input(ictx);
+}
+
+int lpms_decode(input_params *inp, output_results *decoded_results, dframe_buffer *dframe_buf, struct decode_meta *dmeta)
+{
+  int ret = 0, dfcount = 0;
+  if (!dframe_buf) return AVERROR(ENOMEM);
+  ret = lpms_decode_begin(inp, dmeta);
+  if (ret < 0) return ret;
   dframe_buf->cnt = 0;
-  dframe_buf->dframes =  malloc(sizeof(dframemeta) * MAX_DFRAME_CNT);
-  
-  if (!inp) LPMS_ERR(transcode_cleanup, "Missing input params")
+  while (1) {
+    ret = grow_dframe_buffer(dframe_buf, dfcount, inp->max_frames);
+    if (ret < 0) LPMS_ERR(decode_cleanup, "Unable to buffer decoded frame");
+    ret = lpms_decode_frame(inp, &dframe_buf->dframes[dfcount], decoded_results);
+    if (ret == AVERROR_EOF) break;
+    else if (ret < 0) goto decode_cleanup;
+    dfcount++;
+  }
+  dframe_buf->cnt = dfcount;
 
-  // by default we re-use decoder between segments of same stream
-  // unless we are using SW deocder and had to re-open IO or demuxer
-  if (!ictx->ic) {
-    // reopen demuxer for the input segment if needed
-    // XXX could open_input() be re-used here?
-    ret = avformat_open_input(&ictx->ic, inp->fname, NULL, NULL);
-    if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen demuxer");
-    ret = avformat_find_stream_info(ictx->ic, NULL);
-    if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to find info for reopened stream")
-  } else if (!ictx->ic->pb) {
-    // reopen input segment file IO context if needed
-    ret = avio_open(&ictx->ic->pb, inp->fname, AVIO_FLAG_READ);
-    if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen file");
-  } else reopen_decoders = 0;
-  if (reopen_decoders) {
-    // XXX check to see if we can also reuse decoder for sw decoding
-    if (AV_HWDEVICE_TYPE_CUDA != ictx->hw_type) {
-      ret = open_video_decoder(inp, ictx);
-      if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen video decoder");
-    }
-    ret = open_audio_decoder(inp, ictx);
-    if (ret < 0) LPMS_ERR(transcode_cleanup, "Unable to reopen audio decoder")
+decode_cleanup:
+  lpms_decode_end(inp, dmeta);
+  return ret == AVERROR_EOF ? 0 : ret;
+}
+
+struct decode_meta* alloc_decode_meta(){
+  struct decode_meta *dmeta = malloc(sizeof (struct decode_meta));
+  if (!dmeta) return NULL;
+  memset(dmeta, 0, sizeof *dmeta);
+  return dmeta; 
+}
+
+void free_decode_meta(struct decode_meta *dmeta)
+{
+  if (!dmeta) return;
+  if (dmeta->last_frame_v) av_frame_free(&dmeta->last_frame_v);
+  if (dmeta->last_frame_a) av_frame_free(&dmeta->last_frame_a);
+  if (dmeta->a_codecpar) avcodec_parameters_free(&dmeta->a_codecpar);
+  if (dmeta->v_codecpar) avcodec_parameters_free(&dmeta->v_codecpar);
+  av_buffer_unref(&dmeta->hw_frames_ctx);
+  free(dmeta);
+}
+
+dframemeta* alloc_dframe()
+{
+  dframemeta *df = malloc(sizeof (dframemeta));
+  if (!df) return NULL;
+  memset(df, 0, sizeof *df);
+  av_init_packet(&df->in_pkt);
+  df->dec_frame = av_frame_alloc();
+  if (!df->dec_frame) {
+    free(df);
+    return NULL;
   }
+  return df;
+}
 
-  for(int dfcount=0; dfcount < MAX_DFRAME_CNT; dfcount++){
-    dframe_buf->dframes[dfcount].dec_frame = av_frame_alloc();
-    av_init_packet(&(dframe_buf->dframes[dfcount].in_pkt));
-    if (!dframe_buf->dframes[dfcount].dec_frame) LPMS_ERR(transcode_cleanup, "Unable to allocate frame");
+void free_dframe(dframemeta *df)
+{
+  if (!df) return;
+  av_frame_free(&df->dec_frame);
+  av_packet_unref(&df->in_pkt);
+  free(df);
+}
+
+dframe_buffer* alloc_dframe_buffer()
+{
+  dframe_buffer *dframe_buf = malloc(sizeof (dframe_buffer));
+  if (!dframe_buf) return NULL;
+  memset(dframe_buf, 0, sizeof *dframe_buf);
+  return dframe_buf;
+}
+
+void reset_dframe_buffer(dframe_buffer *dframe_buf)
+{
+  if (!dframe_buf) return;
+  for (int i = 0; i < dframe_buf->cap; i++) {
+    av_frame_unref(dframe_buf->dframes[i].dec_frame);
+    av_packet_unref(&dframe_buf->dframes[i].in_pkt);
+    dframe_buf->dframes[i].has_frame = 0;
   }
-  int dfcount = 0;
+  dframe_buf->cnt = 0;
+}
 
-  clock_t t;
-  t = clock();
-  while (1) {
-    // DEMUXING & DECODING
-    int has_frame = 0;
-    AVStream *ist = NULL;
-    AVFrame *last_frame = NULL;
-    // av_frame_unref(dframe[dfcount].dec_frame);
-    av_frame_unref(dframe_buf->dframes[dfcount].dec_frame);
-    // ret = process_in(ictx, dframe[dfcount].dec_frame, &dframe[dfcount].in_pkt);
-    ret = process_in(ictx, dframe_buf->dframes[dfcount].dec_frame, &dframe_buf->dframes[dfcount].in_pkt);
-    if (ret == AVERROR_EOF) break;
-                            // Bail out on streams that appear to be broken
-    else if (lpms_ERR_PACKET_ONLY == ret) ; // keep going for stream copy
-    else if (ret < 0) LPMS_ERR(transcode_cleanup, "Could not decode; stopping");
-    // ist = ictx->ic->streams[dframe[dfcount].in_pkt.stream_index];
-    ist = ictx->ic->streams[dframe_buf->dframes[dfcount].in_pkt.stream_index];
+void free_dframe_buffer(dframe_buffer *dframe_buf)
+{
+  if (!dframe_buf) return;
+  free_dframes(dframe_buf);
+  free(dframe_buf);
+}
 
-    has_frame = lpms_ERR_PACKET_ONLY != ret;
-    // dframe[dfcount].has_frame = has_frame;  //nick
-    dframe_buf->dframes[dfcount].has_frame = has_frame;  
-    if (AVMEDIA_TYPE_VIDEO == ist->codecpar->codec_type) {
-      // if (is_flush_frame(dframe[dfcount].dec_frame)) continue;
-      if (is_flush_frame(dframe_buf->dframes[dfcount].dec_frame)) continue;
-      // width / height will be zero for pure streamcopy (no decoding)
-      // decoded_results->frames += dframe[dfcount].dec_frame->width && dframe[dfcount].dec_frame->height;
-      // decoded_results->pixels += dframe[dfcount].dec_frame->width * dframe[dfcount].dec_frame->height;
-      // has_frame = has_frame && dframe[dfcount].dec_frame->width && dframe[dfcount].dec_frame->height;
-      // dframe[dfcount].has_frame = has_frame;
-      decoded_results->frames += dframe_buf->dframes[dfcount].dec_frame->width && dframe_buf->dframes[dfcount].dec_frame->height;
-      decoded_results->pixels += dframe_buf->dframes[dfcount].dec_frame->width * dframe_buf->dframes[dfcount].dec_frame->height;
-      has_frame = has_frame && dframe_buf->dframes[dfcount].dec_frame->width && dframe_buf->dframes[dfcount].dec_frame->height;
-      dframe_buf->dframes[dfcount].has_frame = has_frame;
-      if (has_frame) last_frame = ictx->last_frame_v;
-    } else if (AVMEDIA_TYPE_AUDIO == ist->codecpar->codec_type) {
-      // has_frame = has_frame && dframe[dfcount].dec_frame->nb_samples;
-      // dframe[dfcount].has_frame = has_frame;
-      has_frame = has_frame && dframe_buf->dframes[dfcount].dec_frame->nb_samples;
-      dframe_buf->dframes[dfcount].has_frame = has_frame;
-      if (has_frame) last_frame = ictx->last_frame_a;
-    }
-    if (has_frame) {
-      int64_t dur = 0;
-      // if (dframe[dfcount].dec_frame->pkt_duration) dur = dframe[dfcount].dec_frame->pkt_duration;
-      if (dframe_buf->dframes[dfcount].dec_frame->pkt_duration) dur = dframe_buf->dframes[dfcount].dec_frame->pkt_duration;
-      else if (ist->r_frame_rate.den) {
-        dur = av_rescale_q(1, av_inv_q(ist->r_frame_rate), ist->time_base);
-      } else {
-        // TODO use better heuristics for this; look at how ffmpeg does it
-        LPMS_WARN("Could not determine next pts; filter might drop");
-      }
-      // dframe[dfcount].dec_frame->pkt_duration = dur;
-      dframe_buf->dframes[dfcount].dec_frame->pkt_duration = dur;
-      // printf("lastframe %x %x decframe %d %x lastframe=%x\n", ictx->last_frame_a, ictx->last_frame_v, dfcount, dframe_buf->dframes[dfcount].dec_frame, last_frame);
-      av_frame_unref(last_frame);
-      // av_frame_ref(last_frame, dframe[dfcount].dec_frame);
-      av_frame_ref(last_frame, dframe_buf->dframes[dfcount].dec_frame);
-         
-      dfcount++;
-    }
+static int64_t frame_bytes(AVFrame *frame, int64_t *hw_bytes)
+{
+  int64_t bytes = 0;
+  if (frame->hw_frames_ctx) {
+    // The frame data is an opaque surface handle, so size the surface
+    // from the software format of the frames context.
+    AVHWFramesContext *hw_frames = (AVHWFramesContext*)frame->hw_frames_ctx->data;
+    int size = av_image_get_buffer_size(hw_frames->sw_format,
+                                        hw_frames->width, hw_frames->height, 1);
+    if (size > 0) *hw_bytes += size;
+    return 0;
   }
-  t = clock() - t;
-  float time_taken = ((float)t)/CLOCKS_PER_SEC; 
-  printf("Decoding segment took %f seconds\n", time_taken);
-  dframe_buf->cnt = dfcount;
-  	
-transcode_cleanup:
-  if (ictx->ic) {
-    // Only mpegts reuse the demuxer for subsequent segments.
-    // Close the demuxer for everything else.
-    // TODO might be reusable with fmp4 ; check!
-    if (!is_mpegts(ictx->ic)) avformat_close_input(&ictx->ic);
-    else if (ictx->ic->pb) {
-      // Reset leftovers from demuxer internals to prepare for next segment
-      avio_flush(ictx->ic->pb);
-      avformat_flush(ictx->ic);
-      avio_closep(&ictx->ic->pb);
-    }
+  for (int i = 0; i < AV_NUM_DATA_POINTERS && frame->buf[i]; i++) {
+    bytes += frame->buf[i]->size;
   }
-  ictx->flushed = 0;
-  ictx->flushing = 0;
-  ictx->pkt_diff = 0;
-  ictx->sentinel_count = 0;
-  av_packet_unref(&ipkt);  // needed for early exits
-  if (ictx->first_pkt) av_packet_free(&ictx->first_pkt);
-  if (ictx->ac) avcodec_free_context(&ictx->ac);
-  if (ictx->vc && AV_HWDEVICE_TYPE_NONE == ictx->hw_type) avcodec_free_context(&ictx->vc);
-  // copy_ictx(ictx_temp, ictx);
-  set_dmeta(dmeta, ictx);
-  return ret == AVERROR_EOF ? 0 : ret;
+  for (int i = 0; i < frame->nb_extended_buf; i++) {
+    bytes += frame->extended_buf[i]->size;
+  }
+  return bytes;
 }
 
-int lpms_decode(input_params *inp,  output_results *decoded_results, dframe_buffer *dframe_buf, struct input_ctx *ictx, struct decode_meta *dmeta)
+void dframe_buffer_footprint(dframe_buffer *dframe_buf, int64_t *host_bytes, int64_t *hw_bytes)
 {
-  int ret = 0;
-  struct transcode_thread *h = inp->dec_handle;
-  if (!h->initialized) {
-    int i = 0;
-    int decode_a = 0, decode_v = 0;
+  *host_bytes = *hw_bytes = 0;
+  if (!dframe_buf) return;
+  for (int i = 0; i < dframe_buf->cnt; i++) {
+    dframemeta *df = &dframe_buf->dframes[i];
+    if (df->has_frame) *host_bytes += frame_bytes(df->dec_frame, hw_bytes);
+    if (df->in_pkt.buf) *host_bytes += df->in_pkt.buf->size;
+  }
+}
 
-    // populate input context
-    ret = open_input(inp, &h->ictx);
-    // ret = open_input(inp, ictx);
-    if (ret < 0) {
-      return ret;
+int picture_planes(enum AVPixelFormat fmt, int w, int h, int widths[4], int heights[4])
+{
+  int ret = 0, i = 0, nb_planes = 0;
+  const AVPixFmtDescriptor *desc = av_pix_fmt_desc_get(fmt);
+  if (!desc || (desc->flags & AV_PIX_FMT_FLAG_HWACCEL)) return AVERROR(EINVAL);
+  ret = av_image_fill_linesizes(widths, fmt, w);
+  if (ret < 0) return ret;
+  nb_planes = av_pix_fmt_count_planes(fmt);
+  for (i = 0; i < nb_planes; i++) {
+    heights[i] = h;
+    // the chroma planes of planar YUV formats are subsampled
+    if ((i == 1 || i == 2) && !(desc->flags & AV_PIX_FMT_FLAG_RGB)) {
+      heights[i] = AV_CEIL_RSHIFT(h, desc->log2_chroma_h);
     }
   }
-  ret = decode(h, inp, decoded_results, dframe_buf, ictx, dmeta);
-  h->initialized = 1;
+  return nb_planes;
+}
 
+int frame_planes(AVFrame *frame, int *widths, int *heights, int max_planes)
+{
+  int i = 0, nb_planes = 0, planar = 0, size = 0;
+  if (!frame->nb_samples) {
+    if (max_planes < 4) return AVERROR(EINVAL);
+    return picture_planes(frame->format, frame->width, frame->height, widths, heights);
+  }
+  // audio has one plane per channel if planar, otherwise a single plane
+  planar = av_sample_fmt_is_planar(frame->format);
+  nb_planes = planar ? frame->channels : 1;
+  if (nb_planes > max_planes) return AVERROR(EINVAL);
+  size = av_samples_get_buffer_size(NULL, planar ? 1 : frame->channels,
+                                    frame->nb_samples, frame->format, 1);
+  if (size < 0) return size;
+  for (i = 0; i < nb_planes; i++) {
+    widths[i] = size;
+    heights[i] = 1;
+  }
+  return nb_planes;
+}
+
+int map_host_frame(AVFrame *dst, AVFrame *src, int sizes[AV_NUM_DATA_POINTERS])
+{
+  int ret = 0, i = 0, nb_planes = 0;
+  int widths[4], heights[4];
+  if (src->hw_frames_ctx) {
+    // Surfaces aren't addressable from the host, so download a copy
+    ret = av_hwframe_transfer_data(dst, src, 0);
+    if (ret < 0) LPMS_ERR(map_frame_err, "Unable to download hardware frame");
+    ret = av_frame_copy_props(dst, src);
+    if (ret < 0) LPMS_ERR(map_frame_err, "Unable to copy frame properties");
+  } else {
+    ret = av_frame_ref(dst, src);
+    if (ret < 0) LPMS_ERR(map_frame_err, "Unable to reference frame");
+  }
+  nb_planes = picture_planes(dst->format, dst->width, dst->height, widths, heights);
+  if (nb_planes < 0) {
+    ret = nb_planes;
+    LPMS_ERR(map_frame_err, "Unknown pixel format");
+  }
+  for (i = 0; i < nb_planes; i++) sizes[i] = dst->linesize[i] * heights[i];
+  return nb_planes;
+
+map_frame_err:
+  av_frame_unref(dst);
   return ret;
 }
 
-struct decode_meta* alloc_decode_meta(){
-  struct decode_meta *dmeta = malloc(sizeof (struct decode_meta));
-  if (!dmeta) return NULL;
-  memset(dmeta, 0, sizeof *dmeta);
-  return dmeta; 
-}
\ No newline at end of file
+int append_dframe(dframe_buffer *dframe_buf, int max, dframemeta **df)
+{
+  int ret = grow_dframe_buffer(dframe_buf, dframe_buf->cnt, max);
+  if (ret < 0) return ret;
+  *df = &dframe_buf->dframes[dframe_buf->cnt++];
+  (*df)->in_pkt.stream_index = 0;
+  (*df)->has_frame = 0;
+  return 0;
+}
+
+int set_dmeta_frames(struct decode_meta *dmeta, dframe_buffer *dframe_buf,
+  AVRational time_base, AVRational framerate)
+{
+  int ret = 0, i = 0;
+  AVFrame *first = NULL, *last = NULL;
+  int64_t dur = av_rescale_q(1, av_inv_q(framerate), time_base);
+  if (!dframe_buf->cnt) LPMS_ERR(set_dmeta_frames_err, "No frames supplied");
+  first = dframe_buf->dframes[0].dec_frame;
+  for (i = 0; i < dframe_buf->cnt; i++) {
+    AVFrame *frame = dframe_buf->dframes[i].dec_frame;
+    if (frame->width != first->width || frame->height != first->height ||
+        frame->format != first->format) {
+      LPMS_ERR(set_dmeta_frames_err, "Supplied frames differ in size or pixel format");
+    }
+    if (last && frame->pts <= last->pts) {
+      LPMS_ERR(set_dmeta_frames_err, "Supplied frames are out of order");
+    }
+    if (!frame->pkt_duration) frame->pkt_duration = dur;
+    last = frame;
+  }
+
+  // The frames form a video-only stream, as if from a single input
+  dmeta->vi = 0;
+  dmeta->ai = -1;
+  dmeta->has_ac = 0;
+  dmeta->hw_type = AV_HWDEVICE_TYPE_NONE;
+  dmeta->v_width = first->width;
+  dmeta->v_height = first->height;
+  dmeta->in_pix_fmt = first->format;
+  dmeta->time_base = time_base;
+  dmeta->sample_aspect_ratio = (AVRational){1, 1};
+  dmeta->framerate = dmeta->r_frame_rate = dmeta->avg_frame_rate = framerate;
+  if (!dmeta->last_frame_v) dmeta->last_frame_v = av_frame_alloc();
+  if (!dmeta->last_frame_a) dmeta->last_frame_a = av_frame_alloc();
+  if (!dmeta->last_frame_v || !dmeta->last_frame_a) {
+    ret = AVERROR(ENOMEM);
+    LPMS_ERR(set_dmeta_frames_err, "Unable to alloc last frames");
+  }
+  av_frame_unref(dmeta->last_frame_v);
+  ret = av_frame_ref(dmeta->last_frame_v, last);
+  if (ret < 0) LPMS_ERR(set_dmeta_frames_err, "Unable to reference last frame");
+  return 0;
+
+set_dmeta_frames_err:
+  return ret;
+}
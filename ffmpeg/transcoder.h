@@ -11,10 +11,13 @@
 extern const int lpms_ERR_INPUT_PIXFMT;
 extern const int lpms_ERR_INPUT_CODEC;
 extern const int lpms_ERR_FILTERS;
+extern const int lpms_ERR_FILTER_PARSE;
+extern const int lpms_ERR_FILTER_CONFIG;
 extern const int lpms_ERR_PACKET_ONLY;
 extern const int lpms_ERR_FILTER_FLUSHED;
 extern const int lpms_ERR_OUTPUTS;
 extern const int lpms_ERR_DTS;
+extern const int lpms_ERR_DFRAME_LIMIT;
 
 struct transcode_thread;
 
@@ -26,8 +29,12 @@ typedef struct {
 typedef struct {
   char *fname;
   char *vfilters;
+  char *afilters; // optional; defaults to 44.1kHz stereo
   int w, h, bitrate, gop_time;
   AVRational fps;
+  // Write the output into memory, returned within output_results, rather
+  // than into fname. fname then only serves as a hint for the format.
+  int to_memory;
 
   component_opts muxer;
   component_opts audio;
@@ -42,12 +49,17 @@ typedef struct {
 } dframemeta;
 
 typedef struct {
-    int cnt;
+    int cnt; // number of entries in use
+    int cap; // number of allocated entries
     dframemeta *dframes;
 } dframe_buffer;
 
 typedef struct {
   char *fname;
+  // Optional in-memory input. If set, the segment is read from here rather
+  // than from fname, which then only serves as a hint for the format.
+  uint8_t *data;
+  int64_t data_size;
   dframe_buffer *dframe_buffer;
   // Handle to a transcode thread.
   // If null, a new transcode thread is allocated.
@@ -60,11 +72,31 @@ typedef struct {
   // Optional hardware acceleration
   enum AVHWDeviceType hw_type;
   char *device;
+
+  // Maximum number of decoded frames buffered per segment.
+  // Zero for the default (MAX_DFRAME_CNT)
+  int max_frames;
+
+  // Optional in and out points. Decoded frames before the in point and from
+  // the out point on are dropped. Times are in microseconds from the start
+  // of the input; frames count decoded video frames from zero.
+  int64_t trim_in_us, trim_out_us;
+  int trim_in_frame, trim_out_frame;
 } input_params;
 
 typedef struct {
     int frames;
     int64_t pixels;
+    // Time spent in each stage, in microseconds
+    int64_t decode_us;
+    int64_t filter_us;
+    int64_t encode_us; // including opening the encoder
+    int64_t mux_us;
+    // Output written to memory, if requested. Must be freed with av_free.
+    uint8_t *data;
+    int data_size;
+    // Details of why the output failed, if known
+    char err[256];
 } output_results;
 
 struct decode_meta{
@@ -74,13 +106,24 @@ struct decode_meta{
     int ai;
     enum AVPixelFormat in_pix_fmt;
     enum AVHWDeviceType hw_type;
-    AVRational time_base;
+    AVRational time_base; // video stream time base
     AVRational sample_aspect_ratio;
     AVRational framerate;
     AVRational r_frame_rate;
+    AVRational avg_frame_rate;
+    AVCodecParameters *v_codecpar; // for video stream copy
     AVBufferRef *hw_frames_ctx;
     AVFrame *last_frame_v;
     AVFrame *last_frame_a;
+
+    // Audio parameters. Only valid if the audio decoder was open (has_ac)
+    int has_ac;
+    int sample_rate;
+    int channels;
+    uint64_t channel_layout;
+    enum AVSampleFormat sample_fmt;
+    AVRational a_time_base;
+    AVCodecParameters *a_codecpar; // for audio stream copy
 };
 enum LPMSLogLevel {
   LPMS_LOG_TRACE    = AV_LOG_TRACE,
@@ -98,13 +141,46 @@ void lpms_init(enum LPMSLogLevel max_level);
 int  lpms_transcode(input_params *inp, output_params *params, output_results *results, int nb_outputs, output_results *decoded_results);
 struct transcode_thread* lpms_transcode_new();
 void lpms_transcode_stop(struct transcode_thread* handle);
-int lpms_encode(input_params *inp, dframe_buffer *dframe_buffer, output_params *params,
-  output_results *results, int nb_outputs, output_results *decoded_results, struct decode_meta *dmeta);
+// Aborts the call in progress on the handle with AVERROR_EXIT, and keeps
+// aborting calls until cleared. Safe to call from any thread.
+void lpms_transcode_interrupt(struct transcode_thread* handle, int interrupt);
+// Number of hardware encoder sessions held by the handle
+int lpms_hw_sessions(struct transcode_thread* handle);
 int lpms_encode1(input_params *inp, dframe_buffer *dframe_buffer, output_params *params,
   output_results *results, int nb_outputs, output_results *decoded_results, struct decode_meta *dmeta);
+// Streaming variants of lpms_decode / lpms_encode1. Frames are decoded and
+// encoded one at a time between the begin and end calls.
+int lpms_decode_begin(input_params *inp, struct decode_meta *dmeta);
+int lpms_decode_frame(input_params *inp, dframemeta *df, output_results *decoded_results);
+void lpms_decode_end(input_params *inp, struct decode_meta *dmeta);
+int lpms_encode_begin(input_params *inp, output_params *params,
+  output_results *results, int nb_outputs, struct decode_meta *dmeta);
+int lpms_encode_frame(input_params *inp, dframemeta *df, struct decode_meta *dmeta);
+int lpms_encode_end(input_params *inp, struct decode_meta *dmeta, int flush);
 int deep_copy_avframe(AVFrame *dest, AVFrame *src);
 struct decode_meta* alloc_decode_meta();
 void free_decode_meta(struct decode_meta* dmeta);
+dframemeta* alloc_dframe();
+void free_dframe(dframemeta *df);
+dframe_buffer* alloc_dframe_buffer();
+void reset_dframe_buffer(dframe_buffer *dframe_buf);
+void free_dframe_buffer(dframe_buffer *dframe_buf);
+// Bytes held by the buffered frames in host and hardware (device) memory
+void dframe_buffer_footprint(dframe_buffer *dframe_buf, int64_t *host_bytes, int64_t *hw_bytes);
+// Makes a decoded picture readable from the host into `dst`, referencing
+// software frames and downloading hardware frames. Fills in the size of each
+// plane and returns the number of planes, or a negative error.
+int map_host_frame(AVFrame *dst, AVFrame *src, int sizes[AV_NUM_DATA_POINTERS]);
+// Fills in the bytes per row and number of rows of each plane of a software
+// picture. Returns the number of planes, or a negative error.
+int picture_planes(enum AVPixelFormat fmt, int w, int h, int widths[4], int heights[4]);
+// As picture_planes, for either an audio or a video frame in host memory.
+int frame_planes(AVFrame *frame, int *widths, int *heights, int max_planes);
+// Frames supplied by the caller rather than decoded. Entries are appended to
+// the buffer and filled in, then the metadata is set up to describe them.
+int append_dframe(dframe_buffer *dframe_buf, int max, dframemeta **df);
+int set_dmeta_frames(struct decode_meta *dmeta, dframe_buffer *dframe_buf,
+  AVRational time_base, AVRational framerate);
 // struct decode_thread* lpms_decode_new();
 // void lpms_decode_stop(struct decode_thread* handle);
 // void set_ictx(struct transcode_thread *h, input_ctx *ictx);
@@ -1,6 +1,7 @@
 package ffmpeg
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -17,6 +18,22 @@ const (
 	FormatMP4
 )
 
+type VideoCodec int
+
+const (
+	H264 VideoCodec = iota
+	H265
+	VP9
+	AV1
+)
+
+var VideoCodecName = map[VideoCodec]string{
+	H264: "H.264",
+	H265: "HEVC",
+	VP9:  "VP9",
+	AV1:  "AV1",
+}
+
 type Profile int
 
 const (
@@ -25,6 +42,9 @@ const (
 	ProfileH264Main
 	ProfileH264High
 	ProfileH264ConstrainedHigh
+	ProfileH265Main
+	ProfileVP9Profile0
+	ProfileAV1Main
 )
 
 // For additional "special" GOP values
@@ -55,6 +75,85 @@ type VideoProfile struct {
 	Format       Format
 	Profile      Profile
 	GOP          time.Duration
+	// Codec to encode with. Defaults to H.264. The encoder used for each
+	// codec is in VideoEncoders; AV1 is only encoded with libaom.
+	Encoder VideoCodec
+	// Codec level such as "4.1". If unset, the encoder picks one.
+	Level string
+	// How the encoder spends bits. Unset uses Bitrate as both the target
+	// and the cap.
+	RateControl RateControl
+	// Speed and quality tradeoff, and what to tune the encoder for. These
+	// are translated for each encoder. Like other encoder options, they
+	// keep outputs from sharing a hardware session unless they're the same.
+	Preset Preset
+	Tune   Tune
+	// How the source is fit into Resolution. Other than the default, the
+	// output is exactly Resolution with pixels shaped so that it displays
+	// at AspectRatio.
+	AspectMode AspectMode
+}
+
+type AspectMode int
+
+const (
+	// Keep the source aspect ratio, scaling the larger dimension of the
+	// source to that of Resolution. The other one may be smaller.
+	AspectKeep AspectMode = iota
+	// Fit within Resolution, padding the rest with black bars
+	AspectPad
+	// Fill Resolution, cropping whatever is outside
+	AspectCrop
+	// Scale to Resolution, distorting the source if its aspect ratio differs
+	AspectStretch
+)
+
+type Preset int
+
+const (
+	PresetDefault Preset = iota
+	PresetFastest
+	PresetFast
+	PresetMedium
+	PresetSlow
+	PresetSlowest
+)
+
+type Tune int
+
+const (
+	TuneNone Tune = iota
+	// Minimize encoder delay, eg for live streams
+	TuneZeroLatency
+	// High quality live action content
+	TuneFilm
+	// Cartoons and the like
+	TuneAnimation
+)
+
+type RateControlMode int
+
+const (
+	RateControlDefault RateControlMode = iota
+	// Constant bitrate at Bitrate
+	RateControlCBR
+	// Variable bitrate averaging Bitrate, capped at MaxBitrate
+	RateControlVBR
+	// Constant quality, optionally capped at MaxBitrate. Bitrate is ignored.
+	RateControlCRF
+)
+
+type RateControl struct {
+	Mode RateControlMode
+	// Peak bitrate, eg "6000k". Required for VBR.
+	MaxBitrate string
+	// Size of the rate control buffer in bits, eg "6000k". The peak may be
+	// exceeded over shorter periods than the buffer covers. Defaults to one
+	// second at the peak bitrate.
+	BufferSize string
+	// CRF for software encoders or CQ for Nvidia, where lower is better.
+	// Ranges from 1 to 51 for H.264 and HEVC, or 1 to 63 for VP9 and AV1.
+	Quality int
 }
 
 //Some sample video profiles
@@ -107,6 +206,41 @@ var ProfileParameters = map[Profile]string{
 	ProfileH264Main:            "main",
 	ProfileH264High:            "high",
 	ProfileH264ConstrainedHigh: "high",
+	ProfileH265Main:            "main",
+	ProfileVP9Profile0:         "0",
+	ProfileAV1Main:             "0",
+}
+
+// Codec that each profile belongs to
+var ProfileCodecs = map[Profile]VideoCodec{
+	ProfileH264Baseline:        H264,
+	ProfileH264Main:            H264,
+	ProfileH264High:            H264,
+	ProfileH264ConstrainedHigh: H264,
+	ProfileH265Main:            H265,
+	ProfileVP9Profile0:         VP9,
+	ProfileAV1Main:             AV1,
+}
+
+// Codecs that may be carried by muxers with restrictions. Muxers not listed
+// here are not checked.
+var muxerCodecs = map[string][]VideoCodec{
+	"mpegts": {H264, H265},
+	"flv":    {H264},
+	"webm":   {VP9, AV1},
+}
+
+func muxerSupportsCodec(muxer string, codec VideoCodec) bool {
+	codecs, ok := muxerCodecs[muxer]
+	if !ok {
+		return true
+	}
+	for _, c := range codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
 }
 
 func VideoProfileResolution(p VideoProfile) (int, int, error) {
@@ -125,17 +259,260 @@ func VideoProfileResolution(p VideoProfile) (int, int, error) {
 	return w, h, nil
 }
 
+// sampleAspect returns the shape of the pixels that makes a w x h picture
+// display at the profile's AspectRatio, such as 32:27 for 720x480 at 16:9.
+// Pixels are square if no aspect ratio is given.
+func sampleAspect(p VideoProfile, w, h int) (int, int, error) {
+	if w <= 0 || h <= 0 {
+		return 0, 0, ErrTranscoderRes
+	}
+	if p.AspectRatio == "" {
+		return 1, 1, nil
+	}
+	ar := strings.Split(p.AspectRatio, ":")
+	if len(ar) != 2 {
+		return 0, 0, ErrTranscoderAsp
+	}
+	n, err := strconv.Atoi(ar[0])
+	if err != nil || n <= 0 {
+		return 0, 0, ErrTranscoderAsp
+	}
+	d, err := strconv.Atoi(ar[1])
+	if err != nil || d <= 0 {
+		return 0, 0, ErrTranscoderAsp
+	}
+	n, d = n*h, d*w
+	a, b := n, d
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return n / a, d / a, nil
+}
+
+// parseBitrate converts a bitrate such as "4000k" into bits per second
+func parseBitrate(br string) (int, error) {
+	return strconv.Atoi(strings.Replace(br, "k", "000", 1))
+}
+
+// peakBitrate returns the highest bitrate the profile's rate control allows
+// over the length of its buffer.
+func peakBitrate(p VideoProfile) string {
+	switch p.RateControl.Mode {
+	case RateControlVBR, RateControlCRF:
+		if p.RateControl.MaxBitrate != "" {
+			return p.RateControl.MaxBitrate
+		}
+	}
+	return p.Bitrate
+}
+
+// VideoProfileToVariantParams returns the HLS variant attributes of the
+// profile. Codecs assume the profile is encoded in software, and only list
+// video; see TranscodeOptionsToVariantParams.
 func VideoProfileToVariantParams(p VideoProfile) m3u8.VariantParams {
+	return variantParams(p, VideoEncoders[Software][p.Encoder])
+}
+
+// TranscodeOptionsToVariantParams is like VideoProfileToVariantParams, but
+// accounts for the encoders selected by the options. AAC audio is listed
+// if audio is encoded.
+func TranscodeOptionsToVariantParams(o TranscodeOptions) m3u8.VariantParams {
+	encoder := o.VideoEncoder.Name
+	if encoder == "" {
+		encoder = VideoEncoders[o.Accel][o.Profile.Encoder]
+	}
+	params := variantParams(o.Profile, encoder)
+	if encoder == "drop" || encoder == "copy" {
+		// No video, or whatever the source was encoded with
+		params.Codecs = ""
+	}
+	if o.AudioEncoder.Name == "" || o.AudioEncoder.Name == "aac" {
+		codecs := []string{}
+		if params.Codecs != "" {
+			codecs = append(codecs, params.Codecs)
+		}
+		// AAC-LC, the default profile of the encoder
+		params.Codecs = strings.Join(append(codecs, "mp4a.40.2"), ",")
+	}
+	return params
+}
+
+func variantParams(p VideoProfile, encoder string) m3u8.VariantParams {
 	r := p.Resolution
 	r = strings.Replace(r, ":", "x", 1)
 
-	bw := p.Bitrate
+	// Players expect BANDWIDTH to be the peak rather than the average
+	bw := peakBitrate(p)
 	bw = strings.Replace(bw, "k", "000", 1)
 	b, err := strconv.ParseUint(bw, 10, 32)
 	if err != nil {
 		glog.Errorf("Error converting %v to variant params: %v", bw, err)
 	}
-	return m3u8.VariantParams{Bandwidth: uint32(b), Resolution: r}
+	codecs := videoCodecString(p, encoder)
+	return m3u8.VariantParams{Bandwidth: uint32(b), Resolution: r, Codecs: codecs}
+}
+
+type codecLevel struct {
+	major, minor int
+	picSize      int64 // max luma samples per picture
+	sampleRate   int64 // max luma samples per second
+	bitrate      int64 // max bits per second
+}
+
+// Level limits for each codec, from the respective specifications.
+// H.264 limits are in macroblocks of 256 samples.
+var codecLevels = map[VideoCodec][]codecLevel{
+	H264: {
+		{1, 0, 99 * 256, 1485 * 256, 64000},
+		{1, 1, 396 * 256, 3000 * 256, 192000},
+		{1, 2, 396 * 256, 6000 * 256, 384000},
+		{1, 3, 396 * 256, 11880 * 256, 768000},
+		{2, 0, 396 * 256, 11880 * 256, 2000000},
+		{2, 1, 792 * 256, 19800 * 256, 4000000},
+		{2, 2, 1620 * 256, 20250 * 256, 4000000},
+		{3, 0, 1620 * 256, 40500 * 256, 10000000},
+		{3, 1, 3600 * 256, 108000 * 256, 14000000},
+		{3, 2, 5120 * 256, 216000 * 256, 20000000},
+		{4, 0, 8192 * 256, 245760 * 256, 20000000},
+		{4, 1, 8192 * 256, 245760 * 256, 50000000},
+		{4, 2, 8704 * 256, 522240 * 256, 50000000},
+		{5, 0, 22080 * 256, 589824 * 256, 135000000},
+		{5, 1, 36864 * 256, 983040 * 256, 240000000},
+		{5, 2, 36864 * 256, 2073600 * 256, 240000000},
+	},
+	H265: {
+		{1, 0, 36864, 552960, 128000},
+		{2, 0, 122880, 3686400, 1500000},
+		{2, 1, 245760, 7372800, 3000000},
+		{3, 0, 552960, 16588800, 6000000},
+		{3, 1, 983040, 33177600, 10000000},
+		{4, 0, 2228224, 66846720, 12000000},
+		{4, 1, 2228224, 133693440, 20000000},
+		{5, 0, 8912896, 267386880, 25000000},
+		{5, 1, 8912896, 534773760, 40000000},
+		{5, 2, 8912896, 1069547520, 60000000},
+		{6, 0, 35651584, 1069547520, 60000000},
+		{6, 1, 35651584, 2139095040, 120000000},
+		{6, 2, 35651584, 4278190080, 240000000},
+	},
+	VP9: {
+		{1, 0, 36864, 829440, 200000},
+		{1, 1, 73728, 2764800, 800000},
+		{2, 0, 122880, 4608000, 1800000},
+		{2, 1, 245760, 9216000, 3600000},
+		{3, 0, 552960, 20736000, 7200000},
+		{3, 1, 983040, 36864000, 12000000},
+		{4, 0, 2228224, 83558400, 18000000},
+		{4, 1, 2228224, 160432128, 30000000},
+		{5, 0, 8912896, 311951360, 60000000},
+		{5, 1, 8912896, 588251136, 120000000},
+		{5, 2, 8912896, 1176502272, 180000000},
+		{6, 0, 35651584, 1176502272, 180000000},
+		{6, 1, 35651584, 2353004544, 240000000},
+		{6, 2, 35651584, 4706009088, 480000000},
+	},
+	AV1: {
+		{2, 0, 147456, 4423680, 1500000},
+		{2, 1, 278784, 8363520, 3000000},
+		{3, 0, 665856, 19975680, 6000000},
+		{3, 1, 1065024, 31950720, 10000000},
+		{4, 0, 2359296, 70778880, 12000000},
+		{4, 1, 2359296, 141557760, 20000000},
+		{5, 0, 8912896, 267386880, 30000000},
+		{5, 1, 8912896, 534773760, 40000000},
+		{5, 2, 8912896, 1069547520, 60000000},
+		{5, 3, 8912896, 1069547520, 60000000},
+		{6, 0, 35651584, 1069547520, 60000000},
+		{6, 1, 35651584, 2139095040, 100000000},
+		{6, 2, 35651584, 4278190080, 160000000},
+		{6, 3, 35651584, 4278190080, 160000000},
+	},
+}
+
+// videoLevel returns the profile's level, or the lowest level that fits the
+// profile's resolution, framerate and bitrate if no level is set.
+func videoLevel(p VideoProfile) (int, int) {
+	if p.Level != "" {
+		var major, minor int
+		if _, err := fmt.Sscanf(p.Level, "%d.%d", &major, &minor); err == nil {
+			return major, minor
+		}
+		if _, err := fmt.Sscanf(p.Level, "%d", &major); err == nil {
+			return major, 0
+		}
+		glog.Errorf("Invalid level %v; estimating instead", p.Level)
+	}
+	levels := codecLevels[p.Encoder]
+	if len(levels) <= 0 {
+		return 0, 0
+	}
+	w, h, _ := VideoProfileResolution(p)
+	// Passthrough framerate is unknown, so assume a typical one
+	fps := float64(30)
+	if p.Framerate > 0 {
+		fps = float64(p.Framerate)
+		if p.FramerateDen > 0 {
+			fps /= float64(p.FramerateDen)
+		}
+	}
+	bitrate, _ := strconv.ParseInt(strings.Replace(peakBitrate(p), "k", "000", 1), 10, 64)
+	size := int64(w * h)
+	rate := int64(float64(size) * fps)
+	for _, l := range levels {
+		if size <= l.picSize && rate <= l.sampleRate && bitrate <= l.bitrate {
+			return l.major, l.minor
+		}
+	}
+	l := levels[len(levels)-1]
+	return l.major, l.minor
+}
+
+// videoCodecString returns the RFC 6381 codec string for the profile encoded
+// with the given encoder, as used in the CODECS attribute of HLS variants.
+// Empty if the codec string can't be known.
+func videoCodecString(p VideoProfile, encoder string) string {
+	major, minor := videoLevel(p)
+	switch p.Encoder {
+	case H264:
+		profile := p.Profile
+		if profile == ProfileNone {
+			// Each encoder has its own default
+			switch encoder {
+			case "libx264":
+				profile = ProfileH264High
+			case "h264_nvenc":
+				profile = ProfileH264Main
+			default:
+				return ""
+			}
+		}
+		// profile_idc and constraint flags, as written by the encoders
+		var idc, flags int
+		switch profile {
+		case ProfileH264Baseline:
+			idc, flags = 0x42, 0xC0
+		case ProfileH264Main:
+			idc, flags = 0x4D, 0x40
+		case ProfileH264High:
+			idc, flags = 0x64, 0x00
+		case ProfileH264ConstrainedHigh:
+			// constraint_set4 and constraint_set5
+			idc, flags = 0x64, 0x0C
+		default:
+			return ""
+		}
+		return fmt.Sprintf("avc1.%02X%02X%02X", idc, flags, major*10+minor)
+	case H265:
+		// Main profile, main tier
+		return fmt.Sprintf("hvc1.1.6.L%d.B0", (major*10+minor)*3)
+	case VP9:
+		// Profile 0, 8 bit
+		return fmt.Sprintf("vp09.00.%02d.08", major*10+minor)
+	case AV1:
+		// Main profile, main tier, 8 bit
+		return fmt.Sprintf("av01.0.%02dM.08", (major-2)*4+minor)
+	}
+	return ""
 }
 
 type ByName []VideoProfile
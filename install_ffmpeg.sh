@@ -23,11 +23,40 @@ if [ ! -e "$HOME/x264/x264" ]; then
   make install-lib-static
 fi
 
+if [ ! -e "$HOME/x265/build/linux/x265" ]; then
+  git clone https://bitbucket.org/multicoreware/x265_git.git "$HOME/x265"
+  cd "$HOME/x265/build/linux"
+  git checkout 3.4
+  cmake -G "Unix Makefiles" -DCMAKE_INSTALL_PREFIX="$HOME/compiled" -DENABLE_SHARED=off ../../source
+  make
+  make install
+fi
+
+if [ ! -e "$HOME/libvpx/libvpx.a" ]; then
+  git clone https://chromium.googlesource.com/webm/libvpx.git "$HOME/libvpx"
+  cd "$HOME/libvpx"
+  git checkout v1.9.0
+  ./configure --prefix="$HOME/compiled" --enable-pic --disable-examples --disable-unit-tests --enable-vp9-highbitdepth
+  make
+  make install
+fi
+
+if [ ! -e "$HOME/aom_build/libaom.a" ]; then
+  git clone https://aomedia.googlesource.com/aom "$HOME/aom" || echo "libaom dir already exists"
+  cd "$HOME/aom"
+  git checkout v1.0.0
+  mkdir -p "$HOME/aom_build"
+  cd "$HOME/aom_build"
+  cmake -G "Unix Makefiles" -DCMAKE_INSTALL_PREFIX="$HOME/compiled" -DENABLE_SHARED=off -DENABLE_TESTS=0 -DENABLE_EXAMPLES=0 "$HOME/aom"
+  make
+  make install
+fi
+
 if [ ! -e "$HOME/ffmpeg/libavcodec/libavcodec.a" ]; then
   git clone https://git.ffmpeg.org/ffmpeg.git "$HOME/ffmpeg" || echo "FFmpeg dir already exists"
   cd "$HOME/ffmpeg"
   git checkout 3ea705767720033754e8d85566460390191ae27d
-  ./configure --prefix="$HOME/compiled" --enable-libx264 --enable-gnutls --enable-gpl --enable-static
+  ./configure --prefix="$HOME/compiled" --enable-libx264 --enable-libx265 --enable-libvpx --enable-libaom --enable-gnutls --enable-gpl --enable-static --pkg-config-flags="--static" --extra-libs="-lpthread -lm"
   make
   make install
 fi
@@ -1,10 +1,7 @@
 package transcoder
 
 import (
-	"fmt"
-	"io/ioutil"
-	"os"
-	"path"
+	"bytes"
 	"path/filepath"
 
 	"github.com/golang/glog"
@@ -17,27 +14,44 @@ type FFMpegSegmentTranscoder struct {
 	workDir   string
 }
 
+// Renditions are kept in memory, so workd is no longer written to.
 func NewFFMpegSegmentTranscoder(ps []ffmpeg.VideoProfile, workd string) *FFMpegSegmentTranscoder {
 	return &FFMpegSegmentTranscoder{tProfiles: ps, workDir: workd}
 }
 
 func (t *FFMpegSegmentTranscoder) Transcode(fname string) ([][]byte, error) {
+	return t.transcode(&ffmpeg.TranscodeOptionsIn{Fname: fname, Accel: ffmpeg.Software})
+}
+
+// TranscodeData transcodes a segment held in memory, without writing it to
+// disk first. The name is used as a hint for the input and output formats.
+func (t *FFMpegSegmentTranscoder) TranscodeData(name string, data []byte) ([][]byte, error) {
+	return t.transcode(&ffmpeg.TranscodeOptionsIn{Fname: name, Data: data, Accel: ffmpeg.Software})
+}
+
+func (t *FFMpegSegmentTranscoder) transcode(in *ffmpeg.TranscodeOptionsIn) ([][]byte, error) {
+	outs := make([]bytes.Buffer, len(t.tProfiles))
+	opts := make([]ffmpeg.TranscodeOptions, len(t.tProfiles))
+	for i, p := range t.tProfiles {
+		opts[i] = ffmpeg.TranscodeOptions{
+			// Only a hint for the muxer; outputs are kept in memory
+			Oname:   filepath.Base(in.Fname),
+			Writer:  &outs[i],
+			Profile: p,
+			Accel:   ffmpeg.Software,
+		}
+	}
+
 	//Invoke ffmpeg
-	err := ffmpeg.Transcode(fname, t.workDir, t.tProfiles)
+	err := ffmpeg.Transcode2(in, opts)
 	if err != nil {
 		glog.Errorf("Error transcoding: %v", err)
 		return nil, err
 	}
 
 	dout := make([][]byte, len(t.tProfiles), len(t.tProfiles))
-	for i, _ := range t.tProfiles {
-		ofile := path.Join(t.workDir, fmt.Sprintf("out%v%v", i, filepath.Base(fname)))
-		d, err := ioutil.ReadFile(ofile)
-		if err != nil {
-			glog.Errorf("Cannot read transcode output: %v", err)
-		}
-		dout[i] = d
-		os.Remove(ofile)
+	for i := range outs {
+		dout[i] = outs[i].Bytes()
 	}
 
 	return dout, nil
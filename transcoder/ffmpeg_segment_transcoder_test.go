@@ -50,9 +50,42 @@ func TestTrans(t *testing.T) {
 	}
 }
 
+func TestTransData(t *testing.T) {
+	configs := []ffmpeg.VideoProfile{
+		ffmpeg.P144p30fps16x9,
+		ffmpeg.P240p30fps16x9,
+	}
+	ffmpeg.InitFFmpeg()
+	d, err := ioutil.ReadFile("test.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := NewFFMpegSegmentTranscoder(configs, "./")
+	r, err := tr.TranscodeData("data.ts", d)
+	if err != nil {
+		t.Errorf("Error transcoding: %v", err)
+	}
+
+	if len(r) != 2 {
+		t.Errorf("Expecting 2 output segments, got %v", len(r))
+	}
+
+	if len(r[0]) < 250000 || len(r[0]) > 285000 {
+		t.Errorf("Expecting output size to be between 250000 and 285000 , got %v", len(r[0]))
+	}
+
+	if len(r[1]) < 280000 || len(r[1]) > 314000 {
+		t.Errorf("Expecting output size to be between 280000 and 314000 , got %v", len(r[1]))
+	}
+
+	if _, err := os.Stat("out0data.ts"); !os.IsNotExist(err) {
+		t.Errorf("Expecting outputs to be cleaned up")
+	}
+}
+
 func TestInvalidProfiles(t *testing.T) {
 
-	// 11 profiles; max 10
+	// 11 profiles; more than the original limit of 10
 	configs := []ffmpeg.VideoProfile{
 		ffmpeg.P144p30fps16x9,
 		ffmpeg.P240p30fps16x9,
@@ -68,11 +101,11 @@ func TestInvalidProfiles(t *testing.T) {
 	}
 	ffmpeg.InitFFmpeg()
 	tr := NewFFMpegSegmentTranscoder(configs, "./")
-	_, err := tr.Transcode("test.ts")
-	if err == nil {
-		t.Errorf("Expected an error transcoding too many segments")
-	} else if err.Error() != "Too many outputs" {
-		t.Errorf("Did not get the expected error while transcoding: %v", err)
+	r, err := tr.Transcode("test.ts")
+	if err != nil {
+		t.Error(err)
+	} else if len(r) != len(configs) {
+		t.Errorf("Expecting %v output segments, got %v", len(configs), len(r))
 	}
 
 	// no profiles
@@ -191,10 +224,10 @@ func TestInvalidFile(t *testing.T) {
 		t.Error(err)
 	}
 
-	// test bad output file names / directories
+	// outputs are kept in memory, so the work dir doesn't need to exist
 	tr = NewFFMpegSegmentTranscoder(configs, "/asdf/qwerty!")
-	_, err = tr.Transcode("test.ts")
-	if err == nil || err.Error() != "No such file or directory" {
+	r, err := tr.Transcode("test.ts")
+	if err != nil || len(r) != 1 || len(r[0]) == 0 {
 		t.Error(err)
 	}
 }